@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"loq7tts-server/loquendo"
+	"loq7tts-server/pkg/cache"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxCachedAudio is the size above which the audio of a synthesis is not cached.
+const maxCachedAudio = 64 << 20
+
+// newCache creates the synthesis cache for the given backend, or returns nil if it is disabled.
+func newCache(backend, dir string, maxSize int64, ttl time.Duration) (cache.Cache, error) {
+	switch backend {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return cache.NewMemory(maxSize, ttl), nil
+	case "disk":
+		return cache.NewDisk(dir, maxSize, ttl)
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q (must be none, memory or disk)", backend)
+	}
+}
+
+// speechKey identifies the audio of a synthesis: two requests with the same key get the same bytes.
+type speechKey struct {
+	Input      string     `json:"input"`
+	Voice      string     `json:"voice"`
+	Language   string     `json:"language,omitempty"`
+	Style      string     `json:"style,omitempty"`
+	Speed      int32      `json:"speed"` // Speed is the engine speed, after mapping
+	Params     [][]string `json:"params"`
+	Format     string     `json:"format"`
+	SampleRate uint       `json:"sample_rate"`
+	Channels   int        `json:"channels"`
+}
+
+// hash returns the cache key. The instruction parameters are sorted by name, keeping the order of repeated ones.
+func (k speechKey) hash(params []ttsParam) string {
+	sorted := make([]ttsParam, len(params))
+	copy(sorted, params)
+	sort.SliceStable(sorted, func(i, j int) bool { return strings.ToLower(sorted[i].key) < strings.ToLower(sorted[j].key) })
+	k.Params = make([][]string, len(sorted))
+	for i, p := range sorted {
+		k.Params[i] = []string{p.key, p.value}
+	}
+	b, _ := json.Marshal(k)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedSpeech is the metadata stored with the cached audio.
+type cachedSpeech struct {
+	Timings loquendo.Timings `json:"timings"`
+}
+
+func getCachedSpeech(c cache.Cache, key string) ([]byte, *cachedSpeech, bool) {
+	data, meta, ok := c.Get(key)
+	if !ok {
+		return nil, nil, false
+	}
+	var speech cachedSpeech
+	if err := json.Unmarshal(meta, &speech); err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("Invalid cached speech metadata, dropping it")
+		c.Delete(key)
+		return nil, nil, false
+	}
+	return data, &speech, true
+}
+
+func putCachedSpeech(c cache.Cache, key string, data []byte, timings loquendo.Timings) {
+	meta, err := json.Marshal(cachedSpeech{Timings: timings})
+	if err == nil {
+		err = c.Put(key, data, meta)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("Error caching speech")
+	}
+}
+
+// captureBuffer keeps a copy of the audio sent to the client, unless it grows larger than maxCachedAudio.
+type captureBuffer struct {
+	bytes.Buffer
+	overflow bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	if b.overflow || b.Len()+len(p) > maxCachedAudio {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// cacheAdmin serves the endpoints to inspect and purge the synthesis cache.
+type cacheAdmin struct {
+	cache cache.Cache
+}
+
+func (a *cacheAdmin) serveList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object":  "list",
+		"stats":   a.cache.Stats(),
+		"entries": a.cache.Entries(),
+	})
+}
+
+func (a *cacheAdmin) servePurge(w http.ResponseWriter, r *http.Request) {
+	stats := a.cache.Stats()
+	if err := a.cache.Purge(); err != nil {
+		log.Error().Err(err).Msg("Error purging cache")
+		writeError(w, serverError("cache_error", "Error purging the cache"))
+		return
+	}
+	log.Info().Int("entries", stats.Entries).Msg("Purged cache")
+	writeJSON(w, http.StatusOK, map[string]any{"object": "cache.purged", "deleted": stats.Entries})
+}
+
+func (a *cacheAdmin) serveDelete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !a.cache.Delete(key) {
+		writeError(w, newAPIError(http.StatusNotFound, errorTypeInvalidRequest, "cache_entry_not_found", "key", "Cache entry not found: "+key))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"object": "cache.entry.deleted", "key": key, "deleted": true})
+}
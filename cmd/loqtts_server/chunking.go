@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"loq7tts-server/loquendo"
+	"loq7tts-server/pkg/audio"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// chunkFade is the length of the fades applied at the joins between chunks, so that they do not click.
+const chunkFade = 5 * time.Millisecond
+
+// ttsParam is an engine parameter set from the request instructions.
+type ttsParam struct {
+	key, value string
+	line       string // line is the instructions line the parameter was read from
+}
+
+// parseInstructions reads the Key=Value lines of the instructions, skipping the malformed ones.
+func parseInstructions(instructions string) []ttsParam {
+	var params []ttsParam
+	for _, line := range strings.Split(instructions, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			log.Warn().Str("line", line).Msg("Invalid instruction line (expected 'key=value')")
+			continue
+		}
+		params = append(params, ttsParam{key: strings.TrimSpace(parts[0]), value: strings.TrimSpace(parts[1]), line: line})
+	}
+	return params
+}
+
+// paramError is returned by speechSettings.apply when the engine rejects a parameter.
+type paramError struct {
+	param ttsParam
+	err   error
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("error setting TTS parameter from '%s': %v", e.param.line, e.err)
+}
+
+func (e *paramError) Unwrap() error {
+	return e.err
+}
+
+// speechSettings are the session settings of a speech request, applied to every session that renders a part of it.
+type speechSettings struct {
+	sampleRate uint
+	mono       bool
+	encoding   loquendo.AudioEncoding
+	params     []ttsParam
+}
+
+func (s *speechSettings) apply(loq loquendo.Synthesizer) error {
+	loq.SetAudioSettings(s.sampleRate, s.mono)
+	loq.SetAudioEncoding(s.encoding)
+	for _, p := range s.params {
+		log.Debug().Str("key", p.key).Str("value", p.value).Msg("Setting TTS parameter from instructions")
+		if err := loq.SetParam(p.key, p.value); err != nil {
+			return &paramError{param: p, err: err}
+		}
+	}
+	return nil
+}
+
+// chunkAudio is the audio of a chunk, buffered from the moment it is rendered until it is read.
+type chunkAudio struct {
+	data    []byte // data holds whole frames only
+	written int    // written is the number of bytes rendered so far
+	done    bool
+	err     error
+	timings loquendo.Timings
+}
+
+// chunkedSpeech renders a long text in chunks, each with a single TTSRead, and reads their audio back in order as
+// one continuous WAV stream. Chunks are rendered ahead on other pool sessions when some are free, so that the
+// joins do not stall the stream, but the first chunk is always rendered on the session of the request.
+type chunkedSpeech struct {
+	options *loquendo.SpeechOptions
+	chunks  []loquendo.TextChunk
+	format  audio.Format // format is the 16-bit linear format the chunks are rendered in
+	fade    int          // fade is the length of the fades at the joins, in bytes
+	ahead   int          // ahead is how many chunks may be rendered past the one being read
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	audio   []*chunkAudio
+	next    int   // next is the next chunk to be rendered
+	current int   // current is the chunk being read
+	read    int64 // read is the number of bytes read from all the chunks
+	timings loquendo.Timings
+	closed  bool
+
+	closeOnce sync.Once
+	output    io.ReadCloser // output is the WAV stream of the chunk samples
+}
+
+// newChunkedSpeech starts rendering the chunks, the first on the given session, which must already be configured
+// with the settings. Up to sessions-1 other sessions are borrowed from the pool if they are free, and returned once
+// all the chunks are rendered. The returned stream is WAV in the encoding of the settings.
+func newChunkedSpeech(ctx context.Context, pool *loquendo.Pool, loq loquendo.Synthesizer, settings *speechSettings,
+	options *loquendo.SpeechOptions, chunks []loquendo.TextChunk, sessions int) (*chunkedSpeech, error) {
+	first, err := loq.SpeakStreaming(ctx, chunks[0].Text, options)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := readChunk(first)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &chunkedSpeech{
+		options: options,
+		chunks:  chunks,
+		format:  stream.Format,
+		fade:    int(time.Duration(stream.Format.SampleRate)*chunkFade/time.Second) * stream.Format.FrameSize(),
+		ahead:   max(sessions, 1),
+		audio:   make([]*chunkAudio, len(chunks)),
+		next:    1,
+		timings: loquendo.Timings{
+			Sentences: []loquendo.SentenceTiming{},
+			Words:     []loquendo.WordTiming{},
+			Bookmarks: []loquendo.BookmarkTiming{},
+		},
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.cond = sync.NewCond(&c.mu)
+	for i := range c.audio {
+		c.audio[i] = &chunkAudio{}
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.render(loq, 0, stream)
+		c.work(loq)
+	}()
+	for i := 1; i < min(sessions, len(chunks)); i++ {
+		extra := pool.TryGet()
+		if extra == nil {
+			break
+		}
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer pool.Put(extra)
+			if err := settings.apply(extra); err != nil {
+				log.Warn().Err(err).Msg("Error configuring TTS session for chunks")
+				return
+			}
+			c.work(extra)
+		}()
+	}
+	log.Debug().Int("chunks", len(chunks)).Msg("Rendering long input in chunks")
+
+	var out *audio.Stream
+	samples := audio.NewStream(chunkSamples{c}, c.format, chunkSamples{c})
+	if out, err = audio.Convert(samples, engineFormat(c.format, settings.encoding)); err == nil {
+		c.output, err = audio.Encode(out, "wav")
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// engineFormat returns the format the engine renders in with the given encoding, at the rate and channels of a
+// 16-bit linear format.
+func engineFormat(linear audio.Format, encoding loquendo.AudioEncoding) audio.Format {
+	switch encoding {
+	case loquendo.AudioEncodingULaw:
+		return audio.Format{Encoding: audio.EncodingULaw, Channels: linear.Channels, SampleRate: linear.SampleRate, BitsPerSample: 8}
+	case loquendo.AudioEncodingALaw:
+		return audio.Format{Encoding: audio.EncodingALaw, Channels: linear.Channels, SampleRate: linear.SampleRate, BitsPerSample: 8}
+	default:
+		return linear
+	}
+}
+
+// readChunk returns the samples of a rendered chunk as 16-bit linear, so that they can be faded.
+func readChunk(reader io.ReadCloser) (*audio.Stream, error) {
+	stream, err := audio.ReadWAV(reader)
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	pcm, err := audio.ToPCM16(stream)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	return pcm, nil
+}
+
+// work renders chunks on the session until there are none left.
+func (c *chunkedSpeech) work(loq loquendo.Synthesizer) {
+	for {
+		c.mu.Lock()
+		for !c.closed && c.next < len(c.chunks) && c.next > c.current+c.ahead {
+			c.cond.Wait()
+		}
+		if c.closed || c.next >= len(c.chunks) {
+			c.mu.Unlock()
+			return
+		}
+		i := c.next
+		c.next++
+		c.mu.Unlock()
+
+		reader, err := loq.SpeakStreaming(c.ctx, c.chunks[i].Text, c.options)
+		var stream *audio.Stream
+		if err == nil {
+			stream, err = readChunk(reader)
+		}
+		if err == nil && stream.Format != c.format {
+			_ = stream.Close()
+			err = fmt.Errorf("chunk %d rendered as %+v instead of %+v", i, stream.Format, c.format)
+		}
+		if err != nil {
+			c.finish(i, err, loquendo.Timings{})
+			return
+		}
+		c.render(loq, i, stream)
+	}
+}
+
+// render buffers the audio of a chunk, fading in its start if it is not the first one.
+func (c *chunkedSpeech) render(loq loquendo.Synthesizer, i int, stream *audio.Stream) {
+	defer stream.Close()
+	frameSize := c.format.FrameSize()
+	buf := make([]byte, 16384)
+	partial := 0
+	for {
+		n, err := stream.Read(buf[partial:])
+		n += partial
+		if whole := n - n%frameSize; whole > 0 {
+			c.mu.Lock()
+			a := c.audio[i]
+			start := len(a.data)
+			a.data = append(a.data, buf[:whole]...)
+			if i > 0 && a.written < c.fade {
+				fadeIn(a.data[start:], a.written, c.fade)
+			}
+			a.written += whole
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			partial = copy(buf, buf[whole:n])
+		} else {
+			partial = n
+		}
+		if err == io.EOF {
+			c.finish(i, nil, loq.Timings())
+			return
+		}
+		if err != nil {
+			c.finish(i, err, loquendo.Timings{})
+			return
+		}
+	}
+}
+
+// finish marks a chunk as rendered, fading out its end if it is not the last one.
+func (c *chunkedSpeech) finish(i int, err error, timings loquendo.Timings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a := c.audio[i]
+	if err == nil && i < len(c.chunks)-1 {
+		fadeOut(a.data[len(a.data)-min(c.fade, len(a.data)):])
+	}
+	a.done, a.err, a.timings = true, err, timings
+	c.cond.Broadcast()
+}
+
+// fadeIn ramps up 16-bit samples that start at byte offset pos of a chunk, over the first length bytes.
+func fadeIn(b []byte, pos, length int) {
+	for i := 0; i+1 < len(b) && pos+i < length; i += 2 {
+		scaleSample(b[i:], float64(pos+i)/float64(length))
+	}
+}
+
+// fadeOut ramps down 16-bit samples to silence.
+func fadeOut(b []byte) {
+	for i := 0; i+1 < len(b); i += 2 {
+		scaleSample(b[i:], float64(len(b)-i)/float64(len(b)))
+	}
+}
+
+func scaleSample(b []byte, gain float64) {
+	s := float64(int16(uint16(b[0]) | uint16(b[1])<<8))
+	v := uint16(int16(s * gain))
+	b[0], b[1] = byte(v), byte(v>>8)
+}
+
+// chunkSamples reads the 16-bit linear samples of the chunks, in order. Closing it stops the rendering.
+type chunkSamples struct {
+	c *chunkedSpeech
+}
+
+func (s chunkSamples) Read(p []byte) (int, error) {
+	return s.c.readSamples(p)
+}
+
+func (s chunkSamples) Close() error {
+	s.c.stop()
+	return nil
+}
+
+func (c *chunkedSpeech) readSamples(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if c.current >= len(c.chunks) {
+			return 0, io.EOF
+		}
+		a := c.audio[c.current]
+		available := len(a.data)
+		if !a.done && c.current < len(c.chunks)-1 {
+			// The end of the chunk is held back until it is known, to be faded out
+			available = max(available-c.fade, 0)
+		}
+		if available > 0 {
+			n := copy(p, a.data[:available])
+			a.data = a.data[n:]
+			c.read += int64(n)
+			return n, nil
+		}
+		if a.done && len(a.data) == 0 {
+			if a.err != nil {
+				return 0, fmt.Errorf("error rendering chunk %d: %w", c.current, a.err)
+			}
+			frames := (c.read - int64(a.written)) / int64(c.format.FrameSize())
+			start := time.Duration(frames) * time.Second / time.Duration(c.format.SampleRate)
+			c.timings.Append(a.timings, start, c.chunks[c.current].Offset)
+			c.audio[c.current] = nil
+			c.current++
+			c.cond.Broadcast()
+			continue
+		}
+		c.cond.Wait()
+	}
+}
+
+// Timings returns the timings of the whole text, once all of the audio has been read.
+func (c *chunkedSpeech) Timings() loquendo.Timings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timings
+}
+
+// Read reads the WAV stream of the whole text.
+func (c *chunkedSpeech) Read(p []byte) (int, error) {
+	return c.output.Read(p)
+}
+
+// stop aborts the rendering of the chunks.
+func (c *chunkedSpeech) stop() {
+	c.cancel()
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// Close stops rendering and waits for the sessions to be done with the chunks.
+func (c *chunkedSpeech) Close() error {
+	c.closeOnce.Do(func() {
+		if c.output != nil {
+			_ = c.output.Close()
+		}
+		c.stop()
+		c.wg.Wait()
+	})
+	return nil
+}
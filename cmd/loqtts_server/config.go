@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mkideal/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// configEnvPrefix is the prefix of the environment variables that set the server options.
+const configEnvPrefix = "LOQTTS_"
+
+// configOption is a server option that can be set from the configuration file and the environment.
+type configOption struct {
+	name  string   // name is the long flag name, also the key in the configuration file
+	flags []string // flags are the command line flags of the option, none if it can only be set in the file
+	value reflect.Value
+}
+
+func (o *configOption) envName() string {
+	if len(o.flags) == 0 {
+		return ""
+	}
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+}
+
+// configOptions lists the options of argv that can be set from the configuration file and the environment, that is,
+// all of them except the configuration file itself, and the options without a flag, named by their yaml tag, that
+// can only be set in the configuration file.
+func configOptions(argv *argT) []configOption {
+	v := reflect.ValueOf(argv).Elem()
+	t := v.Type()
+	var opts []configOption
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("cli")
+		if tag == "-" {
+			if name := t.Field(i).Tag.Get("yaml"); name != "" {
+				opts = append(opts, configOption{name: name, value: v.Field(i)})
+			}
+			continue
+		}
+		if tag == "" {
+			continue
+		}
+		opt := configOption{value: v.Field(i)}
+		for _, name := range strings.Split(tag, ",") {
+			name = strings.TrimSpace(name)
+			if len(name) == 1 {
+				opt.flags = append(opt.flags, "-"+name)
+			} else {
+				opt.flags = append(opt.flags, "--"+name)
+				opt.name = name
+			}
+		}
+		if opt.name != "config" {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// loadConfig sets the options of argv that were not given on the command line from the configuration file, if any,
+// and from the LOQTTS_* environment variables. Options are taken from, in increasing order of precedence: the
+// defaults, the configuration file, the environment and the command line.
+func loadConfig(ctx *cli.Context, argv *argT) error {
+	opts := configOptions(argv)
+	unset := make(map[string]*configOption, len(opts))
+	for i := range opts {
+		if len(opts[i].flags) == 0 || !ctx.IsSet(opts[i].flags[0], opts[i].flags[1:]...) {
+			unset[opts[i].name] = &opts[i]
+		}
+	}
+
+	configFile := argv.Config
+	if !ctx.IsSet("--config", "-c") {
+		if env, ok := os.LookupEnv(configEnvPrefix + "CONFIG"); ok {
+			configFile = env
+		}
+	}
+	if configFile != "" {
+		if err := loadConfigFile(configFile, opts, unset); err != nil {
+			return err
+		}
+	}
+
+	for _, opt := range unset {
+		if opt.envName() == "" {
+			continue
+		}
+		env, ok := os.LookupEnv(opt.envName())
+		if !ok {
+			continue
+		}
+		if err := setOption(opt.value, env); err != nil {
+			return fmt.Errorf("invalid value of %s: %w", opt.envName(), err)
+		}
+	}
+	return nil
+}
+
+// loadConfigFile reads a YAML configuration file, whose keys are the long flag names of the options.
+func loadConfigFile(path string, opts []configOption, unset map[string]*configOption) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading configuration file: %w", err)
+	}
+	var values map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("error parsing configuration file %s: %w", path, err)
+	}
+	for key, node := range values {
+		known := false
+		for _, opt := range opts {
+			known = known || opt.name == key
+		}
+		if !known {
+			return fmt.Errorf("unknown option %q in configuration file %s", key, path)
+		}
+		opt, ok := unset[key]
+		if !ok {
+			continue
+		}
+		// Lists and maps from the file replace the default ones instead of being merged into them
+		value := reflect.New(opt.value.Type())
+		if err := node.Decode(value.Interface()); err != nil {
+			return fmt.Errorf("invalid value of %q in configuration file %s: %w", key, path, err)
+		}
+		opt.value.Set(value.Elem())
+	}
+	return nil
+}
+
+// setOption parses the value of an option from an environment variable. Lists are comma-separated, and maps are
+// comma-separated key=value pairs, where an item without = continues the value of the previous pair, so that
+// values can contain commas.
+func setOption(value reflect.Value, s string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		list := reflect.MakeSlice(value.Type(), 0, 0)
+		for _, item := range splitList(s) {
+			list = reflect.Append(list, reflect.ValueOf(item))
+		}
+		value.Set(list)
+	case reflect.Map:
+		m := reflect.MakeMap(value.Type())
+		var last reflect.Value
+		for _, item := range splitList(s) {
+			k, v, ok := strings.Cut(item, "=")
+			if !ok {
+				if !last.IsValid() {
+					return fmt.Errorf("expected key=value, got %q", item)
+				}
+				m.SetMapIndex(last, reflect.ValueOf(m.MapIndex(last).String()+","+item))
+				continue
+			}
+			last = reflect.ValueOf(strings.TrimSpace(k))
+			m.SetMapIndex(last, reflect.ValueOf(strings.TrimSpace(v)))
+		}
+		value.Set(m)
+	default:
+		return fmt.Errorf("unsupported option type %s", value.Type())
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
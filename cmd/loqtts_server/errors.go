@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"loq7tts-server/loquendo"
+	"net/http"
+)
+
+// Error types, as in the OpenAI API. Clients should retry server_error and rate_limit_error only.
+const (
+	errorTypeInvalidRequest = "invalid_request_error"
+	errorTypeAuthentication = "authentication_error"
+	errorTypePermission     = "permission_error"
+	errorTypeRateLimit      = "rate_limit_error"
+	errorTypeServer         = "server_error"
+)
+
+// apiError is an error response in the OpenAI format. Code is a stable identifier of the condition, Param the
+// request field that caused it, if any.
+type apiError struct {
+	Status  int     `json:"-"`
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// invalidRequest returns a 400 error for the given request field, which may be empty.
+func invalidRequest(code, param, message string) *apiError {
+	return newAPIError(http.StatusBadRequest, errorTypeInvalidRequest, code, param, message)
+}
+
+// serverError returns a 500 error. The message is shown to clients, so it must not include internal details.
+func serverError(code, message string) *apiError {
+	return newAPIError(http.StatusInternalServerError, errorTypeServer, code, "", message)
+}
+
+func newAPIError(status int, errorType, code, param, message string) *apiError {
+	e := &apiError{Status: status, Message: message, Type: errorType, Code: code}
+	if param != "" {
+		e.Param = &param
+	}
+	return e
+}
+
+// engineError maps an error of the TTS engine or the session pool to a response. The callers log the error, whose
+// details are not sent to the client.
+func engineError(err error) *apiError {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return newAPIError(http.StatusServiceUnavailable, errorTypeServer, "request_cancelled", "", "The request was cancelled")
+	case errors.Is(err, loquendo.ErrPoolClosed), errors.Is(err, loquendo.ErrEngineUnavailable):
+		return newAPIError(http.StatusServiceUnavailable, errorTypeServer, "engine_unavailable", "", "The TTS engine is not available")
+	case errors.Is(err, loquendo.ErrLicense):
+		return newAPIError(http.StatusServiceUnavailable, errorTypeServer, "engine_license_error", "", "The TTS engine license check failed")
+	case errors.Is(err, loquendo.ErrUnknownVoice):
+		return newAPIError(http.StatusNotFound, errorTypeInvalidRequest, "voice_not_found", "voice", "The TTS engine could not load the voice")
+	case errors.Is(err, loquendo.ErrUnknownLanguage):
+		return invalidRequest("unsupported_language", "language", "The TTS engine could not load the language")
+	case errors.Is(err, loquendo.ErrUnknownStyle):
+		return invalidRequest("unsupported_style", "style", "The TTS engine could not load the style")
+	case errors.Is(err, loquendo.ErrInvalidParameter):
+		return invalidRequest("invalid_parameter", "", "The TTS engine rejected a parameter")
+	default:
+		return serverError("engine_error", "TTS engine error")
+	}
+}
+
+// writeError sends the error response.
+func writeError(w http.ResponseWriter, e *apiError) {
+	writeJSON(w, e.Status, map[string]*apiError{"error": e})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"loq7tts-server/loquendo"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// readyCheckInterval is the time during which the result of a readiness check is reused
+	readyCheckInterval = 2 * time.Second
+	// readyCheckTimeout bounds a readiness check, including the wait for a session and the test synthesis
+	readyCheckTimeout = 10 * time.Second
+	// readyCheckText is rendered by the test synthesis
+	readyCheckText = "Test."
+)
+
+type readiness struct {
+	Ready         bool       `json:"ready"`
+	EngineVersion string     `json:"engine_version,omitempty"`
+	Voices        int        `json:"voices"`
+	Synthesis     bool       `json:"synthesis"` // Synthesis tells whether the check included a test synthesis
+	CheckedAt     time.Time  `json:"checked_at"`
+	LastError     string     `json:"last_error,omitempty"`    // LastError is the error of the latest failed check, even if later ones succeeded
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"` // LastErrorAt is when the latest check failed
+}
+
+// healthChecker tells whether the engine can serve requests, by borrowing a session from the pool to enumerate the
+// voices and, optionally, render a short prompt.
+type healthChecker struct {
+	engine    loquendo.Engine
+	pool      *loquendo.Pool
+	synthesis bool
+
+	mu      sync.Mutex
+	last    readiness
+	running chan struct{} // running is closed when the check in progress, if any, completes
+}
+
+func newHealthChecker(engine loquendo.Engine, pool *loquendo.Pool, synthesis bool) *healthChecker {
+	return &healthChecker{engine: engine, pool: pool, synthesis: synthesis}
+}
+
+// check runs a readiness check, unless one ran less than readyCheckInterval ago, and returns its result. While a
+// check is in progress, the previous result is returned, or the first one waited for.
+func (h *healthChecker) check(ctx context.Context) readiness {
+	h.mu.Lock()
+	if !h.last.CheckedAt.IsZero() && (h.running != nil || time.Since(h.last.CheckedAt) < readyCheckInterval) {
+		defer h.mu.Unlock()
+		return h.last
+	}
+	if running := h.running; running != nil {
+		h.mu.Unlock()
+		select {
+		case <-running:
+		case <-ctx.Done():
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.last
+	}
+	running := make(chan struct{})
+	h.running = running
+	prev := h.last
+	h.mu.Unlock()
+
+	res := readiness{Synthesis: h.synthesis, LastError: prev.LastError, LastErrorAt: prev.LastErrorAt}
+	// Finish the check even if the client goes away, so that its result can be reused
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readyCheckTimeout)
+	err := h.run(ctx, &res, prev.CheckedAt.IsZero())
+	cancel()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = nil
+	close(running)
+	if errors.Is(err, errSessionsBusy) {
+		// The engine is serving requests: keep the previous result rather than waiting for a session
+		log.Debug().Msg("All TTS sessions busy, skipping readiness check")
+		return h.last
+	}
+	res.CheckedAt = time.Now()
+	res.Ready = err == nil
+	if err != nil {
+		log.Warn().Err(err).Msg("Readiness check failed")
+		res.LastError = err.Error()
+		res.LastErrorAt = &res.CheckedAt
+	}
+	h.last = res
+	return res
+}
+
+var errSessionsBusy = errors.New("all TTS sessions are busy")
+
+// run checks the engine. Without a previous result to fall back to, the first check waits for a session.
+func (h *healthChecker) run(ctx context.Context, res *readiness, first bool) error {
+	// Getting the version tells whether the engine library is loaded
+	version, err := h.engine.GetVersionInfo()
+	if err != nil {
+		return fmt.Errorf("error getting engine version: %w", err)
+	}
+	res.EngineVersion = version
+
+	synth := h.pool.TryGet()
+	if synth == nil {
+		if !first {
+			return errSessionsBusy
+		}
+		if synth, err = h.pool.Get(ctx); err != nil {
+			return fmt.Errorf("error getting TTS session: %w", err)
+		}
+	}
+
+	voices, err := synth.GetVoices()
+	if err == nil {
+		res.Voices = len(voices)
+		if len(voices) == 0 {
+			err = errors.New("no voices installed")
+		} else if h.synthesis {
+			err = testSynthesis(ctx, synth, voices[0].Id)
+		}
+	}
+	if err != nil {
+		h.pool.Discard(synth)
+		return err
+	}
+	h.pool.Put(synth)
+	return nil
+}
+
+// testSynthesis renders a short prompt with the given voice and discards the audio.
+func testSynthesis(ctx context.Context, synth loquendo.Synthesizer, voice string) error {
+	stream, err := synth.SpeakStreaming(ctx, readyCheckText, &loquendo.SpeechOptions{Voice: voice})
+	if err != nil {
+		return fmt.Errorf("error starting test synthesis: %w", err)
+	}
+	defer stream.Close()
+	n, err := io.Copy(io.Discard, stream)
+	if err != nil {
+		return fmt.Errorf("error reading test synthesis: %w", err)
+	}
+	if n == 0 {
+		return errors.New("test synthesis produced no audio")
+	}
+	return nil
+}
+
+func (h *healthChecker) serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+func (h *healthChecker) serveReady(w http.ResponseWriter, r *http.Request) {
+	res := h.check(r.Context())
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, res)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"loq7tts-server/loquendo"
+	"loq7tts-server/pkg/ratelimit"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// apiKeyConfig describes an API key in the configuration file or in the keys file.
+type apiKeyConfig struct {
+	Key     string   `yaml:"key"`
+	Label   string   `yaml:"label"`   // Label identifies the key in logs, derived from its hash if empty
+	Voices  []string `yaml:"voices"`  // Voices are the Loquendo voices the key may use, all if empty
+	Formats []string `yaml:"formats"` // Formats are the response formats the key may request, all if empty
+	Enabled *bool    `yaml:"enabled"` // Enabled is true if omitted
+
+	// Limits of the key, the server defaults if omitted, 0 for no limit
+	RateRequests   *float64 `yaml:"rate-requests"`   // RateRequests is the number of speech requests per second
+	RateCharacters *int     `yaml:"rate-characters"` // RateCharacters is the number of input characters per minute
+	QuotaDaily     *int64   `yaml:"quota-daily"`     // QuotaDaily is the number of input characters per day
+	QuotaMonthly   *int64   `yaml:"quota-monthly"`   // QuotaMonthly is the number of input characters per month
+}
+
+// limits returns the limits of the key, taking the defaults for the ones not set.
+func (c *apiKeyConfig) limits(defaults keyLimits) keyLimits {
+	res := defaults
+	if c.RateRequests != nil {
+		res.requests = ratelimit.PerSecond(*c.RateRequests)
+	}
+	if c.RateCharacters != nil {
+		res.characters = ratelimit.PerMinute(float64(*c.RateCharacters))
+	}
+	if c.QuotaDaily != nil {
+		res.quota.Daily = *c.QuotaDaily
+	}
+	if c.QuotaMonthly != nil {
+		res.quota.Monthly = *c.QuotaMonthly
+	}
+	return res
+}
+
+// apiKey is an API key of the store. Only the hash of the key is kept.
+type apiKey struct {
+	label   string
+	hash    [sha256.Size]byte
+	voices  map[string]bool // voices holds the allowed voice IDs, nil if all are allowed
+	formats map[string]bool // formats holds the allowed response formats, nil if all are allowed
+	enabled bool
+	limits  keyLimits
+}
+
+// allowsVoice tells whether the key may use the voice. A nil key, when authentication is disabled, allows all.
+func (k *apiKey) allowsVoice(voice string) bool {
+	return k == nil || k.voices == nil || k.voices[voice]
+}
+
+// allowsFormat tells whether the key may request the response format. A nil key allows all.
+func (k *apiKey) allowsFormat(format string) bool {
+	return k == nil || k.formats == nil || k.formats[format]
+}
+
+// keyHash returns a short hash of a key, safe to log.
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// keyStore holds the API keys accepted by the server. Authentication is disabled if it is empty.
+type keyStore struct {
+	keys []*apiKey
+}
+
+// hasQuotas tells whether any key has a quota.
+func (s *keyStore) hasQuotas() bool {
+	for _, k := range s.keys {
+		if k.limits.quota.Enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// newKeyStore validates the key configurations against the installed voices and the known response formats. Keys
+// get the default limits unless they set their own.
+func newKeyStore(configs []apiKeyConfig, voices []loquendo.Voice, defaults keyLimits) (*keyStore, error) {
+	s := &keyStore{}
+	labels := make(map[string]bool, len(configs))
+	for i, c := range configs {
+		if c.Key == "" {
+			return nil, fmt.Errorf("API key %d: empty key", i+1)
+		}
+		key := &apiKey{
+			label:   c.Label,
+			hash:    sha256.Sum256([]byte(c.Key)),
+			enabled: c.Enabled == nil || *c.Enabled,
+			limits:  c.limits(defaults),
+		}
+		if key.label == "" {
+			key.label = "key-" + keyHash(c.Key)
+		}
+		if labels[key.label] {
+			return nil, fmt.Errorf("API key %s: duplicate label", key.label)
+		}
+		labels[key.label] = true
+		for _, existing := range s.keys {
+			if existing.hash == key.hash {
+				return nil, fmt.Errorf("API key %s: same key as %s", key.label, existing.label)
+			}
+		}
+
+		if len(c.Voices) > 0 {
+			key.voices = make(map[string]bool, len(c.Voices))
+			for _, v := range c.Voices {
+				voice := findVoice(voices, strings.TrimSpace(v))
+				if voice == "" {
+					return nil, fmt.Errorf("API key %s: voice not installed: %s", key.label, v)
+				}
+				key.voices[voice] = true
+			}
+		}
+		if len(c.Formats) > 0 {
+			key.formats = make(map[string]bool, len(c.Formats))
+			for _, f := range c.Formats {
+				f = strings.ToLower(strings.TrimSpace(f))
+				if _, ok := outputFormats[f]; !ok {
+					return nil, fmt.Errorf("API key %s: unknown response format: %s", key.label, f)
+				}
+				key.formats[f] = true
+			}
+		}
+		s.keys = append(s.keys, key)
+	}
+	return s, nil
+}
+
+// loadKeysFile reads a YAML list of API keys.
+func loadKeysFile(path string) ([]apiKeyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys file: %w", err)
+	}
+	var configs []apiKeyConfig
+	if err := yaml.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("error parsing keys file %s: %w", path, err)
+	}
+	return configs, nil
+}
+
+// lookup finds a key. All the keys are compared in constant time, so that the time taken does not depend on which
+// one matches, nor on how much of it.
+func (s *keyStore) lookup(token string) *apiKey {
+	hash := sha256.Sum256([]byte(token))
+	var found *apiKey
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			found = k
+		}
+	}
+	return found
+}
+
+type apiKeyContextKey struct{}
+
+// requestKey returns the API key of an authenticated request, or nil if authentication is disabled.
+func requestKey(ctx context.Context) *apiKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return key
+}
+
+// middleware rejects requests without a valid and enabled key. The key is stored in the request context, and its
+// label added to the request logger.
+func (s *keyStore) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.keys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			log.Warn().Str("url", r.URL.Path).Msg("Missing API key")
+			writeError(w, newAPIError(http.StatusUnauthorized, errorTypeAuthentication, "invalid_api_key", "", "Invalid or missing API key"))
+			return
+		}
+		key := s.lookup(token)
+		if key == nil {
+			log.Warn().Str("key_hash", keyHash(token)).Str("url", r.URL.Path).Msg("Invalid API key")
+			writeError(w, newAPIError(http.StatusUnauthorized, errorTypeAuthentication, "invalid_api_key", "", "Invalid or missing API key"))
+			return
+		}
+		if !key.enabled {
+			log.Warn().Str("key", key.label).Str("url", r.URL.Path).Msg("Disabled API key")
+			writeError(w, newAPIError(http.StatusUnauthorized, errorTypeAuthentication, "invalid_api_key", "", "Invalid or missing API key"))
+			return
+		}
+
+		logger := log.Ctx(r.Context()).With().Str("key", key.label).Logger()
+		ctx := context.WithValue(logger.WithContext(r.Context()), apiKeyContextKey{}, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// adminMiddleware rejects requests without the admin key, which is separate from the API keys.
+func adminMiddleware(adminKey string, next http.Handler) http.Handler {
+	adminHash := sha256.Sum256([]byte(adminKey))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		hash := sha256.Sum256([]byte(token))
+		if !ok || subtle.ConstantTimeCompare(hash[:], adminHash[:]) != 1 {
+			log.Warn().Str("url", r.URL.Path).Msg("Invalid or missing admin key")
+			writeError(w, newAPIError(http.StatusUnauthorized, errorTypeAuthentication, "invalid_api_key", "", "Invalid or missing admin key"))
+			return
+		}
+		logger := log.Ctx(r.Context()).With().Str("key", "admin").Logger()
+		next.ServeHTTP(w, r.WithContext(logger.WithContext(r.Context())))
+	})
+}
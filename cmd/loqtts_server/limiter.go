@@ -0,0 +1,184 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errQueueFull    = errors.New("too many requests in queue")
+	errQueueTimeout = errors.New("timed out waiting in queue")
+)
+
+type limiterStats struct {
+	Active    int    `json:"active"`     // Active is the number of requests being served
+	Queued    int    `json:"queued"`     // Queued is the number of requests waiting for a slot
+	MaxActive int    `json:"max_active"` // MaxActive is the configured concurrency limit
+	MaxQueue  int    `json:"max_queue"`  // MaxQueue is the configured queue size
+	Served    uint64 `json:"served"`     // Served is the number of requests that got a slot
+	Rejected  uint64 `json:"rejected"`   // Rejected is the number of requests refused because the queue was full
+	TimedOut  uint64 `json:"timed_out"`  // TimedOut is the number of requests that gave up waiting in the queue
+}
+
+type queueWaiter struct {
+	ready   chan struct{}
+	granted bool
+	elem    *list.Element
+}
+
+// requestLimiter bounds the number of requests served concurrently. Excess requests wait in a bounded FIFO queue
+// for at most queueTimeout, and are rejected right away when the queue is full.
+type requestLimiter struct {
+	maxActive    int
+	maxQueue     int
+	queueTimeout time.Duration
+
+	mu    sync.Mutex
+	queue *list.List
+	stats limiterStats
+	// avgDuration is a moving average of how long a slot is held, used to estimate Retry-After
+	avgDuration time.Duration
+}
+
+func newRequestLimiter(maxActive, maxQueue int, queueTimeout time.Duration) *requestLimiter {
+	return &requestLimiter{
+		maxActive:    maxActive,
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+		queue:        list.New(),
+		stats: limiterStats{
+			MaxActive: maxActive,
+			MaxQueue:  maxQueue,
+		},
+	}
+}
+
+// acquire waits for a free slot. On success, the returned function must be called to release it.
+func (l *requestLimiter) acquire(ctx context.Context) (func(), error) {
+	l.mu.Lock()
+	if l.stats.Active < l.maxActive && l.queue.Len() == 0 {
+		l.stats.Active++
+		l.stats.Served++
+		l.mu.Unlock()
+		return l.releaser(), nil
+	}
+	if l.queue.Len() >= l.maxQueue {
+		l.stats.Rejected++
+		l.mu.Unlock()
+		return nil, errQueueFull
+	}
+	w := &queueWaiter{ready: make(chan struct{})}
+	w.elem = l.queue.PushBack(w)
+	depth := l.queue.Len()
+	l.mu.Unlock()
+
+	log.Info().Int("queue_depth", depth).Msg("Request queued")
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return l.releaser(), nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		// The slot was handed over while we were giving up; keep it
+		return l.releaser(), nil
+	}
+	l.queue.Remove(w.elem)
+	l.stats.TimedOut++
+	return nil, err
+}
+
+func (l *requestLimiter) releaser() func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.release(time.Since(start))
+		})
+	}
+}
+
+func (l *requestLimiter) release(held time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.avgDuration == 0 {
+		l.avgDuration = held
+	} else {
+		l.avgDuration = (l.avgDuration*7 + held) / 8
+	}
+
+	// Hand the slot over to the first waiter, if any, so that the queue is served in order
+	if front := l.queue.Front(); front != nil {
+		w := l.queue.Remove(front).(*queueWaiter)
+		w.granted = true
+		l.stats.Served++
+		close(w.ready)
+		return
+	}
+	l.stats.Active--
+}
+
+// retryAfter estimates how long a client should wait before its request can be served.
+func (l *requestLimiter) retryAfter() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rounds := float64(l.queue.Len())/float64(l.maxActive) + 1
+	return max(time.Duration(rounds*float64(l.avgDuration)), time.Second)
+}
+
+func (l *requestLimiter) Stats() limiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.Queued = l.queue.Len()
+	return stats
+}
+
+// middleware limits the concurrency of the wrapped handler, replying 429 when the queue is full and 503 when a
+// request waited in the queue for too long.
+func (l *requestLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := l.acquire(r.Context())
+		if err != nil {
+			retryAfter := strconv.Itoa(int(math.Ceil(l.retryAfter().Seconds())))
+			stats := l.Stats()
+			switch {
+			case errors.Is(err, errQueueFull):
+				log.Ctx(r.Context()).Warn().Int("active", stats.Active).Int("queue_depth", stats.Queued).Msg("Request rejected, queue is full")
+				w.Header().Set("Retry-After", retryAfter)
+				writeError(w, newAPIError(http.StatusTooManyRequests, errorTypeRateLimit, "queue_full", "",
+					"The server is busy, too many requests are queued. Please retry later."))
+			case errors.Is(err, errQueueTimeout):
+				log.Ctx(r.Context()).Warn().Int("active", stats.Active).Int("queue_depth", stats.Queued).Msg("Request timed out in queue")
+				w.Header().Set("Retry-After", retryAfter)
+				writeError(w, newAPIError(http.StatusServiceUnavailable, errorTypeServer, "queue_timeout", "",
+					"The server is busy, the request timed out waiting in queue. Please retry later."))
+			default:
+				// The client went away while waiting
+				log.Ctx(r.Context()).Debug().Err(err).Msg("Request abandoned while queued")
+			}
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
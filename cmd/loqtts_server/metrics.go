@@ -0,0 +1,104 @@
+package main
+
+import (
+	"loq7tts-server/loquendo"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Speech metrics, registered with the default Prometheus registry along with the engine metrics.
+var (
+	metricSpeechRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loqtts_speech_requests_total",
+		Help: "Number of speech requests, by status code, response format and voice.",
+	}, []string{"status", "format", "voice"})
+	metricSpeechDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "loqtts_speech_duration_seconds",
+		Help:    "Time to serve a successful speech request, until the end of the audio.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"format"})
+	metricSpeechTimeToFirstByte = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "loqtts_speech_time_to_first_byte_seconds",
+		Help:    "Time from a successful speech request to the first byte of its audio.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"format"})
+	metricSpeechCharacters = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "loqtts_speech_characters_total",
+		Help: "Number of input characters synthesized by the engine.",
+	})
+	metricSpeechAudioSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "loqtts_speech_audio_seconds_total",
+		Help: "Seconds of audio sent to clients, including cached audio.",
+	})
+	metricFFmpegFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loqtts_ffmpeg_failures_total",
+		Help: "Number of ffmpeg processes that failed to start or exited with an error, by response format.",
+	}, []string{"format"})
+)
+
+// registerPoolMetrics exposes the state of the session pool.
+func registerPoolMetrics(pool *loquendo.Pool) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "loqtts_pool_sessions_in_use",
+		Help: "Number of TTS engine sessions borrowed by requests.",
+	}, func() float64 { return float64(pool.Stats().InUse) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "loqtts_pool_sessions_idle",
+		Help: "Number of TTS engine sessions ready to be borrowed.",
+	}, func() float64 { return float64(pool.Stats().Idle) })
+}
+
+// speechMetrics records the outcome of a speech request. Its labels are filled in as the request is validated.
+type speechMetrics struct {
+	http.ResponseWriter
+	start     time.Time
+	status    int
+	firstByte time.Time
+	format    string
+	voice     string
+}
+
+func newSpeechMetrics(w http.ResponseWriter) *speechMetrics {
+	return &speechMetrics{ResponseWriter: w, start: time.Now()}
+}
+
+func (m *speechMetrics) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *speechMetrics) Write(b []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	if m.firstByte.IsZero() && len(b) > 0 {
+		m.firstByte = time.Now()
+	}
+	return m.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, to flush SSE events.
+func (m *speechMetrics) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// done counts the request once it has been served.
+func (m *speechMetrics) done() {
+	status := m.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	metricSpeechRequests.WithLabelValues(strconv.Itoa(status), m.format, m.voice).Inc()
+	if status == http.StatusOK {
+		metricSpeechDuration.WithLabelValues(m.format).Observe(time.Since(m.start).Seconds())
+		if !m.firstByte.IsZero() {
+			metricSpeechTimeToFirstByte.WithLabelValues(m.format).Observe(m.firstByte.Sub(m.start).Seconds())
+		}
+	}
+}
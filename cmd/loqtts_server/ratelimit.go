@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"loq7tts-server/pkg/ratelimit"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// quotaFlushInterval is how often the quota usage is saved.
+const quotaFlushInterval = 10 * time.Second
+
+// keyLimits are the rate limits and quotas of an API key.
+type keyLimits struct {
+	requests   ratelimit.Rate // requests limits the speech requests
+	characters ratelimit.Rate // characters limits the input characters
+	quota      ratelimit.QuotaLimits
+}
+
+// rateLimiter enforces the rate limits of the API keys and of the client IPs, and the quotas of the API keys.
+type rateLimiter struct {
+	ipRequests   ratelimit.Rate
+	ipCharacters ratelimit.Rate
+	buckets      *ratelimit.Limiter
+	// quotas tracks the quota usage, nil if no key has a quota
+	quotas *ratelimit.Quotas
+}
+
+func newRateLimiter(ipRequests, ipCharacters ratelimit.Rate, quotas *ratelimit.Quotas) *rateLimiter {
+	return &rateLimiter{
+		ipRequests:   ipRequests,
+		ipCharacters: ipCharacters,
+		buckets:      ratelimit.NewLimiter(),
+		quotas:       quotas,
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateBucket is a bucket of the limiter that applies to a request.
+type rateBucket struct {
+	key  string
+	rate ratelimit.Rate
+}
+
+// requestBuckets returns the buckets of the API key and of the client IP of the request, for the given kind of limit.
+func requestBuckets(r *http.Request, kind string, keyRate, ipRate ratelimit.Rate) []rateBucket {
+	var buckets []rateBucket
+	if key := requestKey(r.Context()); key != nil && keyRate.Enabled() {
+		buckets = append(buckets, rateBucket{"key/" + kind + "/" + key.label, keyRate})
+	}
+	if ipRate.Enabled() {
+		buckets = append(buckets, rateBucket{"ip/" + kind + "/" + clientIP(r), ipRate})
+	}
+	return buckets
+}
+
+// take removes n tokens from the buckets of the API key and of the client IP of the request, for the given kind of
+// limit, and sets the x-ratelimit headers of the most constrained one. It returns whether the request is allowed,
+// and if not, when to retry.
+func (l *rateLimiter) take(w http.ResponseWriter, r *http.Request, kind string, keyRate, ipRate ratelimit.Rate, n float64) (bool, time.Duration) {
+	buckets := requestBuckets(r, kind, keyRate, ipRate)
+	var results []ratelimit.Result
+	for _, b := range buckets {
+		results = append(results, l.buckets.Take(b.key, b.rate, n))
+	}
+	if len(results) == 0 {
+		return true, 0
+	}
+
+	// Show the bucket that rejected the request, or else the one with the fewest tokens left
+	shown := results[0]
+	for _, res := range results[1:] {
+		if shown.Allowed && (!res.Allowed || res.Remaining < shown.Remaining) {
+			shown = res
+		}
+	}
+	w.Header().Set("X-Ratelimit-Limit-"+kind, strconv.Itoa(shown.Limit))
+	w.Header().Set("X-Ratelimit-Remaining-"+kind, strconv.Itoa(shown.Remaining))
+	w.Header().Set("X-Ratelimit-Reset-"+kind, formatReset(shown.Reset))
+
+	var retryAfter time.Duration
+	for _, res := range results {
+		retryAfter = max(retryAfter, res.RetryAfter)
+	}
+	if retryAfter > 0 {
+		// A rejected request takes no tokens from the buckets that allowed it
+		for i, res := range results {
+			if res.Allowed {
+				l.buckets.Refund(buckets[i].key, buckets[i].rate, n)
+			}
+		}
+	}
+	return retryAfter == 0, retryAfter
+}
+
+// formatReset formats a reset time as in the OpenAI API, i.e. 1s or 6m0s.
+func formatReset(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+func rateLimitError(w http.ResponseWriter, code string, retryAfter time.Duration, message string) *apiError {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return newAPIError(http.StatusTooManyRequests, errorTypeRateLimit, code, "", message)
+}
+
+// middleware applies the request rate limits.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keyRate ratelimit.Rate
+		if key := requestKey(r.Context()); key != nil {
+			keyRate = key.limits.requests
+		}
+		if ok, retryAfter := l.take(w, r, "requests", keyRate, l.ipRequests, 1); !ok {
+			log.Ctx(r.Context()).Warn().Str("ip", clientIP(r)).Dur("retry_after", retryAfter).Msg("Request rate limit reached")
+			writeError(w, rateLimitError(w, "rate_limit_exceeded", retryAfter, "Rate limit reached for requests. Please retry later."))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// useCharacters applies the input character rate limits to a speech request.
+func (l *rateLimiter) useCharacters(w http.ResponseWriter, r *http.Request, n int) *apiError {
+	var keyRate ratelimit.Rate
+	if key := requestKey(r.Context()); key != nil {
+		keyRate = key.limits.characters
+	}
+	if ok, retryAfter := l.take(w, r, "characters", keyRate, l.ipCharacters, float64(n)); !ok {
+		log.Ctx(r.Context()).Warn().Str("ip", clientIP(r)).Int("characters", n).Dur("retry_after", retryAfter).Msg("Character rate limit reached")
+		return rateLimitError(w, "rate_limit_exceeded", retryAfter, "Rate limit reached for input characters. Please retry later.")
+	}
+	return nil
+}
+
+// chargeQuota charges the input characters of a speech request to the quotas of its API key. It returns a function
+// that refunds them, for requests that fail.
+func (l *rateLimiter) chargeQuota(w http.ResponseWriter, r *http.Request, n int) (refund func(), apiErr *apiError) {
+	key := requestKey(r.Context())
+	if key == nil || l.quotas == nil || !key.limits.quota.Enabled() {
+		return func() {}, nil
+	}
+	res := l.quotas.Use(key.label, int64(n), key.limits.quota)
+	for _, p := range []struct {
+		name   string
+		period ratelimit.QuotaPeriod
+	}{{ratelimit.Daily, res.Daily}, {ratelimit.Monthly, res.Monthly}} {
+		if p.period.Limit > 0 {
+			w.Header().Set("X-Ratelimit-Limit-Characters-"+p.name, strconv.FormatInt(p.period.Limit, 10))
+			w.Header().Set("X-Ratelimit-Remaining-Characters-"+p.name, strconv.FormatInt(p.period.Remaining, 10))
+			w.Header().Set("X-Ratelimit-Reset-Characters-"+p.name, formatReset(p.period.Reset))
+		}
+	}
+	if !res.Allowed {
+		// The characters were not used, so they do not count towards the rate limits either
+		for _, b := range requestBuckets(r, "characters", key.limits.characters, l.ipCharacters) {
+			l.buckets.Refund(b.key, b.rate, float64(n))
+		}
+		reset := res.Daily.Reset
+		if res.Exhausted == ratelimit.Monthly {
+			reset = res.Monthly.Reset
+		}
+		log.Ctx(r.Context()).Warn().Str("period", res.Exhausted).Int("characters", n).Msg("Character quota exceeded")
+		return nil, rateLimitError(w, "insufficient_quota", reset, fmt.Sprintf("The %s character quota of this API key is exhausted.", res.Exhausted))
+	}
+	return func() {
+		l.quotas.Refund(key.label, int64(n), res.At)
+		log.Ctx(r.Context()).Debug().Int("characters", n).Msg("Character quota refunded")
+	}, nil
+}
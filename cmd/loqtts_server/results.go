@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"loq7tts-server/loquendo"
+	"loq7tts-server/pkg/subtitles"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// speechResult holds the metadata of a synthesis, available once its audio has been sent.
+type speechResult struct {
+	Timings loquendo.Timings
+	created time.Time
+}
+
+// resultStore keeps the results of the latest syntheses for a while, so that clients can fetch them by request ID.
+type resultStore struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*speechResult
+	order   []string
+}
+
+func newResultStore(ttl time.Duration, maxEntries int) *resultStore {
+	return &resultStore{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*speechResult),
+	}
+}
+
+func newRequestID() string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return "speech_" + hex.EncodeToString(b[:])
+}
+
+// evict drops expired entries and the oldest ones above the size limit. The lock must be held.
+func (s *resultStore) evict() {
+	drop := 0
+	for drop < len(s.order) {
+		entry := s.entries[s.order[drop]]
+		if len(s.order)-drop <= s.maxEntries && time.Since(entry.created) < s.ttl {
+			break
+		}
+		delete(s.entries, s.order[drop])
+		drop++
+	}
+	s.order = s.order[drop:]
+}
+
+func (s *resultStore) put(id string, result *speechResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result.created = time.Now()
+	s.entries[id] = result
+	s.order = append(s.order, id)
+	s.evict()
+}
+
+func (s *resultStore) get(id string) (*speechResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	result, ok := s.entries[id]
+	return result, ok
+}
+
+type sentenceTimingJSON struct {
+	Index      int     `json:"index"`
+	Text       string  `json:"text"`
+	TextOffset int     `json:"text_offset"`
+	Start      float64 `json:"start"`
+	End        float64 `json:"end"`
+}
+
+type wordTimingJSON struct {
+	Text       string  `json:"text"`
+	TextOffset int     `json:"text_offset"`
+	Sentence   int     `json:"sentence"`
+	Start      float64 `json:"start"`
+	End        float64 `json:"end"`
+}
+
+type bookmarkTimingJSON struct {
+	Name string  `json:"name"`
+	Time float64 `json:"time"`
+}
+
+type timingsJSON struct {
+	Id             string               `json:"id"`
+	Object         string               `json:"object"`
+	Duration       float64              `json:"duration"`
+	Sentences      []sentenceTimingJSON `json:"sentences"`
+	Words          []wordTimingJSON     `json:"words"`
+	WordsEstimated bool                 `json:"words_estimated"`
+	Bookmarks      []bookmarkTimingJSON `json:"bookmarks"`
+}
+
+// timingsToJSON converts the timings to their API representation, with times in seconds.
+func timingsToJSON(id string, timings loquendo.Timings) timingsJSON {
+	res := timingsJSON{
+		Id:             id,
+		Object:         "audio.speech.timings",
+		Duration:       timings.Duration.Seconds(),
+		Sentences:      make([]sentenceTimingJSON, len(timings.Sentences)),
+		Words:          make([]wordTimingJSON, len(timings.Words)),
+		WordsEstimated: timings.WordsEstimated,
+		Bookmarks:      make([]bookmarkTimingJSON, len(timings.Bookmarks)),
+	}
+	for i, s := range timings.Sentences {
+		res.Sentences[i] = sentenceTimingJSON{
+			Index:      s.Index,
+			Text:       s.Text,
+			TextOffset: s.TextOffset,
+			Start:      s.Start.Seconds(),
+			End:        s.End.Seconds(),
+		}
+	}
+	for i, w := range timings.Words {
+		res.Words[i] = wordTimingJSON{
+			Text:       w.Text,
+			TextOffset: w.TextOffset,
+			Sentence:   w.Sentence,
+			Start:      w.Start.Seconds(),
+			End:        w.End.Seconds(),
+		}
+	}
+	for i, b := range timings.Bookmarks {
+		res.Bookmarks[i] = bookmarkTimingJSON{Name: b.Name, Time: b.Time.Seconds()}
+	}
+	return res
+}
+
+func (s *resultStore) serveTimings(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	result, ok := s.get(id)
+	if !ok {
+		writeError(w, newAPIError(http.StatusNotFound, errorTypeInvalidRequest, "result_not_found", "id", "Speech result not found or expired: "+id))
+		return
+	}
+	writeJSON(w, http.StatusOK, timingsToJSON(id, result.Timings))
+}
+
+func (s *resultStore) serveSubtitles(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	result, ok := s.get(id)
+	if !ok {
+		writeError(w, newAPIError(http.StatusNotFound, errorTypeInvalidRequest, "result_not_found", "id", "Speech result not found or expired: "+id))
+		return
+	}
+
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = string(subtitles.FormatWebVTT)
+	}
+	format, err := subtitles.ParseFormat(formatName)
+	if err != nil {
+		writeError(w, invalidRequest("unsupported_subtitle_format", "format", "Unsupported subtitle format (must be 'vtt' or 'srt')"))
+		return
+	}
+
+	w.Header().Set("Content-Type", format.MimeType()+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", id, format))
+	w.WriteHeader(http.StatusOK)
+	if err = subtitles.Write(w, format, subtitles.FromTimings(result.Timings)); err != nil {
+		log.Error().Err(err).Msg("Error writing subtitles to response")
+	}
+}
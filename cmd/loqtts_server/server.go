@@ -1,41 +1,93 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/fs"
 	"loq7tts-server/loquendo"
+	"loq7tts-server/pkg/ratelimit"
 	"loq7tts-server/pkg/utils"
-	"math"
+	"net"
 	"net/http"
 	"os"
-	"slices"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/mkideal/cli"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 )
 
+// sessionCloseTimeout is how long cancelled requests have to hand back their TTS sessions on shutdown.
+const sessionCloseTimeout = 5 * time.Second
+
 //go:embed web/*
 var webContent embed.FS
 
 type argT struct {
 	cli.Helper
-	BindAddr   string `cli:"a,addr" usage:"address to listen on" dft:":8080"`
-	DebugTTS   bool   `cli:"d,debug" usage:"enable debug logging for TTS engine events" dft:"false"`
-	ApiKey     string `cli:"k,apikey" usage:"API key for authentication" dft:""`
-	FfmpegPath string `cli:"ffmpeg-path" usage:"Path to ffmpeg executable" dft:"ffmpeg"`
-	LogLevel   string `cli:"log-level" usage:"Log level (trace, debug, info, warn, error, fatal, panic)" dft:"info"`
-	JsonLogs   bool   `cli:"j,json-logs" usage:"Output JSON logs instead of plain text" dft:"false"`
+	Config     string   `cli:"c,config" usage:"Path to a YAML configuration file, whose keys are the long option names" dft:""`
+	BindAddr   string   `cli:"a,addr" usage:"address to listen on" dft:":8080"`
+	DebugTTS   bool     `cli:"d,debug" usage:"enable debug logging for TTS engine events" dft:"false"`
+	ApiKeys    []string `cli:"k,apikey" usage:"API key for authentication (can be used multiple times)" dft:""`
+	KeysFile   string   `cli:"keys-file" usage:"Path to a YAML file listing API keys with their labels and scopes" dft:""`
+	AdminKey   string   `cli:"admin-key" usage:"Key for the cache administration endpoints, which are disabled if empty" dft:""`
+	FfmpegPath string   `cli:"ffmpeg-path" usage:"Path to ffmpeg executable" dft:"ffmpeg"`
+	LogLevel   string   `cli:"log-level" usage:"Log level (trace, debug, info, warn, error, fatal, panic)" dft:"info"`
+	JsonLogs   bool     `cli:"j,json-logs" usage:"Output JSON logs instead of plain text" dft:"false"`
+	FakeEngine bool     `cli:"fake-engine" usage:"Use an in-process fake synthesizer instead of the Loquendo engine (for testing)" dft:"false"`
+	EngineDLL  string   `cli:"engine-dll" usage:"Path to the Loquendo engine DLL, found from the registry if empty" dft:""`
+	EngineIni  string   `cli:"engine-ini" usage:"Path to the Loquendo session configuration file, the engine default if empty" dft:""`
+
+	PoolMin         int `cli:"pool-min" usage:"Minimum number of warm TTS engine sessions" dft:"1"`
+	PoolMax         int `cli:"pool-max" usage:"Maximum number of TTS engine sessions" dft:"4"`
+	PoolIdleTimeout int `cli:"pool-idle-timeout" usage:"Seconds after which idle TTS engine sessions above the minimum are closed" dft:"300"`
+	PoolHealthCheck int `cli:"pool-health-check" usage:"Seconds between health checks of idle TTS engine sessions, 0 to disable" dft:"60"`
+
+	MaxConcurrency int `cli:"max-concurrency" usage:"Maximum number of speech requests served at once" dft:"4"`
+	MaxQueue       int `cli:"max-queue" usage:"Maximum number of speech requests waiting for a free slot" dft:"32"`
+	QueueTimeout   int `cli:"queue-timeout" usage:"Seconds a speech request may wait in queue before being rejected" dft:"30"`
+
+	RateRequests     float64 `cli:"rate-requests" usage:"Speech requests per second allowed per API key, 0 for no limit" dft:"0"`
+	RateCharacters   int     `cli:"rate-characters" usage:"Input characters per minute allowed per API key, 0 for no limit" dft:"0"`
+	IPRateRequests   float64 `cli:"ip-rate-requests" usage:"Speech requests per second allowed per client IP, 0 for no limit" dft:"0"`
+	IPRateCharacters int     `cli:"ip-rate-characters" usage:"Input characters per minute allowed per client IP, 0 for no limit" dft:"0"`
+	QuotaDaily       int     `cli:"quota-daily" usage:"Input characters per day allowed per API key, 0 for no limit" dft:"0"`
+	QuotaMonthly     int     `cli:"quota-monthly" usage:"Input characters per month allowed per API key, 0 for no limit" dft:"0"`
+	QuotaFile        string  `cli:"quota-file" usage:"File where the quota usage of the API keys is saved, empty to keep it in memory only" dft:""`
+
+	ReadySynthesis bool `cli:"ready-synthesis" usage:"Render a short test prompt in readiness checks" dft:"false"`
+	DrainTimeout   int  `cli:"drain-timeout" usage:"Seconds to wait for requests in progress to complete on shutdown, before cancelling them" dft:"8"`
+
+	ResultsTTL int `cli:"results-ttl" usage:"Seconds the timings of a speech request are kept after it completes" dft:"600"`
+
+	ChunkSize     int `cli:"chunk-size" usage:"Maximum bytes of input rendered at once; longer inputs are split at paragraphs and sentences, 0 to disable" dft:"1000"`
+	ChunkSessions int `cli:"chunk-sessions" usage:"Maximum number of free TTS engine sessions rendering the chunks of a long input in parallel" dft:"2"`
+
+	Cache     string `cli:"cache" usage:"Synthesis cache backend (none, memory, disk)" dft:"none"`
+	CacheDir  string `cli:"cache-dir" usage:"Directory of the disk synthesis cache" dft:"cache"`
+	CacheSize int    `cli:"cache-size" usage:"Maximum size of the synthesis cache in MiB" dft:"512"`
+	CacheTTL  int    `cli:"cache-ttl" usage:"Seconds cached audio is kept, 0 to keep it until evicted by size" dft:"86400"`
+
+	VoiceAliases  map[string]string `cli:"voice-alias" usage:"Map an OpenAI voice name to a Loquendo voice (can be used multiple times), i.e. --voice-alias alloy=Roberto" dft:""`
+	DefaultParams map[string]string `cli:"p,param" usage:"Set a default engine parameter, overridden by the request instructions (can be used multiple times), i.e. -pAutoGuess=VoiceSentence" dft:""`
+
+	// Keys are the API keys with labels and scopes, which can only be given in the configuration file
+	Keys []apiKeyConfig `cli:"-" yaml:"keys"`
 }
 
 func main() {
 	os.Exit(cli.Run(new(argT), func(ctx *cli.Context) error {
 		argv := ctx.Argv().(*argT)
+		if err := loadConfig(ctx, argv); err != nil {
+			return err
+		}
 		if err := utils.SetLogLevel(argv.LogLevel); err != nil {
 			return err
 		}
@@ -44,6 +96,8 @@ func main() {
 		} else {
 			log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 		}
+		// Requests without a logger of their own log with the global one
+		zerolog.DefaultContextLogger = &log.Logger
 		if err := runServer(argv); err != nil {
 			return err
 		}
@@ -51,13 +105,18 @@ func main() {
 	}))
 }
 
-func getAvailableVoices() ([]loquendo.Voice, error) {
-	loq, err := loquendo.NewTTS(nil)
-	if err != nil {
-		return nil, err
+func newEngine(argv *argT) (loquendo.Engine, error) {
+	if argv.FakeEngine {
+		return loquendo.NewFakeEngine(), nil
 	}
-	defer loq.Close()
-	return loq.GetVoices()
+	var dllPath, iniFile *string
+	if argv.EngineDLL != "" {
+		dllPath = &argv.EngineDLL
+	}
+	if argv.EngineIni != "" {
+		iniFile = &argv.EngineIni
+	}
+	return loquendo.NewEngine(dllPath, iniFile)
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -66,194 +125,176 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
-func serveSpeech(debugTTS bool, ffmpegPath string, w http.ResponseWriter, r *http.Request) {
-	type requestBody struct {
-		Input          string  `json:"input"`
-		Model          string  `json:"model"`
-		_              any     `json:"voice"`
-		Instructions   string  `json:"instructions" default:""`
-		ResponseFormat string  `json:"response_format" default:"mp3"`
-		Speed          float64 `json:"speed" default:"1.0"`
-		StreamFormat   string  `json:"stream_format"`
-	}
-	var reqBody requestBody
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		log.Err(err).Msg("Error decoding JSON body")
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
-		return
+func runServer(argv *argT) error {
+	engine, err := newEngine(argv)
+	if err != nil {
+		return err
 	}
-
-	if !slices.Contains([]string{"mp3", "opus", "aac", "flac", "wav"}, reqBody.ResponseFormat) {
-		log.Warn().Str("response_format", reqBody.ResponseFormat).Msg("Unsupported response format")
-		http.Error(w, "Unsupported response format", http.StatusBadRequest)
-		return
+	defer engine.Close()
+
+	pool, err := loquendo.NewPool(engine, loquendo.PoolOptions{
+		MinSize:             argv.PoolMin,
+		MaxSize:             argv.PoolMax,
+		IdleTimeout:         time.Duration(argv.PoolIdleTimeout) * time.Second,
+		HealthCheckInterval: time.Duration(argv.PoolHealthCheck) * time.Second,
+		DebugEvents:         argv.DebugTTS,
+	})
+	if err != nil {
+		return err
 	}
+	defer pool.Close()
+	registerPoolMetrics(pool)
 
-	if reqBody.StreamFormat != "" && reqBody.StreamFormat != "audio" {
-		log.Warn().Str("stream_format", reqBody.StreamFormat).Msg("Unsupported stream format")
-		http.Error(w, "Unsupported stream format (only 'audio' is supported)", http.StatusNotImplemented)
-		return
-	}
+	// Prepare the list of available voices
+	voices := pool.Voices()
+	log.Debug().Str("voices", fmt.Sprintf("%+v", voices)).Msg("Available voices")
 
-	if reqBody.Speed < 0 || reqBody.Speed > 4 {
-		log.Warn().Float64("speed", reqBody.Speed).Msg("Invalid speed")
-		http.Error(w, "Invalid speed (must be between 0 and 4)", http.StatusBadRequest)
-		return
-	}
+	models := make(map[string]any)
+	data := make([]map[string]string, 0)
 
-	inputVoice := strings.TrimPrefix(reqBody.Model, "tts-loquendo-")
-	if inputVoice == "" {
-		log.Warn().Str("model", reqBody.Model).Msg("Invalid model")
-		http.Error(w, "Invalid model", http.StatusBadRequest)
-		return
+	models["object"] = "list"
+	for _, v := range voices {
+		data = append(data, map[string]string{
+			"id":              fmt.Sprintf("tts-loquendo-%s", strings.ToLower(v.Id)),
+			"name":            v.Id,
+			"native_language": v.NativeLanguage,
+			"gender":          v.Gender,
+			"object":          "model",
+		})
 	}
+	models["data"] = data
 
-	loq, err := loquendo.NewTTS(nil)
-	if err != nil {
-		log.Err(err).Msg("Error initializing TTS engine")
-		http.Error(w, "TTS engine error: "+err.Error(), http.StatusInternalServerError)
-		return
+	keyConfigs := argv.Keys
+	for _, k := range argv.ApiKeys {
+		keyConfigs = append(keyConfigs, apiKeyConfig{Key: k})
 	}
-	defer loq.Close()
-
-	if debugTTS {
-		loq.SetDebugEvents(true)
+	if argv.KeysFile != "" {
+		fileKeys, err := loadKeysFile(argv.KeysFile)
+		if err != nil {
+			return err
+		}
+		keyConfigs = append(keyConfigs, fileKeys...)
 	}
-
-	voices, err := loq.GetVoices()
+	keys, err := newKeyStore(keyConfigs, voices, keyLimits{
+		requests:   ratelimit.PerSecond(argv.RateRequests),
+		characters: ratelimit.PerMinute(float64(argv.RateCharacters)),
+		quota:      ratelimit.QuotaLimits{Daily: int64(argv.QuotaDaily), Monthly: int64(argv.QuotaMonthly)},
+	})
 	if err != nil {
-		log.Err(err).Msg("Error retrieving available voices from TTS engine")
-		http.Error(w, "TTS engine error: "+err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
+	log.Info().Int("keys", len(keys.keys)).Msg("API keys loaded")
 
-	voice := ""
-	for _, v := range voices {
-		if strings.EqualFold(v.Id, inputVoice) {
-			voice = v.Id
-			break
+	var quotas *ratelimit.Quotas
+	if keys.hasQuotas() {
+		if quotas, err = ratelimit.OpenQuotas(argv.QuotaFile, quotaFlushInterval); err != nil {
+			return err
+		}
+		if argv.QuotaFile == "" {
+			log.Warn().Msg("No quota file, the quota usage will be lost on restart")
 		}
+		defer quotas.Close()
 	}
+	rates := newRateLimiter(ratelimit.PerSecond(argv.IPRateRequests), ratelimit.PerMinute(float64(argv.IPRateCharacters)), quotas)
+	apiKeyMiddleware := keys.middleware
 
-	if voice == "" {
-		log.Warn().Str("voice", inputVoice).Msg("Voice not found")
-		http.Error(w, "Requested voice not found: "+inputVoice, http.StatusNotFound)
-		return
+	if argv.MaxConcurrency < 1 {
+		return fmt.Errorf("invalid max concurrency %d", argv.MaxConcurrency)
 	}
+	limiter := newRequestLimiter(argv.MaxConcurrency, max(argv.MaxQueue, 0), time.Duration(argv.QueueTimeout)*time.Second)
 
-	var mappedSpeed int32 = 50
-	if reqBody.Speed != 1 {
-		// Map:  2^x, with x in [-2, +2]
-		// To:   [0, 100]
-		mappedSpeed = int32(100 * (math.Log2(reqBody.Speed) + 2) / 4)
+	encoders := detectEncoders(argv.FfmpegPath)
+	log.Info().Interface("formats", encoders).Msg("Available response formats")
+
+	speechCache, err := newCache(argv.Cache, argv.CacheDir, int64(argv.CacheSize)<<20, time.Duration(argv.CacheTTL)*time.Second)
+	if err != nil {
+		return err
+	}
+	if speechCache != nil {
+		log.Info().Interface("cache", speechCache.Stats()).Msg("Synthesis cache enabled")
 	}
-	log.Debug().Float64("from", reqBody.Speed).Int32("to", mappedSpeed).Msg("Mapped speed")
 
-	for _, line := range strings.Split(reqBody.Instructions, "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			log.Warn().Str("line", line).Msg("Invalid instruction line (expected 'key=value')")
-			continue
-		}
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-		log.Debug().Str("key", key).Str("value", value).Msg("Setting TTS parameter from instructions")
-		if err := loq.SetParam(key, value); err != nil {
-			log.Warn().Err(err).Str("key", key).Str("value", value).Msg("Error setting TTS parameter")
-			http.Error(w, fmt.Sprintf("Invalid TTS parameter in instructions: '%s'", line), http.StatusBadRequest)
-			return
-		}
+	health := newHealthChecker(engine, pool, argv.ReadySynthesis)
+	if ready := health.check(context.Background()); ready.Ready {
+		log.Info().Str("version", ready.EngineVersion).Int("voices", ready.Voices).Msg("Engine ready")
 	}
 
-	reader, err := loq.SpeakStreaming(reqBody.Input, &loquendo.SpeechOptions{
-		Voice: voice,
-		Speed: &mappedSpeed,
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /healthz", health.serveHealth)
+	mux.HandleFunc("GET /readyz", health.serveReady)
+
+	mux.HandleFunc("GET /v1/models", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, models)
 	})
-	if err != nil {
-		log.Err(err).Msg("Error starting TTS streaming")
-		http.Error(w, "TTS engine error: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
 
-	mimeType := fmt.Sprintf("audio/%s", reqBody.ResponseFormat)
-	fileExt := reqBody.ResponseFormat
-	if reqBody.ResponseFormat == "ogg" {
-		mimeType = "audio/ogg"
-		fileExt = "oga"
-	}
-	if reqBody.ResponseFormat != "wav" {
-		newReader, err := TranscodeAudio(reader, reqBody.ResponseFormat, ffmpegPath)
-		if err != nil {
-			log.Error().Err(err).Msg("Error transcoding audio")
-			http.Error(w, "Error transcoding audio", http.StatusInternalServerError)
-			reader.Close()
-			return
+	// The engine inventory is cached by the pool, so voices are filtered here rather than by querying a session
+	mux.HandleFunc("GET /v1/voices", func(w http.ResponseWriter, r *http.Request) {
+		filter := loquendo.VoiceFilter{Language: r.URL.Query().Get("language"), Gender: r.URL.Query().Get("gender")}
+		matched := make([]loquendo.Voice, 0, len(voices))
+		for _, v := range voices {
+			if filter.Match(v) {
+				matched = append(matched, v)
+			}
 		}
-		reader = newReader
-	}
-	defer reader.Close()
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": matched})
+	})
 
-	w.Header().Set("Content-Type", mimeType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=tts.%s", fileExt))
-	w.WriteHeader(http.StatusOK)
+	mux.HandleFunc("GET /v1/languages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": pool.Languages()})
+	})
 
-	if _, err = io.Copy(w, reader); err != nil {
-		log.Error().Err(err).Msg("Error writing audio to response")
-		http.Error(w, "Error writing audio to response", http.StatusInternalServerError)
-		return
-	}
-}
+	mux.HandleFunc("GET /v1/styles", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": pool.Styles()})
+	})
 
-func runServer(argv *argT) error {
-	// Prepare the list of available voices
-	voices, err := getAvailableVoices()
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	mux.HandleFunc("GET /v1/status", func(w http.ResponseWriter, r *http.Request) {
+		status := map[string]any{
+			"queue":   limiter.Stats(),
+			"pool":    pool.Stats(),
+			"formats": encoders,
+		}
+		if speechCache != nil {
+			status["cache"] = speechCache.Stats()
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	voiceAliases, err := newVoiceAliases(argv.VoiceAliases, voices)
 	if err != nil {
 		return err
 	}
-	log.Debug().Str("voices", fmt.Sprintf("%+v", voices)).Msg("Available voices")
 
-	models := make(map[string]any)
-	data := make([]map[string]string, 0)
-
-	models["object"] = "list"
-	for _, v := range voices {
-		data = append(data, map[string]string{
-			"id":              fmt.Sprintf("tts-loquendo-%s", strings.ToLower(v.Id)),
-			"name":            v.Id,
-			"native_language": v.NativeLanguage,
-			"gender":          v.Gender,
-			"object":          "model",
-		})
+	defaultParams, err := newDefaultParams(argv.DefaultParams, pool)
+	if err != nil {
+		return err
 	}
-	models["data"] = data
 
-	apiKeyMiddleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if argv.ApiKey != "" {
-				key := r.Header.Get("Authorization")
-				if key != "Bearer "+argv.ApiKey {
-					log.Warn().Str("key", key).Msg("Invalid API key")
-					http.Error(w, "Unauthorized", http.StatusUnauthorized)
-					return
-				}
-			}
-			next.ServeHTTP(w, r)
-		})
+	speech := &speechServer{
+		pool:          pool,
+		ffmpegPath:    argv.FfmpegPath,
+		results:       newResultStore(time.Duration(argv.ResultsTTL)*time.Second, 1000),
+		voiceAliases:  voiceAliases,
+		encoders:      encoders,
+		chunkSize:     argv.ChunkSize,
+		chunkSessions: argv.ChunkSessions,
+		cache:         speechCache,
+		defaultParams: defaultParams,
+		limits:        rates,
 	}
 
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("GET /v1/models", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, models)
-	})
+	mux.Handle("POST /v1/audio/speech", apiKeyMiddleware(rates.middleware(limiter.middleware(http.HandlerFunc(speech.serveSpeech)))))
+	mux.Handle("GET /v1/audio/speech/{id}/timings", apiKeyMiddleware(http.HandlerFunc(speech.results.serveTimings)))
+	mux.Handle("GET /v1/audio/speech/{id}/subtitles", apiKeyMiddleware(http.HandlerFunc(speech.results.serveSubtitles)))
 
-	mux.Handle("POST /v1/audio/speech", apiKeyMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		serveSpeech(argv.DebugTTS, argv.FfmpegPath, writer, request)
-	})))
+	if speechCache != nil && argv.AdminKey != "" {
+		admin := &cacheAdmin{cache: speechCache}
+		mux.Handle("GET /v1/cache", adminMiddleware(argv.AdminKey, http.HandlerFunc(admin.serveList)))
+		mux.Handle("DELETE /v1/cache", adminMiddleware(argv.AdminKey, http.HandlerFunc(admin.servePurge)))
+		mux.Handle("DELETE /v1/cache/{key}", adminMiddleware(argv.AdminKey, http.HandlerFunc(admin.serveDelete)))
+	}
 
 	webFS := mustSub(webContent, "web")
 	mux.Handle("GET /web/", cacheStatic(http.StripPrefix("/web/", http.FileServer(http.FS(webFS)))))
@@ -265,8 +306,13 @@ func runServer(argv *argT) error {
 	corsMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id, X-Cache, X-Cache-Key, Retry-After, "+
+				"X-Ratelimit-Limit-Requests, X-Ratelimit-Remaining-Requests, X-Ratelimit-Reset-Requests, "+
+				"X-Ratelimit-Limit-Characters, X-Ratelimit-Remaining-Characters, X-Ratelimit-Reset-Characters, "+
+				"X-Ratelimit-Limit-Characters-Daily, X-Ratelimit-Remaining-Characters-Daily, X-Ratelimit-Reset-Characters-Daily, "+
+				"X-Ratelimit-Limit-Characters-Monthly, X-Ratelimit-Remaining-Characters-Monthly, X-Ratelimit-Reset-Characters-Monthly")
 			if r.Method == http.MethodOptions {
 				w.WriteHeader(http.StatusNoContent)
 				return
@@ -282,11 +328,51 @@ func runServer(argv *argT) error {
 		})
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// requestsCtx is cancelled when the drain timeout expires, stopping the syntheses still in progress
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	srv := &http.Server{
+		Addr:        argv.BindAddr,
+		Handler:     logRequestsMiddleware(corsMiddleware(mux)),
+		BaseContext: func(net.Listener) context.Context { return requestsCtx },
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
 	log.Info().Str("addr", argv.BindAddr).Msg("Starting server")
-	if err := http.ListenAndServe(argv.BindAddr, logRequestsMiddleware(corsMiddleware(mux))); err != nil {
+
+	select {
+	case err := <-serveErr:
 		return err
+	case <-ctx.Done():
+	}
+	// Restore the default behavior, so that a second signal kills the server
+	stop()
+
+	drainTimeout := time.Duration(argv.DrainTimeout) * time.Second
+	log.Info().Dur("timeout", drainTimeout).Msg("Shutting down, waiting for requests in progress")
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		log.Warn().Err(err).Msg("Requests still in progress, cancelling them")
+		cancelRequests()
+		_ = srv.Close()
 	}
 
+	// Wait for the cancelled requests to hand back their sessions, so that they are closed before the engine is
+	// unloaded
+	_ = pool.Close()
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), sessionCloseTimeout)
+	defer cancelClose()
+	if err := pool.Drain(closeCtx); err != nil {
+		log.Warn().Int("sessions", pool.Stats().InUse).Msg("TTS sessions still in use, unloading the engine anyway")
+	}
+	log.Info().Msg("Server stopped")
 	return nil
 }
 
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"loq7tts-server/loquendo"
+	"loq7tts-server/pkg/audio"
+	"loq7tts-server/pkg/cache"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// speechServer serves the speech synthesis endpoints.
+type speechServer struct {
+	pool       *loquendo.Pool
+	ffmpegPath string
+	results    *resultStore
+	encoders   map[string]encoderBackend
+	// voiceAliases maps lower-case OpenAI voice names to Loquendo voice IDs
+	voiceAliases map[string]string
+	// chunkSize is the maximum length of the text rendered with a single TTSRead, 0 for no limit
+	chunkSize int
+	// chunkSessions is the maximum number of sessions rendering the chunks of a request
+	chunkSessions int
+	// cache stores the final audio of the syntheses, nil if disabled
+	cache cache.Cache
+	// defaultParams are set before the parameters of the request instructions, which can override them
+	defaultParams []ttsParam
+	// limits applies the character rate limits and quotas
+	limits *rateLimiter
+}
+
+// genericModels are the OpenAI model names accepted in place of a tts-loquendo-<voice> model.
+var genericModels = map[string]bool{
+	"tts-1":           true,
+	"tts-1-hd":        true,
+	"gpt-4o-mini-tts": true,
+}
+
+// newVoiceAliases validates the alias table against the installed voices and normalizes it.
+func newVoiceAliases(aliases map[string]string, voices []loquendo.Voice) (map[string]string, error) {
+	res := make(map[string]string, len(aliases))
+	for name, target := range aliases {
+		voice := findVoice(voices, strings.TrimSpace(target))
+		if voice == "" {
+			return nil, fmt.Errorf("voice alias %s: voice not installed: %s", name, target)
+		}
+		res[strings.ToLower(strings.TrimSpace(name))] = voice
+	}
+	return res, nil
+}
+
+// newDefaultParams checks the default engine parameters on a session of the pool, and returns them sorted by name.
+func newDefaultParams(params map[string]string, pool *loquendo.Pool) ([]ttsParam, error) {
+	res := make([]ttsParam, 0, len(params))
+	for key, value := range params {
+		res = append(res, ttsParam{key: strings.TrimSpace(key), value: strings.TrimSpace(value), line: key + "=" + value})
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].key < res[j].key })
+
+	loq, err := pool.Get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Put(loq)
+	for _, p := range res {
+		if err := loq.SetParam(p.key, p.value); err != nil {
+			return nil, fmt.Errorf("default parameter %s: %w", p.line, err)
+		}
+	}
+	return res, nil
+}
+
+func findVoice(voices []loquendo.Voice, id string) string {
+	for _, v := range voices {
+		if strings.EqualFold(v.Id, id) {
+			return v.Id
+		}
+	}
+	return ""
+}
+
+// resolveLanguage returns the installed language selected by a request, matched case-insensitively, or "" for the
+// native language of the voice.
+func (s *speechServer) resolveLanguage(language string) (string, *apiError) {
+	language = strings.TrimSpace(language)
+	if language == "" {
+		return "", nil
+	}
+	for _, l := range s.pool.Languages() {
+		if strings.EqualFold(l.Id, language) {
+			return l.Id, nil
+		}
+	}
+	return "", invalidRequest("unsupported_language", "language", "Language not installed: "+language)
+}
+
+// resolveStyle returns the installed speaking style selected by a request, or "" for the voice default.
+func (s *speechServer) resolveStyle(style string) (string, *apiError) {
+	style = strings.TrimSpace(style)
+	if style == "" {
+		return "", nil
+	}
+	for _, st := range s.pool.Styles() {
+		if strings.EqualFold(st.Id, style) {
+			return st.Id, nil
+		}
+	}
+	return "", invalidRequest("unsupported_style", "style", "Style not installed: "+style)
+}
+
+// resolveVoice returns the Loquendo voice selected by a request. The voice field takes precedence, either as an
+// alias or as a Loquendo voice ID; otherwise the voice comes from a tts-loquendo-<voice> model name.
+func (s *speechServer) resolveVoice(model, voice string) (string, *apiError) {
+	requested := strings.TrimSpace(voice)
+	if !strings.HasPrefix(model, "tts-loquendo-") && model != "" && !genericModels[model] {
+		return "", invalidRequest("model_not_supported", "model", "Unsupported model: "+model)
+	}
+	param := "voice"
+	if requested == "" {
+		requested = strings.TrimPrefix(model, "tts-loquendo-")
+		if requested == "" || genericModels[model] {
+			return "", invalidRequest("voice_required", "voice", "A voice is required with model "+model)
+		}
+		param = "model"
+	} else if alias, ok := s.voiceAliases[strings.ToLower(requested)]; ok {
+		return alias, nil
+	}
+
+	if found := findVoice(s.pool.Voices(), requested); found != "" {
+		return found, nil
+	}
+	return "", newAPIError(http.StatusNotFound, errorTypeInvalidRequest, "voice_not_found", param, "Requested voice not found: "+requested)
+}
+
+func (s *speechServer) serveSpeech(w http.ResponseWriter, r *http.Request) {
+	type requestBody struct {
+		Input          string  `json:"input"`
+		Model          string  `json:"model"`
+		Voice          string  `json:"voice"`
+		Language       string  `json:"language"`
+		Style          string  `json:"style"`
+		Instructions   string  `json:"instructions"`
+		ResponseFormat string  `json:"response_format"`
+		Speed          float64 `json:"speed"`
+		StreamFormat   string  `json:"stream_format"`
+		SampleRate     uint    `json:"sample_rate"`
+		Channels       int     `json:"channels"`
+	}
+	metrics := newSpeechMetrics(w)
+	w = metrics
+	defer metrics.done()
+
+	requestID := newRequestID()
+	w.Header().Set("X-Request-Id", requestID)
+	logger := log.Ctx(r.Context())
+	key := requestKey(r.Context())
+
+	reqBody := requestBody{ResponseFormat: "mp3", Speed: 1.0}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		logger.Err(err).Msg("Error decoding JSON body")
+		writeError(w, invalidRequest("invalid_json", "", "Invalid JSON body: "+err.Error()))
+		return
+	}
+
+	format, ok := outputFormats[reqBody.ResponseFormat]
+	if !ok {
+		logger.Warn().Str("response_format", reqBody.ResponseFormat).Msg("Unsupported response format")
+		writeError(w, invalidRequest("unsupported_response_format", "response_format", "Unsupported response format: "+reqBody.ResponseFormat))
+		return
+	}
+	metrics.format = reqBody.ResponseFormat
+	if !key.allowsFormat(reqBody.ResponseFormat) {
+		logger.Warn().Str("response_format", reqBody.ResponseFormat).Msg("Response format not allowed for API key")
+		writeError(w, newAPIError(http.StatusForbidden, errorTypePermission, "response_format_not_allowed", "response_format", "Response format not allowed for this API key: "+reqBody.ResponseFormat))
+		return
+	}
+
+	backend, ok := s.encoders[reqBody.ResponseFormat]
+	if !ok {
+		logger.Warn().Str("response_format", reqBody.ResponseFormat).Msg("No encoder available for response format")
+		writeError(w, invalidRequest("response_format_unavailable", "response_format", "Response format not available on this server: "+reqBody.ResponseFormat))
+		return
+	}
+
+	if reqBody.StreamFormat != "" && reqBody.StreamFormat != "audio" && reqBody.StreamFormat != "sse" {
+		logger.Warn().Str("stream_format", reqBody.StreamFormat).Msg("Unsupported stream format")
+		writeError(w, invalidRequest("unsupported_stream_format", "stream_format", "Unsupported stream format (must be 'audio' or 'sse')"))
+		return
+	}
+
+	if reqBody.Speed < 0 || reqBody.Speed > 4 {
+		logger.Warn().Float64("speed", reqBody.Speed).Msg("Invalid speed")
+		writeError(w, invalidRequest("invalid_speed", "speed", "Invalid speed (must be between 0 and 4)"))
+		return
+	}
+
+	sampleRate := format.SampleRate
+	if reqBody.SampleRate != 0 {
+		if reqBody.SampleRate < minSampleRate || reqBody.SampleRate > maxSampleRate {
+			logger.Warn().Uint("sample_rate", reqBody.SampleRate).Msg("Invalid sample rate")
+			writeError(w, invalidRequest("invalid_sample_rate", "sample_rate", fmt.Sprintf("Invalid sample rate (must be between %d and %d)", minSampleRate, maxSampleRate)))
+			return
+		}
+		sampleRate = reqBody.SampleRate
+	} else if sampleRate == 0 {
+		sampleRate = loquendo.DefaultSampleRate
+	}
+
+	channels := 1
+	if reqBody.Channels != 0 {
+		if reqBody.Channels != 1 && reqBody.Channels != 2 {
+			logger.Warn().Int("channels", reqBody.Channels).Msg("Invalid channels")
+			writeError(w, invalidRequest("invalid_channels", "channels", "Invalid channels (must be 1 or 2)"))
+			return
+		}
+		channels = reqBody.Channels
+	}
+	if !supportsChannels(reqBody.ResponseFormat, backend, channels) {
+		logger.Warn().Int("channels", channels).Str("response_format", reqBody.ResponseFormat).Msg("Channels not supported by encoder")
+		writeError(w, invalidRequest("unsupported_channels", "channels", fmt.Sprintf("Response format %s is only available in mono on this server", reqBody.ResponseFormat)))
+		return
+	}
+
+	voice, apiErr := s.resolveVoice(reqBody.Model, reqBody.Voice)
+	if apiErr != nil {
+		logger.Warn().Err(apiErr).Str("model", reqBody.Model).Str("voice", reqBody.Voice).Msg("Invalid voice")
+		writeError(w, apiErr)
+		return
+	}
+	metrics.voice = voice
+	if !key.allowsVoice(voice) {
+		logger.Warn().Str("voice", voice).Msg("Voice not allowed for API key")
+		writeError(w, newAPIError(http.StatusForbidden, errorTypePermission, "voice_not_allowed", "voice", "Voice not allowed for this API key: "+voice))
+		return
+	}
+
+	language, apiErr := s.resolveLanguage(reqBody.Language)
+	var style string
+	if apiErr == nil {
+		style, apiErr = s.resolveStyle(reqBody.Style)
+	}
+	if apiErr != nil {
+		logger.Warn().Err(apiErr).Str("language", reqBody.Language).Str("style", reqBody.Style).Msg("Invalid persona")
+		writeError(w, apiErr)
+		return
+	}
+
+	var mappedSpeed int32 = 50
+	if reqBody.Speed != 1 {
+		// Map:  2^x, with x in [-2, +2]
+		// To:   [0, 100]
+		mappedSpeed = int32(100 * (math.Log2(reqBody.Speed) + 2) / 4)
+	}
+	logger.Debug().Float64("from", reqBody.Speed).Int32("to", mappedSpeed).Msg("Mapped speed")
+
+	params := append(slices.Clip(s.defaultParams), parseInstructions(reqBody.Instructions)...)
+	contentType := format.contentType(sampleRate, channels)
+	sse := reqBody.StreamFormat == "sse"
+	inputChars := utf8.RuneCountInString(reqBody.Input)
+	if apiErr := s.limits.useCharacters(w, r, inputChars); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	var cacheKey string
+	if s.cache != nil {
+		cacheKey = speechKey{
+			Input:      reqBody.Input,
+			Voice:      voice,
+			Language:   language,
+			Style:      style,
+			Speed:      mappedSpeed,
+			Format:     reqBody.ResponseFormat,
+			SampleRate: sampleRate,
+			Channels:   channels,
+		}.hash(params)
+		w.Header().Set("X-Cache-Key", cacheKey)
+		if data, cached, ok := getCachedSpeech(s.cache, cacheKey); ok {
+			logger.Debug().Str("key", cacheKey).Int("size", len(data)).Msg("Serving speech from cache")
+			w.Header().Set("X-Cache", "HIT")
+			if sendAudio(w, r, bytes.NewReader(data), sse, contentType, format.FileExt, inputChars) {
+				s.results.put(requestID, &speechResult{Timings: cached.Timings})
+				metricSpeechAudioSeconds.Add(cached.Timings.Duration.Seconds())
+				logger.Info().Str("request_id", requestID).Str("voice", voice).Str("response_format", reqBody.ResponseFormat).
+					Int("characters", inputChars).Dur("audio", cached.Timings.Duration).Bool("cached", true).Msg("Speech served")
+			}
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	// Only synthesized audio counts towards the quotas: cache hits are free, and failed requests are refunded
+	refundQuota, apiErr := s.limits.chargeQuota(w, r, inputChars)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+	served := false
+	defer func() {
+		if !served {
+			refundQuota()
+		}
+	}()
+
+	loq, err := s.pool.Get(r.Context())
+	if err != nil {
+		logger.Err(err).Msg("Error acquiring TTS engine session")
+		writeError(w, engineError(err))
+		return
+	}
+	defer s.pool.Put(loq)
+
+	renderRate := loquendo.NativeSampleRate(sampleRate)
+	settings := &speechSettings{
+		sampleRate: renderRate,
+		mono:       channels == 1,
+		encoding:   format.Encoding,
+		params:     params,
+	}
+	if err := settings.apply(loq); err != nil {
+		logger.Warn().Err(err).Msg("Error setting TTS parameter")
+		var pErr *paramError
+		if errors.As(err, &pErr) && errors.Is(err, loquendo.ErrInvalidParameter) {
+			writeError(w, invalidRequest("invalid_parameter", "instructions", fmt.Sprintf("Invalid TTS parameter in instructions: '%s'", pErr.param.line)))
+		} else {
+			writeError(w, engineError(err))
+		}
+		return
+	}
+
+	options := &loquendo.SpeechOptions{
+		Voice:    voice,
+		Language: language,
+		Style:    style,
+		Speed:    &mappedSpeed,
+	}
+	var reader io.ReadCloser
+	timings := loq.Timings
+	if chunks := loquendo.SplitChunks(reqBody.Input, s.chunkSize); len(chunks) > 1 {
+		var chunked *chunkedSpeech
+		if chunked, err = newChunkedSpeech(r.Context(), s.pool, loq, settings, options, chunks, s.chunkSessions); err == nil {
+			reader, timings = chunked, chunked.Timings
+		}
+	} else {
+		reader, err = loq.SpeakStreaming(r.Context(), reqBody.Input, options)
+	}
+	if err != nil {
+		logger.Err(err).Msg("Error starting TTS streaming")
+		writeError(w, engineError(err))
+		return
+	}
+
+	if renderRate != sampleRate {
+		logger.Debug().Uint("from", renderRate).Uint("to", sampleRate).Msg("Resampling engine audio")
+		newReader, err := ResampleAudio(reader, sampleRate)
+		if err != nil {
+			logger.Error().Err(err).Msg("Error resampling audio")
+			writeError(w, serverError("audio_processing_error", "Error resampling audio"))
+			reader.Close()
+			return
+		}
+		reader = newReader
+	}
+
+	if format.Raw {
+		stream, err := audio.ReadWAV(reader)
+		if err != nil {
+			logger.Error().Err(err).Msg("Error parsing engine audio")
+			writeError(w, serverError("audio_processing_error", "Error parsing engine audio"))
+			reader.Close()
+			return
+		}
+		logger.Debug().Interface("format", stream.Format).Msg("Stripped WAV header")
+		reader = stream
+	} else if format.Transcode {
+		newReader, err := EncodeAudio(r.Context(), reader, reqBody.ResponseFormat, backend, s.ffmpegPath)
+		if err != nil {
+			logger.Error().Err(err).Str("backend", string(backend)).Msg("Error encoding audio")
+			writeError(w, serverError("audio_processing_error", "Error encoding audio"))
+			reader.Close()
+			return
+		}
+		reader = newReader
+	}
+	defer reader.Close()
+
+	var body io.Reader = reader
+	var capture *captureBuffer
+	if cacheKey != "" {
+		capture = &captureBuffer{}
+		body = io.TeeReader(body, capture)
+	}
+	if !sendAudio(w, r, body, sse, contentType, format.FileExt, inputChars) {
+		return
+	}
+	served = true
+	speechTimings := timings()
+	s.results.put(requestID, &speechResult{Timings: speechTimings})
+	metricSpeechCharacters.Add(float64(inputChars))
+	metricSpeechAudioSeconds.Add(speechTimings.Duration.Seconds())
+	logger.Info().Str("request_id", requestID).Str("voice", voice).Str("response_format", reqBody.ResponseFormat).
+		Int("characters", inputChars).Dur("audio", speechTimings.Duration).Bool("cached", false).Msg("Speech served")
+	if capture != nil && !capture.overflow {
+		if reqBody.ResponseFormat == "wav" {
+			// The response was streamed with unknown sizes, which are known by now
+			audio.FixWAVSizes(capture.Bytes())
+		}
+		putCachedSpeech(s.cache, cacheKey, capture.Bytes(), speechTimings)
+	}
+}
+
+// sendAudio sends the audio to the client, as SSE events or as a file of the given content type. It returns whether
+// all of the audio was sent.
+func sendAudio(w http.ResponseWriter, r *http.Request, reader io.Reader, sse bool, contentType, fileExt string, inputChars int) bool {
+	if sse {
+		if err := streamSSE(w, reader, inputChars); err != nil {
+			logStreamError(r, err, "Error streaming audio events")
+			return false
+		}
+		return true
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=tts.%s", fileExt))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, reader); err != nil {
+		logStreamError(r, err, "Error writing audio to response")
+		return false
+	}
+	return true
+}
+
+// logStreamError logs an error that interrupted the audio stream. Clients that disconnect are not an error: the
+// synthesis has already been aborted through the request context.
+func logStreamError(r *http.Request, err error, msg string) {
+	if r.Context().Err() != nil {
+		log.Ctx(r.Context()).Info().Err(err).Msg("Client disconnected, synthesis aborted")
+		return
+	}
+	log.Ctx(r.Context()).Error().Err(err).Msg(msg)
+}
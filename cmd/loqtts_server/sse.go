@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+type sseAudioDelta struct {
+	Type  string `json:"type"`
+	Audio string `json:"audio"`
+}
+
+type sseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type sseAudioDone struct {
+	Type  string   `json:"type"`
+	Usage sseUsage `json:"usage"`
+}
+
+func writeSSEEvent(w http.ResponseWriter, rc *http.ResponseController, event any) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// streamSSE sends the audio as a stream of speech.audio.delta Server-Sent Events, each one flushed as soon as the
+// audio is available, followed by a speech.audio.done event. The engine has no notion of tokens, so the usage
+// reports the number of input characters instead.
+func streamSSE(w http.ResponseWriter, reader io.Reader, inputChars int) error {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			delta := sseAudioDelta{
+				Type:  "speech.audio.delta",
+				Audio: base64.StdEncoding.EncodeToString(buf[:n]),
+			}
+			if wErr := writeSSEEvent(w, rc, delta); wErr != nil {
+				return wErr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeSSEEvent(w, rc, sseAudioDone{
+		Type: "speech.audio.done",
+		Usage: sseUsage{
+			InputTokens:  inputChars,
+			OutputTokens: 0,
+			TotalTokens:  inputChars,
+		},
+	})
+}
@@ -1,25 +1,174 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"loq7tts-server/loquendo"
+	"loq7tts-server/pkg/audio"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-// TranscodeAudio transcodes the wave audio into the specified format using FFmpeg
-func TranscodeAudio(reader io.ReadCloser, outFormat string, ffmpegPath string) (io.ReadCloser, error) {
-	cmd := exec.Command(ffmpegPath, "-i", "pipe:0")
+type outputFormat struct {
+	MimeType   string
+	FileExt    string
+	SampleRate uint                   // SampleRate requested to the engine, 0 for the engine default
+	Encoding   loquendo.AudioEncoding // Encoding requested to the engine
+	Raw        bool                   // Raw formats are the engine output with the WAV header stripped
+	Transcode  bool                   // Transcode formats are produced by an encoder, in-process or ffmpeg
+}
+
+var outputFormats = map[string]outputFormat{
+	"mp3":  {MimeType: "audio/mp3", FileExt: "mp3", Transcode: true},
+	"opus": {MimeType: "audio/opus", FileExt: "opus", Transcode: true},
+	"aac":  {MimeType: "audio/aac", FileExt: "aac", Transcode: true},
+	"flac": {MimeType: "audio/flac", FileExt: "flac", Transcode: true},
+	"wav":  {MimeType: "audio/wav", FileExt: "wav"},
+	// Raw 24 kHz 16-bit little-endian mono, as in the OpenAI API
+	"pcm": {MimeType: "audio/L16", FileExt: "pcm", SampleRate: 24000, Raw: true},
+	// Raw 8 kHz G.711, for telephony
+	"ulaw": {MimeType: "audio/PCMU", FileExt: "ulaw", SampleRate: 8000, Encoding: loquendo.AudioEncodingULaw, Raw: true},
+	"alaw": {MimeType: "audio/PCMA", FileExt: "alaw", SampleRate: 8000, Encoding: loquendo.AudioEncodingALaw, Raw: true},
+}
+
+// Limits of the sample rate that can be requested. Rates the engine does not support natively are resampled.
+const (
+	minSampleRate = 8000
+	maxSampleRate = 48000
+)
+
+// contentType returns the MIME type of the response. Since raw formats have no header, their sample rate and
+// channels are given as parameters.
+func (f outputFormat) contentType(sampleRate uint, channels int) string {
+	if !f.Raw {
+		return f.MimeType
+	}
+	return fmt.Sprintf("%s; rate=%d; channels=%d", f.MimeType, sampleRate, channels)
+}
+
+// encoderBackend tells how an output format is produced.
+type encoderBackend string
+
+const (
+	backendEngine encoderBackend = "engine" // backendEngine formats are rendered directly by the engine
+	backendNative encoderBackend = "native" // backendNative formats are encoded in-process
+	backendFFmpeg encoderBackend = "ffmpeg" // backendFFmpeg formats are transcoded with ffmpeg
+)
+
+// ffmpegEncoders are the ffmpeg encoders used for each format, see TranscodeAudio.
+var ffmpegEncoders = map[string]string{
+	"mp3":  "libmp3lame",
+	"opus": "libopus",
+	"aac":  "aac",
+	"flac": "flac",
+}
+
+// ffmpegPreferred are the formats transcoded with ffmpeg whenever it supports them, their in-process encoder being
+// only a fallback: libopus codes stereo and at a higher quality than the in-process CELT-only encoder.
+var ffmpegPreferred = map[string]bool{
+	"opus": true,
+}
+
+// detectEncoders returns how each available output format is produced. Formats with an in-process encoder are
+// always available, the others only if ffmpeg is found and supports them.
+func detectEncoders(ffmpegPath string) map[string]encoderBackend {
+	available := ffmpegAvailableEncoders(ffmpegPath)
+	res := make(map[string]encoderBackend)
+	for name, format := range outputFormats {
+		switch {
+		case !format.Transcode:
+			res[name] = backendEngine
+		case ffmpegPreferred[name] && available[ffmpegEncoders[name]]:
+			res[name] = backendFFmpeg
+		case audio.HasEncoder(name):
+			res[name] = backendNative
+		case available[ffmpegEncoders[name]]:
+			res[name] = backendFFmpeg
+		}
+	}
+	return res
+}
+
+// ffmpegAvailableEncoders lists the audio encoders of ffmpeg, or nothing if it cannot be run.
+func ffmpegAvailableEncoders(ffmpegPath string) map[string]bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		log.Warn().Err(err).Str("ffmpeg_path", ffmpegPath).Msg("ffmpeg not available, only in-process encoders will be used")
+		return nil
+	}
+	res := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		// i.e. " A....D libopus              libopus Opus"
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "A") {
+			res[fields[1]] = true
+		}
+	}
+	return res
+}
+
+// supportsChannels tells whether the backend can encode the format with the given number of channels.
+func supportsChannels(name string, backend encoderBackend, channels int) bool {
+	if backend != backendNative {
+		return true
+	}
+	_, err := audio.NewEncoder(name, io.Discard, audio.PCM16(maxSampleRate, uint16(channels)))
+	return err == nil
+}
+
+// EncodeAudio encodes the engine WAV stream into the output format, with the given backend.
+func EncodeAudio(ctx context.Context, reader io.ReadCloser, outFormat string, backend encoderBackend, ffmpegPath string) (io.ReadCloser, error) {
+	if backend == backendFFmpeg {
+		return TranscodeAudio(ctx, reader, outFormat, ffmpegPath)
+	}
+	stream, err := audio.ReadWAV(reader)
+	if err != nil {
+		return nil, err
+	}
+	return audio.Encode(stream, outFormat)
+}
+
+// ResampleAudio converts the engine WAV stream to the given sample rate, keeping its channels and encoding.
+func ResampleAudio(reader io.ReadCloser, sampleRate uint) (io.ReadCloser, error) {
+	stream, err := audio.ReadWAV(reader)
+	if err != nil {
+		return nil, err
+	}
+	target := stream.Format
+	target.SampleRate = uint32(sampleRate)
+	converted, err := audio.Convert(stream, target)
+	if err != nil {
+		return nil, err
+	}
+	return audio.Encode(converted, "wav")
+}
+
+// TranscodeAudio transcodes the wave audio into the specified format using FFmpeg. FFmpeg is killed, and the
+// source reader closed, when the context is done or the returned reader is closed before the end of the output.
+func TranscodeAudio(ctx context.Context, reader io.ReadCloser, outFormat string, ffmpegPath string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-i", "pipe:0")
 	cmd.Stdin = reader
 	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error {
+		_ = reader.Close()
+		return cmd.Process.Kill()
+	}
+	cmd.WaitDelay = 5 * time.Second
 	//if ffmpegPath != "" {
 	//	cmd.Path = ffmpegPath
 	//}
 
 	switch outFormat {
 	case "wav":
+		cancel()
 		return nil, fmt.Errorf("programming error: should not call ffmpeg to output wav")
 	case "opus", "ogg", "vorbis":
 		cmd.Args = append(cmd.Args, "-f", "ogg", "-c:a", "libopus")
@@ -30,26 +179,46 @@ func TranscodeAudio(reader io.ReadCloser, outFormat string, ffmpegPath string) (
 	case "flac":
 		cmd.Args = append(cmd.Args, "-f", "flac")
 	default:
+		cancel()
 		return nil, fmt.Errorf("unsupported output format: %s", outFormat)
 	}
 	cmd.Args = append(cmd.Args, "pipe:1")
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
+	// Wait must not be called before the output has been read, so the output goes through a pipe that stays
+	// readable after the process exits
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
 	log.Debug().Strs("ffmpeg_args", cmd.Args).Msg("starting ffmpeg with arguments")
 
 	if err := cmd.Start(); err != nil {
+		metricFFmpegFailures.WithLabelValues(outFormat).Inc()
+		cancel()
 		return nil, err
 	}
 
 	go func() {
-		if err := cmd.Wait(); err != nil {
+		err := cmd.Wait()
+		if err != nil && ctx.Err() == nil {
 			log.Error().Err(err).Msg("ffmpeg exited with error")
+			metricFFmpegFailures.WithLabelValues(outFormat).Inc()
+		} else if err != nil {
+			log.Debug().Err(err).Msg("ffmpeg stopped")
 		}
 		reader.Close()
+		_ = pw.CloseWithError(err)
+		cancel()
 	}()
 
-	return stdout, nil
+	return &transcodeStream{PipeReader: pr, cancel: cancel}, nil
+}
+
+// transcodeStream kills FFmpeg when closed.
+type transcodeStream struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (t *transcodeStream) Close() error {
+	t.cancel()
+	return t.PipeReader.Close()
 }
@@ -36,7 +36,7 @@ window.translations.en = {
     // Audio formats
     formats: {
         mp3: "MP3 (default)",
-        opus: "OGG/Vorbis",
+        opus: "Ogg/Opus",
         aac: "AAC (YouTube, mobile)",
         flac: "FLAC (lossless)",
         wav: "WAV (low latency)",
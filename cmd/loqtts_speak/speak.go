@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"loq7tts-server/loquendo"
+	"loq7tts-server/pkg/audio"
+	"loq7tts-server/pkg/subtitles"
 	"loq7tts-server/pkg/utils"
 	"os"
+	"os/signal"
 	"runtime/debug"
 
 	"github.com/mkideal/cli"
@@ -20,13 +24,48 @@ type argT struct {
 	Text       string            `cli:"t,text" usage:"Text to speak, - for stdin. Default: the voice's demo sentence" dft:""`
 	Voice      string            `cli:"v,voice" usage:"Voice to use"`
 	Speed      int32             `cli:"s,speed" usage:"Speech speed in the range 0-100. Default: 50" dft:"50"`
+	SampleRate uint              `cli:"r,sample-rate" usage:"Output sample rate in Hz, between 8000 and 48000. Default: 32000" dft:"0"`
+	Stereo     bool              `cli:"stereo" usage:"Output stereo audio instead of mono" dft:"false"`
 	ListVoices bool              `cli:"l,list-voices" usage:"List available voices" dft:"false"`
+	Language   string            `cli:"language" usage:"Language to speak, for multilingual voices. Default: the voice's native language. With list-voices, only list the voices of this native language" dft:""`
+	Style      string            `cli:"style" usage:"Speaking style to use. Default: the voice's default style" dft:""`
+	Gender     string            `cli:"gender" usage:"Only list the voices of this gender (for list-voices)" dft:""`
+	ListLangs  bool              `cli:"list-languages" usage:"List available languages" dft:"false"`
+	ListStyles bool              `cli:"list-styles" usage:"List available speaking styles" dft:"false"`
 	Params     map[string]string `cli:"p,param" usage:"Set a parameter for the voice engine (can be used multiple times), i.e. -pAutoGuess=\"VoiceSentence:Italian,English\"" dft:""`
-	JsonOutput bool              `cli:"j,json" usage:"Output JSON instead of plain text (for list-voices)" dft:"false"`
+	JsonOutput bool              `cli:"j,json" usage:"Output JSON instead of plain text (for the list options)" dft:"false"`
 	Output     string            `cli:"o,output" usage:"Output file name, - for stdout" dft:""`
+	Subtitles  string            `cli:"subtitles" usage:"Also write subtitles aligned to the audio to this file (.vtt or .srt)" dft:""`
+	Events     bool              `cli:"events" usage:"Log the engine events (sentences, bookmarks, ...) while speaking" dft:"false"`
 	LogLevel   string            `cli:"log-level" usage:"Log level (trace, debug, info, warn, error, fatal, panic)" dft:"info"`
 	DebugTTS   bool              `cli:"d,debug" usage:"enable debug logging for TTS engine events" dft:"false"`
 	Version    bool              `cli:"V,version" usage:"show version information" dft:"false"`
+	FakeEngine bool              `cli:"fake-engine" usage:"use an in-process fake synthesizer instead of the Loquendo engine (for testing)" dft:"false"`
+	EngineDLL  string            `cli:"engine-dll" usage:"path to the Loquendo engine DLL, found from the registry if empty" dft:""`
+	EngineIni  string            `cli:"engine-ini" usage:"path to the Loquendo session configuration file, the engine default if empty" dft:""`
+}
+
+func newEngine(argv *argT) (loquendo.Engine, error) {
+	if argv.FakeEngine {
+		return loquendo.NewFakeEngine(), nil
+	}
+	var dllPath, iniFile *string
+	if argv.EngineDLL != "" {
+		dllPath = &argv.EngineDLL
+	}
+	if argv.EngineIni != "" {
+		iniFile = &argv.EngineIni
+	}
+	return loquendo.NewEngine(dllPath, iniFile)
+}
+
+func printJSON(v any) error {
+	jsonData, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	println(string(jsonData))
+	return nil
 }
 
 func main() {
@@ -38,6 +77,12 @@ func main() {
 		}
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
+		engine, err := newEngine(argv)
+		if err != nil {
+			return err
+		}
+		defer engine.Close()
+
 		if argv.Version {
 			goLibVersion := "unknown"
 			buildInfo, ok := debug.ReadBuildInfo()
@@ -45,7 +90,7 @@ func main() {
 				goLibVersion = buildInfo.Main.Version
 			}
 
-			loqVersion, err := loquendo.GetVersionInfo()
+			loqVersion, err := engine.GetVersionInfo()
 			if err != nil {
 				return err
 			}
@@ -72,7 +117,7 @@ func main() {
 			return nil
 		}
 
-		loq, err := loquendo.NewTTS(nil)
+		loq, err := engine.NewSynthesizer()
 		if err != nil {
 			return err
 		}
@@ -82,19 +127,45 @@ func main() {
 			loq.SetDebugEvents(true)
 		}
 
-		voices, err := loq.GetVoices()
-		if err != nil {
-			return err
+		if argv.ListLangs {
+			languages, err := loq.GetLanguages()
+			if err != nil {
+				return err
+			}
+			if argv.JsonOutput {
+				return printJSON(languages)
+			}
+			println("Available languages:")
+			for _, l := range languages {
+				println(" - Id:", l.Id)
+				fmt.Printf("   Description: %s\n", l.Description)
+			}
+			return nil
+		}
+
+		if argv.ListStyles {
+			styles, err := loq.GetStyles()
+			if err != nil {
+				return err
+			}
+			if argv.JsonOutput {
+				return printJSON(styles)
+			}
+			println("Available styles:")
+			for _, s := range styles {
+				println(" - Id:", s.Id)
+				fmt.Printf("   Description: %s\n", s.Description)
+			}
+			return nil
 		}
 
 		if argv.ListVoices {
+			voices, err := loq.FindVoices(loquendo.VoiceFilter{Language: argv.Language, Gender: argv.Gender})
+			if err != nil {
+				return err
+			}
 			if argv.JsonOutput {
-				jsonData, err := json.MarshalIndent(voices, "", "  ")
-				if err != nil {
-					return err
-				}
-				println(string(jsonData))
-				return nil
+				return printJSON(voices)
 			}
 
 			println("Available voices:")
@@ -112,6 +183,11 @@ func main() {
 			return fmt.Errorf("voice not specified")
 		}
 
+		voices, err := loq.GetVoices()
+		if err != nil {
+			return err
+		}
+
 		voiceId := argv.Voice
 		var voice *loquendo.Voice = nil
 		for _, v := range voices {
@@ -135,6 +211,22 @@ func main() {
 			text = string(bytes)
 		}
 
+		sampleRate := argv.SampleRate
+		if sampleRate == 0 {
+			sampleRate = loquendo.DefaultSampleRate
+		} else if sampleRate < 8000 || sampleRate > 48000 {
+			return fmt.Errorf("invalid sample rate %d, must be between 8000 and 48000", sampleRate)
+		}
+		renderRate := loquendo.NativeSampleRate(sampleRate)
+		loq.SetAudioSettings(renderRate, !argv.Stereo)
+
+		var subFormat subtitles.Format
+		if argv.Subtitles != "" {
+			if subFormat, err = subtitles.FormatFromPath(argv.Subtitles); err != nil {
+				return err
+			}
+		}
+
 		for k, v := range argv.Params {
 			log.Trace().Str("key", k).Str("value", v).Msg("Setting parameter")
 			if err := loq.SetParam(k, v); err != nil {
@@ -142,15 +234,56 @@ func main() {
 			}
 		}
 
-		reader, err := loq.SpeakStreaming(text, &loquendo.SpeechOptions{
-			Voice: voiceId,
-			Speed: &argv.Speed,
-		})
-		if err != nil {
-			return err
+		// Stop the engine on Ctrl+C, instead of leaving it rendering into a closed pipe
+		speakCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		options := &loquendo.SpeechOptions{
+			Voice:    voiceId,
+			Language: argv.Language,
+			Style:    argv.Style,
+			Speed:    &argv.Speed,
+		}
+		var reader io.ReadCloser
+		eventsDone := make(chan struct{})
+		if argv.Events {
+			var events <-chan loquendo.Event
+			if reader, events, err = loq.SpeakEvents(speakCtx, text, options); err != nil {
+				return err
+			}
+			go func() {
+				defer close(eventsDone)
+				for e := range events {
+					entry := log.Info().Stringer("type", e.Type).Dur("at", e.Time)
+					if e.Type == loquendo.EventSentence {
+						entry = entry.Int("index", e.Index)
+					}
+					if e.Text != "" {
+						entry = entry.Str("text", e.Text)
+					}
+					entry.Msg("TTS event")
+				}
+			}()
+		} else {
+			close(eventsDone)
+			if reader, err = loq.SpeakStreaming(speakCtx, text, options); err != nil {
+				return err
+			}
 		}
 		defer reader.Close()
 
+		var stream *audio.Stream
+		if renderRate != sampleRate {
+			// The engine cannot render at the requested rate
+			if stream, err = audio.ReadWAV(reader); err != nil {
+				return err
+			}
+			format := stream.Format
+			format.SampleRate = uint32(sampleRate)
+			if stream, err = audio.Convert(stream, format); err != nil {
+				return err
+			}
+		}
+
 		var output io.Writer
 		if argv.Output == "" {
 			if term.IsTerminal(int(os.Stdout.Fd())) {
@@ -167,7 +300,39 @@ func main() {
 			}
 			defer output.(*os.File).Close()
 		}
-		_, err = io.Copy(output, reader)
+		if stream != nil {
+			err = writeWAV(output, stream)
+		} else {
+			_, err = io.Copy(output, reader)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing audio: %s", err)
+		}
+		// The event channel is closed once the prompt has ended
+		_ = reader.Close()
+		<-eventsDone
+
+		if argv.Subtitles != "" {
+			subFile, err := os.Create(argv.Subtitles)
+			if err != nil {
+				return fmt.Errorf("error opening subtitles file: %s", err)
+			}
+			defer subFile.Close()
+			if err = subtitles.Write(subFile, subFormat, subtitles.FromTimings(loq.Timings())); err != nil {
+				return fmt.Errorf("error writing subtitles: %s", err)
+			}
+		}
 		return nil
 	}))
 }
+
+func writeWAV(output io.Writer, stream *audio.Stream) error {
+	enc, err := audio.NewWAVEncoder(output, stream.Format)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(enc, stream); err != nil {
+		return err
+	}
+	return enc.Close()
+}
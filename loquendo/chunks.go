@@ -0,0 +1,113 @@
+package loquendo
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TextChunk is a part of a longer text, rendered on its own.
+type TextChunk struct {
+	Text   string // Text is the chunk text
+	Offset int    // Offset is the byte offset of the chunk in the whole text
+}
+
+// SplitChunks splits a text into chunks of at most maxLen bytes, breaking at paragraphs first, then at sentences.
+// Sentences longer than maxLen are split at spaces, or anywhere if they have none. A maxLen of 0 or less returns
+// the text as a single chunk.
+func SplitChunks(text string, maxLen int) []TextChunk {
+	if maxLen <= 0 || len(text) <= maxLen {
+		return []TextChunk{{Text: text}}
+	}
+
+	var chunks []TextChunk
+	start, end := -1, -1
+	flush := func() {
+		if start >= 0 {
+			chunks = append(chunks, TextChunk{Text: text[start:end], Offset: start})
+		}
+		start, end = -1, -1
+	}
+	add := func(span textSpan) {
+		spanEnd := span.offset + len(span.text)
+		if start >= 0 && spanEnd-start > maxLen {
+			flush()
+		}
+		if start < 0 {
+			start = span.offset
+		}
+		end = spanEnd
+	}
+
+	for _, paragraph := range splitParagraphs(text) {
+		for _, sentence := range splitSentences(paragraph.text) {
+			sentence.offset += paragraph.offset
+			for len(sentence.text) > maxLen {
+				cut := splitPoint(sentence.text, maxLen)
+				add(textSpan{text: sentence.text[:cut], offset: sentence.offset})
+				flush()
+				rest := strings.TrimLeft(sentence.text[cut:], " \t")
+				sentence.offset += len(sentence.text) - len(rest)
+				sentence.text = rest
+			}
+			if sentence.text != "" {
+				add(sentence)
+			}
+		}
+		// Paragraphs are never joined, so that their pauses are kept
+		flush()
+	}
+	return chunks
+}
+
+// splitParagraphs splits the text at blank lines.
+func splitParagraphs(text string) []textSpan {
+	var spans []textSpan
+	offset := 0
+	for _, p := range strings.SplitAfter(text, "\n\n") {
+		if s := strings.TrimSpace(p); s != "" {
+			spans = append(spans, textSpan{text: s, offset: offset + strings.Index(p, s)})
+		}
+		offset += len(p)
+	}
+	return spans
+}
+
+// splitPoint returns where to break a text longer than maxLen: after the last space within maxLen, or at the last
+// rune boundary within maxLen if there is none.
+func splitPoint(text string, maxLen int) int {
+	if i := strings.LastIndexAny(text[:maxLen+1], " \t"); i > 0 {
+		return i
+	}
+	cut := maxLen
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return max(cut, 1)
+}
+
+// Append appends the timings of the next chunk of a text, whose audio starts at the given time and whose text
+// starts at the given byte offset.
+func (t *Timings) Append(next Timings, start time.Duration, textOffset int) {
+	sentences := len(t.Sentences)
+	for _, s := range next.Sentences {
+		s.Index += sentences
+		s.TextOffset += textOffset
+		s.Start += start
+		s.End += start
+		t.Sentences = append(t.Sentences, s)
+	}
+	for _, w := range next.Words {
+		w.Sentence += sentences
+		w.TextOffset += textOffset
+		w.Start += start
+		w.End += start
+		t.Words = append(t.Words, w)
+	}
+	for _, b := range next.Bookmarks {
+		b.Time += start
+		t.Bookmarks = append(t.Bookmarks, b)
+	}
+	t.Duration = max(t.Duration, start+next.Duration)
+	t.WordsEstimated = t.WordsEstimated || next.WordsEstimated
+}
@@ -0,0 +1,142 @@
+package loquendo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"loq7tts-server/loquendo/ffi_wrapper"
+	"strings"
+)
+
+// ErrEngineUnavailable is returned by NewEngine on platforms where the Loquendo engine cannot be loaded.
+var ErrEngineUnavailable = errors.New("the Loquendo TTS engine is only available on windows/386")
+
+// EngineError is an error returned by the engine, carrying its result code. Errors from the engine are wrapped with
+// it, and can be matched against the sentinel errors below with errors.Is, according to the call that failed.
+type EngineError = ffi_wrapper.EngineError
+
+var (
+	ErrLicense          = ffi_wrapper.ErrLicense          // ErrLicense is matched by license check failures
+	ErrUnknownVoice     = ffi_wrapper.ErrUnknownVoice     // ErrUnknownVoice is matched when a voice cannot be loaded
+	ErrUnknownLanguage  = ffi_wrapper.ErrUnknownLanguage  // ErrUnknownLanguage is matched when a language cannot be loaded
+	ErrUnknownStyle     = ffi_wrapper.ErrUnknownStyle     // ErrUnknownStyle is matched when a style cannot be loaded
+	ErrInvalidParameter = ffi_wrapper.ErrInvalidParameter // ErrInvalidParameter is matched by rejected parameters
+)
+
+type Voice struct {
+	Id             string `json:"id"`              // Id is the unique voice identifier
+	Description    string `json:"description"`     // Description is the voice mnemonic description
+	Gender         string `json:"gender"`          // Gender is the voice gender
+	Age            int    `json:"age"`             // Age is the voice age
+	NativeLanguage string `json:"native_language"` // NativeLanguage is the voice's native language
+	DemoSentence   string `json:"demo_sentence"`   // DemoSentence is a sample sentence in which the voice introduces itself using its native language
+	BaseSpeed      int    `json:"base_speed"`      // BaseSpeed is the voice default speech in word/minute
+	BasePitch      int    `json:"base_pitch"`      // BasePitch is the voice default pitch in hertz
+}
+
+// Language is a language installed in the engine.
+type Language struct {
+	Id          string `json:"id"`          // Id is the language name, e.g. Italian, used as NativeLanguage by the voices
+	Description string `json:"description"` // Description is the language mnemonic description
+}
+
+// Style is a speaking style installed in the engine.
+type Style struct {
+	Id          string `json:"id"`          // Id is the unique style identifier
+	Description string `json:"description"` // Description is the style mnemonic description
+}
+
+// VoiceFilter selects voices by their attributes. Empty fields match all voices.
+type VoiceFilter struct {
+	Language string // Language matches the native language of the voice
+	Gender   string // Gender matches the voice gender
+}
+
+// IsEmpty tells whether the filter matches all voices.
+func (f VoiceFilter) IsEmpty() bool {
+	return f.Language == "" && f.Gender == ""
+}
+
+// Match tells whether the voice matches the filter. Attributes are compared case-insensitively.
+func (f VoiceFilter) Match(v Voice) bool {
+	return (f.Language == "" || strings.EqualFold(f.Language, v.NativeLanguage)) &&
+		(f.Gender == "" || strings.EqualFold(f.Gender, v.Gender))
+}
+
+// AudioEncoding is the sample encoding of the audio produced by the engine.
+type AudioEncoding int
+
+const (
+	AudioEncodingLinear AudioEncoding = iota // AudioEncodingLinear is 16-bit signed little-endian PCM
+	AudioEncodingALaw                        // AudioEncodingALaw is 8-bit G.711 A-law
+	AudioEncodingULaw                        // AudioEncodingULaw is 8-bit G.711 mu-law
+)
+
+// DefaultSampleRate is the sample rate the engine renders at, unless set with SetAudioSettings.
+const DefaultSampleRate = 32000
+
+// Sample rates supported by SetAudioSettings, in ascending order. Other rates in the range of the lowest and the
+// highest one can be obtained by resampling, see NativeSampleRate.
+var NativeSampleRates = []uint{8000, 11025, 16000, 22050, 24000, 32000, 44100, 48000}
+
+// NativeSampleRate returns the rate to render at in order to obtain the given rate: the rate itself if the engine
+// supports it, otherwise the closest higher supported rate, so that resampling only loses the unneeded bandwidth.
+func NativeSampleRate(rate uint) uint {
+	for _, r := range NativeSampleRates {
+		if r >= rate {
+			return r
+		}
+	}
+	return NativeSampleRates[len(NativeSampleRates)-1]
+}
+
+type SpeechOptions struct {
+	Voice    string `json:"voice"`
+	Language string `json:"language"` // Language is the language to speak, the voice's native language if empty
+	Style    string `json:"style"`    // Style is the speaking style, the voice default if empty
+	Speed    *int32 `json:"speed"`
+}
+
+// Synthesizer is a single text-to-speech session, able to render one prompt at a time.
+type Synthesizer interface {
+	// GetVoices lists the voices installed in the engine.
+	GetVoices() ([]Voice, error)
+	// FindVoices lists the installed voices that match the filter.
+	FindVoices(filter VoiceFilter) ([]Voice, error)
+	// GetLanguages lists the languages installed in the engine.
+	GetLanguages() ([]Language, error)
+	// GetStyles lists the speaking styles installed in the engine.
+	GetStyles() ([]Style, error)
+	// SetParam sets an engine parameter for the following prompts.
+	SetParam(name, value string) error
+	// SetDebugEvents enables logging of the engine events.
+	SetDebugEvents(enabled bool)
+	// SetAudioSettings sets the sample rate and channel layout of the following prompts.
+	SetAudioSettings(sampleRate uint, mono bool)
+	// SetAudioEncoding sets the sample encoding of the following prompts.
+	SetAudioEncoding(encoding AudioEncoding)
+	// SpeakStreaming starts rendering the text and returns a reader for the resulting WAV stream. Rendering is
+	// stopped when the context is cancelled or the reader is closed before the end of the stream.
+	SpeakStreaming(ctx context.Context, text string, options *SpeechOptions) (io.ReadCloser, error)
+	// SpeakEvents is SpeakStreaming, also returning a channel of the engine events of the prompt. The channel is
+	// closed after the end of speech, or when the reader is closed. It is buffered, and events that do not fit are
+	// dropped rather than blocking the engine.
+	SpeakEvents(ctx context.Context, text string, options *SpeechOptions) (io.ReadCloser, <-chan Event, error)
+	// Timings returns the timings of the last prompt. They are complete once its audio stream has been read to
+	// the end.
+	Timings() Timings
+	// Reset discards the parameters and audio settings set on the session, restoring the defaults.
+	Reset() error
+	// Close releases the session.
+	Close() error
+}
+
+// Engine creates Synthesizer sessions.
+type Engine interface {
+	// NewSynthesizer opens a new synthesis session.
+	NewSynthesizer() (Synthesizer, error)
+	// GetVersionInfo returns the engine version string.
+	GetVersionInfo() (string, error)
+	// Close unloads the engine. Sessions must be closed beforehand.
+	Close() error
+}
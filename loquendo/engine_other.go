@@ -0,0 +1,8 @@
+//go:build !windows
+
+package loquendo
+
+// NewEngine always fails on this platform, since the Loquendo engine DLL can only be loaded on Windows.
+func NewEngine(dllPath *string, iniFile *string) (Engine, error) {
+	return nil, ErrEngineUnavailable
+}
@@ -0,0 +1,102 @@
+package loquendo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EventType is the kind of an engine event.
+type EventType int
+
+const (
+	EventAudioStart     EventType = iota // EventAudioStart is sent when the audio starts flowing
+	EventSentence                        // EventSentence is sent at the start of every sentence
+	EventParagraph                       // EventParagraph is sent at the start of every paragraph
+	EventBookmark                        // EventBookmark is sent for the bookmarks embedded in the text
+	EventLanguageChange                  // EventLanguageChange is sent when a tag changes the language
+	EventVoiceChange                     // EventVoiceChange is sent when a tag changes the voice
+	EventError                           // EventError is sent when the engine reports an error while rendering
+	EventEndOfSpeech                     // EventEndOfSpeech is the last event of a prompt
+)
+
+var eventTypeNames = []string{"audio_start", "sentence", "paragraph", "bookmark", "language_change", "voice_change", "error", "end_of_speech"}
+
+func (t EventType) String() string {
+	if t >= 0 && int(t) < len(eventTypeNames) {
+		return eventTypeNames[t]
+	}
+	return fmt.Sprintf("event_%d", int(t))
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Event is an event reported by the engine while rendering a prompt.
+type Event struct {
+	Type EventType     `json:"type"`
+	Time time.Duration `json:"time"` // Time is the position of the event in the audio
+	// Index is the position of the sentence in the prompt, for sentence events
+	Index int `json:"index,omitempty"`
+	// Text is the bookmark name, the new language or voice, the paragraph text or the error message, depending on
+	// the type of the event
+	Text string `json:"text,omitempty"`
+}
+
+// eventBufferSize is the number of events buffered for a slow reader, beyond which events are dropped.
+const eventBufferSize = 256
+
+// eventSink delivers the events of a prompt to its channel. Sending never blocks, since events come from the engine
+// callback thread. A nil sink discards the events.
+type eventSink struct {
+	ch chan Event
+
+	mu        sync.Mutex
+	sentences int
+	dropped   int
+	closed    bool
+}
+
+func newEventSink() *eventSink {
+	return &eventSink{ch: make(chan Event, eventBufferSize)}
+}
+
+func (s *eventSink) emit(e Event) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if e.Type == EventSentence {
+		e.Index = s.sentences
+		s.sentences++
+	}
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped++
+	}
+}
+
+// close closes the channel, once the last event of the prompt has been sent or the prompt was abandoned.
+func (s *eventSink) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.dropped > 0 {
+		log.Warn().Int("dropped", s.dropped).Msg("TTS events dropped, the event channel was not read in time")
+	}
+	close(s.ch)
+}
@@ -0,0 +1,471 @@
+package loquendo
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"loq7tts-server/pkg/audio"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// FakeEngine is an in-process Engine that renders text as a sequence of tones instead of speech. Its output is
+// deterministic and its length depends on the text, which makes it suitable for running the server and the CLI
+// on platforms where the Loquendo engine is not available.
+type FakeEngine struct{}
+
+// FakeTTS is the Synthesizer created by FakeEngine.
+type FakeTTS struct {
+	params      map[string]string
+	sampleRate  uint32
+	channels    uint16
+	encoding    AudioEncoding
+	debugEvents bool
+	closed      bool
+
+	timings timingRecorder
+	speech  *fakeSpeech
+	text    string
+}
+
+var _ Engine = (*FakeEngine)(nil)
+var _ Synthesizer = (*FakeTTS)(nil)
+
+var fakeVoices = []Voice{
+	{
+		Id:             "Roberto",
+		Description:    "Fake Italian male voice",
+		Gender:         "male",
+		Age:            40,
+		NativeLanguage: "Italian",
+		DemoSentence:   "Ciao, sono Roberto, una voce di prova.",
+		BaseSpeed:      160,
+		BasePitch:      110,
+	},
+	{
+		Id:             "Paola",
+		Description:    "Fake Italian female voice",
+		Gender:         "female",
+		Age:            30,
+		NativeLanguage: "Italian",
+		DemoSentence:   "Ciao, sono Paola, una voce di prova.",
+		BaseSpeed:      165,
+		BasePitch:      210,
+	},
+	{
+		Id:             "Simon",
+		Description:    "Fake British English male voice",
+		Gender:         "male",
+		Age:            35,
+		NativeLanguage: "EnglishGb",
+		DemoSentence:   "Hello, I'm Simon, a test voice.",
+		BaseSpeed:      170,
+		BasePitch:      120,
+	},
+	{
+		Id:             "Susan",
+		Description:    "Fake American English female voice",
+		Gender:         "female",
+		Age:            30,
+		NativeLanguage: "EnglishUs",
+		DemoSentence:   "Hello, I'm Susan, a test voice.",
+		BaseSpeed:      170,
+		BasePitch:      220,
+	},
+}
+
+var fakeLanguages = []Language{
+	{Id: "Italian", Description: "Fake Italian language"},
+	{Id: "EnglishGb", Description: "Fake British English language"},
+	{Id: "EnglishUs", Description: "Fake American English language"},
+}
+
+var fakeStyles = []Style{
+	{Id: "Neutral", Description: "Fake neutral style"},
+	{Id: "Expressive", Description: "Fake expressive style"},
+}
+
+// fakeParams are the engine parameters accepted by FakeTTS.SetParam, matched case-insensitively.
+var fakeParams = []string{
+	"MultiSpacePause", "MaxParPause", "ProsodicPauses", "ShortPauseLength", "MediumPauseLength",
+	"LongPauseLength", "SpellingLevel", "SpellPunctuation", "TaggedText", "TextFormat", "DefaultNumberType",
+	"AutoGuess", "LanguageSetForGuesser",
+}
+
+func NewFakeEngine() *FakeEngine {
+	return &FakeEngine{}
+}
+
+func (e *FakeEngine) NewSynthesizer() (Synthesizer, error) {
+	metricSessions.Inc()
+	return &FakeTTS{
+		params:     make(map[string]string),
+		sampleRate: DefaultSampleRate,
+		channels:   1,
+	}, nil
+}
+
+func (e *FakeEngine) GetVersionInfo() (string, error) {
+	return "Fake TTS engine (in-process tone generator)", nil
+}
+
+func (e *FakeEngine) Close() error {
+	return nil
+}
+
+func (t *FakeTTS) GetVoices() ([]Voice, error) {
+	voices := make([]Voice, len(fakeVoices))
+	copy(voices, fakeVoices)
+	return voices, nil
+}
+
+func (t *FakeTTS) FindVoices(filter VoiceFilter) ([]Voice, error) {
+	var voices []Voice
+	for _, v := range fakeVoices {
+		if filter.Match(v) {
+			voices = append(voices, v)
+		}
+	}
+	return voices, nil
+}
+
+func (t *FakeTTS) GetLanguages() ([]Language, error) {
+	languages := make([]Language, len(fakeLanguages))
+	copy(languages, fakeLanguages)
+	return languages, nil
+}
+
+func (t *FakeTTS) GetStyles() ([]Style, error) {
+	styles := make([]Style, len(fakeStyles))
+	copy(styles, fakeStyles)
+	return styles, nil
+}
+
+func (t *FakeTTS) SetParam(name, value string) error {
+	for _, p := range fakeParams {
+		if strings.EqualFold(p, name) {
+			t.params[p] = value
+			return nil
+		}
+	}
+	err := fmt.Errorf("error setting TTS parameter %q: %w", name, ErrInvalidParameter)
+	observeEngineError("SetParam", err)
+	return err
+}
+
+func (t *FakeTTS) SetDebugEvents(enabled bool) {
+	t.debugEvents = enabled
+}
+
+func (t *FakeTTS) SetAudioSettings(sampleRate uint, mono bool) {
+	t.sampleRate = uint32(sampleRate)
+	if mono {
+		t.channels = 1
+	} else {
+		t.channels = 2
+	}
+}
+
+func (t *FakeTTS) SetAudioEncoding(encoding AudioEncoding) {
+	t.encoding = encoding
+}
+
+func (t *FakeTTS) Reset() error {
+	t.params = make(map[string]string)
+	t.sampleRate = DefaultSampleRate
+	t.channels = 1
+	t.encoding = AudioEncodingLinear
+	t.debugEvents = false
+	t.timings.reset()
+	t.speech = nil
+	t.text = ""
+	return nil
+}
+
+func (t *FakeTTS) Close() error {
+	if !t.closed {
+		metricSessions.Dec()
+	}
+	t.closed = true
+	return nil
+}
+
+func (t *FakeTTS) SpeakStreaming(ctx context.Context, text string, options *SpeechOptions) (io.ReadCloser, error) {
+	stream, err := t.speakStreaming(ctx, text, options, nil)
+	observeEngineError("SpeakStreaming", err)
+	return stream, err
+}
+
+func (t *FakeTTS) SpeakEvents(ctx context.Context, text string, options *SpeechOptions) (io.ReadCloser, <-chan Event, error) {
+	events := newEventSink()
+	stream, err := t.speakStreaming(ctx, text, options, events)
+	observeEngineError("SpeakStreaming", err)
+	if err != nil {
+		events.close()
+		return nil, nil, err
+	}
+	return stream, events.ch, nil
+}
+
+func (t *FakeTTS) speakStreaming(ctx context.Context, text string, options *SpeechOptions, events *eventSink) (io.ReadCloser, error) {
+	if t.closed {
+		return nil, errors.New("session closed")
+	}
+
+	voice := fakeVoices[0]
+	var speed int32 = 50
+	if options != nil {
+		found := false
+		for _, v := range fakeVoices {
+			if v.Id == options.Voice {
+				voice = v
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("error loading persona %q: %w", options.Voice, ErrUnknownVoice)
+		}
+		// Any installed language can be spoken by any voice, as with the multilingual Loquendo voices
+		if options.Language != "" && !slices.ContainsFunc(fakeLanguages, func(l Language) bool { return l.Id == options.Language }) {
+			return nil, fmt.Errorf("error loading persona %q with language %q: %w", options.Voice, options.Language, ErrUnknownLanguage)
+		}
+		if options.Style != "" && !slices.ContainsFunc(fakeStyles, func(s Style) bool { return s.Id == options.Style }) {
+			return nil, fmt.Errorf("error loading persona %q with style %q: %w", options.Voice, options.Style, ErrUnknownStyle)
+		}
+		if options.Speed != nil {
+			speed = *options.Speed
+		}
+	}
+	if speed < 0 || speed > 100 {
+		return nil, fmt.Errorf("error setting speed %d: %w", speed, ErrInvalidParameter)
+	}
+
+	t.timings.reset()
+	t.text = text
+	t.speech = newFakeSpeech(ctx, text, voice, speed, t.sampleRate, t.channels, t.encoding, &t.timings)
+	t.speech.events = events
+	return t.speech, nil
+}
+
+func (t *FakeTTS) Timings() Timings {
+	if t.speech == nil {
+		return (&timingRecorder{}).build("", 0, t.sampleRate)
+	}
+	return t.timings.build(t.text, t.speech.samples, t.speech.sampleRate)
+}
+
+// fakeSegment is a tone of the given frequency, or silence if freq is 0.
+type fakeSegment struct {
+	freq    float64
+	samples int
+}
+
+type fakeSpeech struct {
+	ctx        context.Context // ctx stops the rendering when cancelled
+	pending    []byte
+	segments   []fakeSegment
+	sampleRate uint32
+	channels   uint16
+	encoding   AudioEncoding
+	samples    int64
+	metrics    *promptMetrics // metrics is nil once the speech is closed
+
+	// events receives the marks as the audio they occur at is rendered, nil if not requested
+	events   *eventSink
+	marks    []fakeMark
+	rendered int64
+	started  bool
+}
+
+// fakeMark is an event of the layout, at the given sample.
+type fakeMark struct {
+	sample int64
+	event  Event
+}
+
+// newFakeSpeech lays out one tone per word, with short gaps between words and longer pauses after
+// punctuation. Speed 50 is the normal rate; every 25 points double or halve the duration. The timing marks of
+// the layout are added to the recorder. Paragraphs start at blank lines.
+func newFakeSpeech(ctx context.Context, text string, voice Voice, speed int32, sampleRate uint32, channels uint16, encoding AudioEncoding, timings *timingRecorder) *fakeSpeech {
+	stretch := math.Pow(2, float64(50-speed)/25)
+	ms := func(d float64) int {
+		return int(d * stretch * float64(sampleRate) / 1000)
+	}
+
+	var segments []fakeSegment
+	var marks []fakeMark
+	position := int64(0)
+	sentenceStart := true
+	wordEnd := 0
+	for i, word := range splitWords(text) {
+		if i == 0 || strings.Contains(text[wordEnd:word.offset], "\n\n") {
+			marks = append(marks, fakeMark{sample: position, event: Event{Type: EventParagraph}})
+		}
+		wordEnd = word.offset + len(word.text)
+		letters := 0
+		for _, r := range word.text {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				letters++
+			}
+		}
+		if sentenceStart {
+			timings.add(timingMark{kind: markSentence, sample: position})
+			marks = append(marks, fakeMark{sample: position, event: Event{Type: EventSentence}})
+			sentenceStart = false
+		}
+		if letters > 0 {
+			freq := float64(voice.BasePitch) * (1 + float64(i%5)/8)
+			segment := fakeSegment{freq: freq, samples: ms(float64(40 * letters))}
+			segments = append(segments, segment)
+			timings.add(timingMark{
+				kind:       markWord,
+				sample:     position,
+				endSample:  position + int64(segment.samples),
+				text:       word.text,
+				textOffset: word.offset,
+			})
+			position += int64(segment.samples)
+		}
+		var pause fakeSegment
+		switch word.text[len(word.text)-1] {
+		case '.', '!', '?':
+			pause = fakeSegment{samples: ms(400)}
+			sentenceStart = true
+		case ';', ':':
+			pause = fakeSegment{samples: ms(400)}
+		case ',':
+			pause = fakeSegment{samples: ms(150)}
+		default:
+			pause = fakeSegment{samples: ms(60)}
+		}
+		segments = append(segments, pause)
+		position += int64(pause.samples)
+	}
+
+	s := &fakeSpeech{
+		ctx:        ctx,
+		segments:   segments,
+		sampleRate: sampleRate,
+		channels:   channels,
+		encoding:   encoding,
+		samples:    position,
+		metrics:    startPrompt(),
+		marks:      marks,
+	}
+	s.pending = audio.WAVHeader(s.format(), uint32(int(position)*s.frameSize()))
+	return s
+}
+
+func (s *fakeSpeech) sampleSize() int {
+	if s.encoding == AudioEncodingLinear {
+		return 2
+	}
+	return 1
+}
+
+func (s *fakeSpeech) frameSize() int {
+	return int(s.channels) * s.sampleSize()
+}
+
+func (s *fakeSpeech) format() audio.Format {
+	format := audio.Format{
+		Encoding:      audio.EncodingPCM,
+		Channels:      s.channels,
+		SampleRate:    s.sampleRate,
+		BitsPerSample: uint16(s.sampleSize() * 8),
+	}
+	switch s.encoding {
+	case AudioEncodingALaw:
+		format.Encoding = audio.EncodingALaw
+	case AudioEncodingULaw:
+		format.Encoding = audio.EncodingULaw
+	}
+	return format
+}
+
+// render generates the samples of a segment, with a short fade at both ends to avoid clicks.
+func (s *fakeSpeech) render(seg fakeSegment) []byte {
+	frameSize := s.frameSize()
+	out := make([]byte, seg.samples*frameSize)
+	fade := int(s.sampleRate) / 200
+	for i := 0; i < seg.samples; i++ {
+		var v int16
+		if seg.freq != 0 {
+			gain := 0.3
+			if i < fade {
+				gain *= float64(i) / float64(fade)
+			} else if seg.samples-i < fade {
+				gain *= float64(seg.samples-i) / float64(fade)
+			}
+			v = int16(gain * math.MaxInt16 * math.Sin(2*math.Pi*seg.freq*float64(i)/float64(s.sampleRate)))
+		}
+		for c := 0; c < int(s.channels); c++ {
+			switch s.encoding {
+			case AudioEncodingALaw:
+				out[i*frameSize+c] = audio.EncodeALaw(v)
+			case AudioEncodingULaw:
+				out[i*frameSize+c] = audio.EncodeULaw(v)
+			default:
+				binary.LittleEndian.PutUint16(out[i*frameSize+c*2:], uint16(v))
+			}
+		}
+	}
+	return out
+}
+
+// emitMarks sends the events of the marks up to the given sample.
+func (s *fakeSpeech) emitMarks(sample int64) {
+	if s.events == nil {
+		return
+	}
+	if !s.started {
+		s.events.emit(Event{Type: EventAudioStart})
+		s.started = true
+	}
+	for len(s.marks) > 0 && s.marks[0].sample <= sample {
+		event := s.marks[0].event
+		event.Time = samplesDuration(s.marks[0].sample, s.sampleRate)
+		s.events.emit(event)
+		s.marks = s.marks[1:]
+	}
+}
+
+func (s *fakeSpeech) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if len(s.segments) == 0 {
+			if s.events != nil {
+				s.emitMarks(s.samples)
+				s.events.emit(Event{Type: EventEndOfSpeech, Time: samplesDuration(s.samples, s.sampleRate)})
+				s.events.close()
+			}
+			return 0, io.EOF
+		}
+		if err := s.ctx.Err(); err != nil {
+			s.segments = nil
+			return 0, err
+		}
+		s.emitMarks(s.rendered)
+		s.pending = s.render(s.segments[0])
+		s.rendered += int64(s.segments[0].samples)
+		s.segments = s.segments[1:]
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *fakeSpeech) Close() error {
+	s.segments = nil
+	s.pending = nil
+	s.events.close()
+	if s.metrics != nil {
+		s.metrics.end()
+		s.metrics = nil
+	}
+	return nil
+}
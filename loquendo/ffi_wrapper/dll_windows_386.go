@@ -85,6 +85,13 @@ type TTSLibrary struct {
 	*/
 	ttsRead *windows.Proc
 
+	/*
+		ttsResultType tts_API_DEFINITION ttsStop(
+		    ttsHandleType hReader
+		);
+	*/
+	ttsStop *windows.Proc
+
 	/*
 		ttsResultType tts_API_DEFINITION ttsSetCallback(
 		    ttsHandleType hReader,
@@ -226,6 +233,9 @@ func LoadEngineDLL(dllPath string) (*TTSLibrary, error) {
 	if lib.ttsRead, err = mustProc("ttsRead"); err != nil {
 		return nil, err
 	}
+	if lib.ttsStop, err = mustProc("ttsStop"); err != nil {
+		return nil, err
+	}
 	if lib.ttsSetCallback, err = mustProc("ttsSetCallback"); err != nil {
 		return nil, err
 	}
@@ -253,7 +263,6 @@ func LoadEngineDLL(dllPath string) (*TTSLibrary, error) {
 	if lib.ttsGetVersionInfo, err = mustProc("ttsGetVersionInfo"); err != nil {
 		return nil, err
 	}
-
 	return lib, nil
 }
 
@@ -0,0 +1,47 @@
+package ffi_wrapper
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TTSResult is the result code returned by the engine API calls.
+type TTSResult int32
+
+const TTSOk TTSResult = 0
+
+// Sentinel errors for common engine failures, matched by EngineError with errors.Is.
+var (
+	ErrLicense          = errors.New("tts license error")
+	ErrUnknownVoice     = errors.New("tts unknown voice")
+	ErrUnknownLanguage  = errors.New("tts unknown language")
+	ErrUnknownStyle     = errors.New("tts unknown style")
+	ErrInvalidParameter = errors.New("tts invalid parameter")
+	ErrBufferTooSmall   = errors.New("tts result buffer too small")
+)
+
+// EngineError is an error returned by an engine API call.
+type EngineError struct {
+	Code    TTSResult // Code is the result code returned by the call
+	Message string    // Message is the description of the code from ttsGetErrorMessage
+	Call    string    // Call is the name of the API function that failed
+
+	// Condition is the sentinel error matched by the failure, if known. The engine does not document its result
+	// codes, so the condition is told from the call that failed, by the wrappers and their callers.
+	Condition error
+}
+
+func (e *EngineError) Error() string {
+	return fmt.Sprintf("tts library error in %s (%d): %s", e.Call, e.Code, e.Message)
+}
+
+// Is reports whether the error is an instance of one of the sentinel errors, from its condition.
+func (e *EngineError) Is(target error) bool {
+	if target == ErrLicense {
+		// The calls that check the license also fail on missing files and settings, which only the message tells
+		// apart
+		return (e.Call == "ttsNewSession" || e.Call == "ttsLoadPersona") && strings.Contains(strings.ToLower(e.Message), "licen")
+	}
+	return e.Condition != nil && e.Condition == target
+}
@@ -75,8 +75,7 @@ func TTSDescribeEvent(eventType TTSEventType, iData uintptr) string {
 		return GetTTSEventDesc(eventType)
 	case TTSEventText, TTSEventBookmark, TTSEventTag, TTSEventAudio, TTSEventLanguageChange, TTSEventError, TTSEventParagraph, TTSEventTextEncoding, TTSEventStyleChange:
 		// iData is a pointer to a null-terminated string
-		str := windows.BytePtrToString((*byte)(unsafe.Pointer(iData)))
-		return fmt.Sprintf("%s: '%q'", GetTTSEventDesc(eventType), str)
+		return fmt.Sprintf("%s: '%q'", GetTTSEventDesc(eventType), TTSEventString(iData))
 	case TTSEventSentence:
 		// iData is an int
 		return fmt.Sprintf("%s: %d", GetTTSEventDesc(eventType), iData)
@@ -85,3 +84,13 @@ func TTSDescribeEvent(eventType TTSEventType, iData uintptr) string {
 		return fmt.Sprintf("%s: iData=0x%08X", GetTTSEventDesc(eventType), iData)
 	}
 }
+
+// TTSEventString returns the string payload of the events whose iData is a pointer to a null-terminated string.
+func TTSEventString(iData uintptr) string {
+	if iData == 0 {
+		return ""
+	}
+	// The string is owned by the engine, outside of the Go heap, and copied before the callback returns
+	//goland:noinspection GoVetUnsafePointer
+	return windows.BytePtrToString((*byte)(unsafe.Pointer(iData)))
+}
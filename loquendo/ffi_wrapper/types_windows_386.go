@@ -4,7 +4,6 @@ package ffi_wrapper
 
 type (
 	TTSHandle               uintptr
-	TTSResult               int32
 	TTSBool                 uint8
 	TTSAudioEncodingType    uint32
 	TTSAudioSampleType      uint32
@@ -14,9 +13,8 @@ type (
 )
 
 const (
-	TTSOk    TTSResult = 0
-	TTSFalse TTSBool   = 0
-	TTSTrue  TTSBool   = 1
+	TTSFalse TTSBool = 0
+	TTSTrue  TTSBool = 1
 )
 
 const (
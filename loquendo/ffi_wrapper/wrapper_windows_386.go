@@ -3,6 +3,7 @@
 package ffi_wrapper
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
@@ -22,11 +23,20 @@ func (l *TTSLibrary) TTSGetErrorMessage(code TTSResult) string {
 	return windows.BytePtrToString((*byte)(unsafe.Pointer(result)))
 }
 
-func (l *TTSLibrary) wrapErr(rc TTSResult) error {
+// wrapErr returns an *EngineError for the result of the named call, or nil if it succeeded.
+func (l *TTSLibrary) wrapErr(call string, rc TTSResult) error {
 	if rc == TTSOk {
 		return nil
 	}
-	return fmt.Errorf("tts library error: %s", l.TTSGetErrorMessage(rc))
+	return &EngineError{Code: rc, Message: l.TTSGetErrorMessage(rc), Call: call}
+}
+
+// wrapErrAs is wrapErr for a failure known to match the sentinel error condition.
+func (l *TTSLibrary) wrapErrAs(call string, rc TTSResult, condition error) error {
+	if rc == TTSOk {
+		return nil
+	}
+	return &EngineError{Code: rc, Message: l.TTSGetErrorMessage(rc), Call: call, Condition: condition}
 }
 
 func (l *TTSLibrary) TTSNewSession(iniFile *string) (TTSHandle, error) {
@@ -37,7 +47,7 @@ func (l *TTSLibrary) TTSNewSession(iniFile *string) (TTSHandle, error) {
 			uintptr(unsafe.Pointer(&handle)),
 			0,
 		)
-		return handle, l.wrapErr(TTSResult(rc))
+		return handle, l.wrapErr("ttsNewSession", TTSResult(rc))
 	}
 
 	iniFilePtr, err := windows.BytePtrFromString(*iniFile)
@@ -48,12 +58,12 @@ func (l *TTSLibrary) TTSNewSession(iniFile *string) (TTSHandle, error) {
 		uintptr(unsafe.Pointer(&handle)),
 		uintptr(unsafe.Pointer(iniFilePtr)),
 	)
-	return handle, l.wrapErr(TTSResult(rc))
+	return handle, l.wrapErr("ttsNewSession", TTSResult(rc))
 }
 
 func (l *TTSLibrary) TTSDeleteSession(session TTSHandle) error {
 	rc, _, _ := l.executor.CallProc(l.ttsDeleteSession, uintptr(session))
-	return l.wrapErr(TTSResult(rc))
+	return l.wrapErr("ttsDeleteSession", TTSResult(rc))
 }
 
 func (l *TTSLibrary) TTSNewReader(session TTSHandle) (TTSHandle, error) {
@@ -62,18 +72,19 @@ func (l *TTSLibrary) TTSNewReader(session TTSHandle) (TTSHandle, error) {
 		uintptr(unsafe.Pointer(&handle)),
 		uintptr(session),
 	)
-	return handle, l.wrapErr(TTSResult(rc))
+	return handle, l.wrapErr("ttsNewReader", TTSResult(rc))
 }
 
 func (l *TTSLibrary) TTSDeleteReader(reader TTSHandle) error {
 	rc, _, _ := l.executor.CallProc(l.ttsDeleteReader, uintptr(reader))
-	return l.wrapErr(TTSResult(rc))
+	return l.wrapErr("ttsDeleteReader", TTSResult(rc))
 }
 
-func (l *TTSLibrary) TTSLoadPersona(reader TTSHandle, voice string, language *string) error {
+func (l *TTSLibrary) TTSLoadPersona(reader TTSHandle, voice string, language *string, style *string) error {
 	var (
 		voicePtr    uintptr = 0
 		languagePtr uintptr = 0
+		stylePtr    uintptr = 0
 	)
 	vp, err := windows.BytePtrFromString(voice)
 	if err != nil {
@@ -87,13 +98,20 @@ func (l *TTSLibrary) TTSLoadPersona(reader TTSHandle, voice string, language *st
 		}
 		languagePtr = uintptr(unsafe.Pointer(lp))
 	}
+	if style != nil {
+		sp, err := windows.BytePtrFromString(*style)
+		if err != nil {
+			return err
+		}
+		stylePtr = uintptr(unsafe.Pointer(sp))
+	}
 	rc, _, _ := l.executor.CallProc(l.ttsLoadPersona,
 		uintptr(reader),
 		voicePtr,
 		languagePtr,
-		0, // style parameter is reserved and should be NULL according to the documentation
+		stylePtr,
 	)
-	return l.wrapErr(TTSResult(rc))
+	return l.wrapErr("ttsLoadPersona", TTSResult(rc))
 }
 
 func (l *TTSLibrary) TTSSetAudio(reader TTSHandle, destName *string, deviceName *string, sampleRate uint32, encoding TTSAudioEncodingType, sampleType TTSAudioSampleType, userptr uintptr) error {
@@ -124,7 +142,7 @@ func (l *TTSLibrary) TTSSetAudio(reader TTSHandle, destName *string, deviceName
 		uintptr(sampleType),
 		userptr,
 	)
-	return l.wrapErr(TTSResult(rc))
+	return l.wrapErr("ttsSetAudio", TTSResult(rc))
 }
 
 func (l *TTSLibrary) TTSRead(reader TTSHandle, input string, async bool, fromFile bool) (promptId uint32, err error) {
@@ -140,7 +158,13 @@ func (l *TTSLibrary) TTSRead(reader TTSHandle, input string, async bool, fromFil
 		uintptr(ToTTSBool(fromFile)),
 		uintptr(unsafe.Pointer(&promptIdOut)),
 	)
-	return promptIdOut, l.wrapErr(TTSResult(rc))
+	return promptIdOut, l.wrapErr("ttsRead", TTSResult(rc))
+}
+
+// TTSStop stops the prompt being rendered by the reader. The engine sends the end of speech event once stopped.
+func (l *TTSLibrary) TTSStop(reader TTSHandle) error {
+	rc, _, _ := l.executor.CallProc(l.ttsStop, uintptr(reader))
+	return l.wrapErr("ttsStop", TTSResult(rc))
 }
 
 func (l *TTSLibrary) TTSSetCallback(reader TTSHandle, callback TTSCallbackFunctionType, userptr uintptr) error {
@@ -151,7 +175,7 @@ func (l *TTSLibrary) TTSSetCallback(reader TTSHandle, callback TTSCallbackFuncti
 		userptr,
 		0, // = TTSCALLBACKFUNCTION
 	)
-	return l.wrapErr(TTSResult(rc))
+	return l.wrapErr("ttsSetCallback", TTSResult(rc))
 }
 
 func (l *TTSLibrary) TTSSetSpeed(reader TTSHandle, speed int32) error {
@@ -159,9 +183,11 @@ func (l *TTSLibrary) TTSSetSpeed(reader TTSHandle, speed int32) error {
 		uintptr(reader),
 		uintptr(speed),
 	)
-	return l.wrapErr(TTSResult(rc))
+	return l.wrapErrAs("ttsSetSpeed", TTSResult(rc), ErrInvalidParameter)
 }
 
+// TTSQuery writes the null-terminated result of the query into the buffer, which must be zeroed. The error matches
+// ErrBufferTooSmall when the result may have been truncated.
 func (l *TTSLibrary) TTSQuery(session TTSHandle, queryType TTSQueryType, dataToRetrieve string, filter *string, resultBuffer *[]byte, loadedOnly bool, rescanFileSystem bool) error {
 	if resultBuffer == nil || len(*resultBuffer) == 0 {
 		return errors.New("resultBuffer must be a non-empty byte slice")
@@ -189,10 +215,12 @@ func (l *TTSLibrary) TTSQuery(session TTSHandle, queryType TTSQueryType, dataToR
 		uintptr(ToTTSBool(loadedOnly)),
 		uintptr(ToTTSBool(rescanFileSystem)),
 	)
-	if err := l.wrapErr(TTSResult(rc)); err != nil {
-		return err
+	// A result that does not fit fills the buffer up to its last byte
+	var condition error
+	if i := bytes.IndexByte(*resultBuffer, 0); i < 0 || i >= len(*resultBuffer)-1 {
+		condition = ErrBufferTooSmall
 	}
-	return nil
+	return l.wrapErrAs("ttsQuery", TTSResult(rc), condition)
 }
 
 func (l *TTSLibrary) TTSSetParam(readerOrSession TTSHandle, name, value string) error {
@@ -209,7 +237,7 @@ func (l *TTSLibrary) TTSSetParam(readerOrSession TTSHandle, name, value string)
 		uintptr(unsafe.Pointer(namePtr)),
 		uintptr(unsafe.Pointer(valuePtr)),
 	)
-	return l.wrapErr(TTSResult(rc))
+	return l.wrapErrAs("ttsSetParam", TTSResult(rc), ErrInvalidParameter)
 }
 
 func (l *TTSLibrary) TTSGetPCM(object TTSHandle) (buffer []byte, complete bool, err error) {
@@ -222,7 +250,7 @@ func (l *TTSLibrary) TTSGetPCM(object TTSHandle) (buffer []byte, complete bool,
 		uintptr(unsafe.Pointer(&numSamplesOut)),
 		uintptr(unsafe.Pointer(&completeOut)),
 	)
-	if err := l.wrapErr(TTSResult(rc)); err != nil {
+	if err := l.wrapErr("ttsGetPCM", TTSResult(rc)); err != nil {
 		return nil, false, err
 	}
 	buffer = unsafe.Slice((*byte)(unsafe.Pointer(bufferPtr)), numSamplesOut)
@@ -232,7 +260,7 @@ func (l *TTSLibrary) TTSGetPCM(object TTSHandle) (buffer []byte, complete bool,
 func (l *TTSLibrary) TTSGetVersionInfo() (string, error) {
 	var buf [512]byte
 	rc, _, _ := l.executor.CallProc(l.ttsGetVersionInfo, uintptr(unsafe.Pointer(&buf[0])))
-	if err := l.wrapErr(TTSResult(rc)); err != nil {
+	if err := l.wrapErr("ttsGetVersionInfo", TTSResult(rc)); err != nil {
 		return "", err
 	}
 	return windows.BytePtrToString(&buf[0]), nil
@@ -244,7 +272,7 @@ func (l *TTSLibrary) TTSSetTextEncodingUTF8(reader TTSHandle) error {
 		uintptr(reader),
 		uintptr(65001), // TTSUTF8 = 65001
 	)
-	return l.wrapErr(TTSResult(rc))
+	return l.wrapErr("ttsSetTextEncoding", TTSResult(rc))
 }
 
 func (l *TTSLibrary) TTSEnableEvent(reader TTSHandle, eventType TTSEventType, enabled bool) error {
@@ -253,7 +281,7 @@ func (l *TTSLibrary) TTSEnableEvent(reader TTSHandle, eventType TTSEventType, en
 		uintptr(eventType),
 		uintptr(ToTTSBool(enabled)),
 	)
-	return l.wrapErr(TTSResult(rc))
+	return l.wrapErr("ttsEnableEvent", TTSResult(rc))
 }
 
 func findEngineLibPathFromRegistry() (string, error) {
@@ -4,14 +4,20 @@ package loquendo
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"loq7tts-server/loquendo/ffi_wrapper"
 	"math/rand"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 	"unsafe"
 
 	"github.com/rs/zerolog/log"
@@ -30,24 +36,30 @@ type TTS struct {
 	currentPromptID uint32
 	speechChannel   chan<- []byte
 	pipe            *npipe.PipeListener
+	// speechEnded is closed when the engine reports the end of the current prompt
+	speechEnded chan struct{}
 
 	channels   ffi_wrapper.TTSAudioSampleType
 	sampleRate uint32
+	encoding   ffi_wrapper.TTSAudioEncodingType
 
 	debugEvents bool
-}
 
-type Voice struct {
-	Id             string `json:"id"`              // Id is the unique voice identifier
-	Description    string `json:"description"`     // Description is the voice mnemonic description
-	Gender         string `json:"gender"`          // Gender is the voice gender
-	Age            int    `json:"age"`             // Age is the voice age
-	NativeLanguage string `json:"native_language"` // NativeLanguage is the voice's native language
-	DemoSentence   string `json:"demo_sentence"`   // DemoSentence is a sample sentence in which the voice introduces itself using its native language
-	BaseSpeed      int    `json:"base_speed"`      // BaseSpeed is the voice default speech in word/minute
-	BasePitch      int    `json:"base_pitch"`      // BasePitch is the voice default pitch in hertz
+	// renderedBytes counts the audio bytes the engine reported with data events for the current prompt, to locate
+	// the other events in the audio
+	renderedBytes atomic.Int64
+	timings       timingRecorder
+	text          string
+	// wordOffset is the offset in text past the last word reported by the engine
+	wordOffset int
+	// events receives the events of the current prompt, if started with SpeakEvents
+	events atomic.Pointer[eventSink]
 }
 
+// stopTimeout is how long closing a stream waits for a stopped prompt to end. Sessions whose prompt does not end
+// cannot be reset, and are discarded by the pool.
+const stopTimeout = 5 * time.Second
+
 func InitEngineDLL(dllPath *string) (err error) {
 	if ttsLib != nil {
 		return errors.New("library DLL already initialized")
@@ -58,7 +70,7 @@ func InitEngineDLL(dllPath *string) (err error) {
 	} else {
 		path, err = ffi_wrapper.GetDefaultEngineLibPath()
 		if err != nil {
-			return fmt.Errorf("error finding engine DLL path: %v", err)
+			return fmt.Errorf("error finding engine DLL path: %w", err)
 		}
 	}
 	log.Debug().Str("path", path).Msg("loading engine DLL")
@@ -78,10 +90,49 @@ func GetVersionInfo() (string, error) {
 	return ttsLib.TTSGetVersionInfo()
 }
 
+// LoquendoEngine is the Engine backed by the Loquendo TTS engine DLL.
+type LoquendoEngine struct {
+	iniFile *string
+}
+
+var _ Synthesizer = (*TTS)(nil)
+
+// NewEngine loads the engine DLL, if not loaded already. Sessions created by the engine use the given
+// configuration file, or the default one if nil.
+func NewEngine(dllPath *string, iniFile *string) (Engine, error) {
+	if ttsLib == nil {
+		if err := InitEngineDLL(dllPath); err != nil {
+			return nil, fmt.Errorf("error initializing TTS library: %w", err)
+		}
+	}
+	return &LoquendoEngine{iniFile: iniFile}, nil
+}
+
+func (e *LoquendoEngine) NewSynthesizer() (Synthesizer, error) {
+	tts, err := NewTTS(e.iniFile)
+	if err != nil {
+		return nil, err
+	}
+	return tts, nil
+}
+
+func (e *LoquendoEngine) GetVersionInfo() (string, error) {
+	return GetVersionInfo()
+}
+
+func (e *LoquendoEngine) Close() error {
+	if ttsLib == nil {
+		return nil
+	}
+	err := ttsLib.Close()
+	ttsLib = nil
+	return err
+}
+
 func NewTTS(iniFile *string) (*TTS, error) {
 	if ttsLib == nil {
 		if err := InitEngineDLL(nil); err != nil {
-			return nil, fmt.Errorf("error initializing TTS library: %v", err)
+			return nil, fmt.Errorf("error initializing TTS library: %w", err)
 		}
 	}
 	if ttsLib == nil {
@@ -90,65 +141,105 @@ func NewTTS(iniFile *string) (*TTS, error) {
 
 	session, err := ttsLib.TTSNewSession(iniFile)
 	if err != nil {
-		return nil, fmt.Errorf("error creating TTS session: %v", err)
-	}
-
-	reader, err := ttsLib.TTSNewReader(session)
-	if err != nil {
-		_ = ttsLib.TTSDeleteSession(session)
-		return nil, fmt.Errorf("error creating TTS reader: %v", err)
+		observeEngineError("NewTTS", err)
+		return nil, fmt.Errorf("error creating TTS session: %w", err)
 	}
+	metricSessions.Inc()
 
 	res := &TTS{
-		phReader:        reader,
 		hSession:        session,
 		currentPromptID: 0,
 		speechChannel:   nil,
 		channels:        1,
-		sampleRate:      32000,
+		sampleRate:      DefaultSampleRate,
+		encoding:        ffi_wrapper.TTSAudioEncTypeLinear,
 	}
 
-	if err = ttsLib.TTSEnableEvent(reader, ffi_wrapper.TTSEventData, true); err != nil {
+	if err = res.newReader(); err != nil {
+		observeEngineError("NewTTS", err)
 		_ = res.Close()
-		return nil, fmt.Errorf("error enabling TTS data events: %v", err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// newReader creates the reader for the session and applies the default reader settings.
+func (t *TTS) newReader() error {
+	reader, err := ttsLib.TTSNewReader(t.hSession)
+	if err != nil {
+		return fmt.Errorf("error creating TTS reader: %w", err)
+	}
+	t.phReader = reader
+
+	if err = ttsLib.TTSEnableEvent(reader, ffi_wrapper.TTSEventData, true); err != nil {
+		return fmt.Errorf("error enabling TTS data events: %w", err)
+	}
+
+	if err = ttsLib.TTSEnableEvent(reader, ffi_wrapper.TTSEventText, true); err != nil {
+		return fmt.Errorf("error enabling TTS text events: %w", err)
 	}
 
 	if err = ttsLib.TTSEnableEvent(reader, ffi_wrapper.TTSEventFreeSpace, false); err != nil {
-		_ = res.Close()
-		return nil, fmt.Errorf("error disabling TTS free space events: %v", err)
+		return fmt.Errorf("error disabling TTS free space events: %w", err)
 	}
 
-	if err = ttsLib.TTSSetTextEncodingUTF8(res.phReader); err != nil {
-		_ = res.Close()
-		return nil, fmt.Errorf("error setting text encoding: %v", err)
+	if err = ttsLib.TTSSetTextEncodingUTF8(reader); err != nil {
+		return fmt.Errorf("error setting text encoding: %w", err)
 	}
 
-	if err = ttsLib.TTSSetCallback(reader, ttsCallbackWrapper, uintptr(unsafe.Pointer(res))); err != nil {
-		_ = res.Close()
-		return nil, fmt.Errorf("error setting TTS callback: %v", err)
+	if err = ttsLib.TTSSetCallback(reader, ttsCallbackWrapper, uintptr(unsafe.Pointer(t))); err != nil {
+		return fmt.Errorf("error setting TTS callback: %w", err)
 	}
 
 	// Disable \@Key=Val tag parsing by default
 	if err = ttsLib.TTSSetParam(reader, "TaggedText", "FALSE"); err != nil {
-		_ = res.Close()
-		return nil, fmt.Errorf("error setting TTS tagged text parameter: %v", err)
+		return fmt.Errorf("error setting TTS tagged text parameter: %w", err)
 	}
 
-	return res, nil
+	return nil
+}
+
+// Reset recreates the reader, discarding all the parameters set on it, and restores the default audio settings.
+// The session, which is the expensive part to set up, is kept.
+func (t *TTS) Reset() error {
+	if t.currentPromptID != 0 {
+		return errors.New("cannot reset while speaking")
+	}
+	if t.phReader != 0 {
+		if err := ttsLib.TTSDeleteReader(t.phReader); err != nil {
+			return fmt.Errorf("error tearing down TTS reader: %w", err)
+		}
+		t.phReader = 0
+	}
+	t.channels = ffi_wrapper.TTSAudioSampleTypeMono
+	t.sampleRate = DefaultSampleRate
+	t.encoding = ffi_wrapper.TTSAudioEncTypeLinear
+	t.debugEvents = false
+	t.timings.reset()
+	t.text = ""
+	t.renderedBytes.Store(0)
+	t.wordOffset = 0
+	t.speechEnded = nil
+	err := t.newReader()
+	observeEngineError("Reset", err)
+	return err
 }
 
 func (t *TTS) Close() error {
 	if t.phReader != 0 {
 		if err := ttsLib.TTSDeleteReader(t.phReader); err != nil {
-			return fmt.Errorf("error tearing down TTS reader: %v", err)
+			return fmt.Errorf("error tearing down TTS reader: %w", err)
 		}
 		t.phReader = 0
 	}
 	if t.hSession != 0 {
 		if err := ttsLib.TTSDeleteSession(t.hSession); err != nil {
-			return fmt.Errorf("error tearing down TTS session: %v", err)
+			observeEngineError("Close", err)
+			return fmt.Errorf("error tearing down TTS session: %w", err)
 		}
 		t.hSession = 0
+		metricSessions.Dec()
 	}
 	return nil
 }
@@ -166,6 +257,17 @@ func (t *TTS) SetAudioSettings(sampleRate uint, mono bool) {
 	t.sampleRate = uint32(sampleRate)
 }
 
+func (t *TTS) SetAudioEncoding(encoding AudioEncoding) {
+	switch encoding {
+	case AudioEncodingALaw:
+		t.encoding = ffi_wrapper.TTSAudioEncTypeALAW
+	case AudioEncodingULaw:
+		t.encoding = ffi_wrapper.TTSAudioEncTypeULAW
+	default:
+		t.encoding = ffi_wrapper.TTSAudioEncTypeLinear
+	}
+}
+
 func fixStringEncoding(input string) (string, error) {
 	inputBytes := []byte(input)
 	e, _, _ := charset.DetermineEncoding(inputBytes, "")
@@ -177,42 +279,110 @@ func fixStringEncoding(input string) (string, error) {
 	return string(decoded), nil
 }
 
-func (t *TTS) GetVoices() ([]Voice, error) {
-	outBuf := make([]byte, 2048)
-	err := ttsLib.TTSQuery(t.hSession, ffi_wrapper.TTSQueryObjectVoice, "Id,Description,Gender,Age,MotherTongue,BaseSpeed,BasePitch,DemoSentence", nil, &outBuf, false, false)
+// Sizes of the query result buffer. A result that fills the buffer may have been truncated, so the query is run
+// again with a buffer twice as large, up to the maximum.
+const (
+	queryBufferSize    = 4096
+	maxQueryBufferSize = 1 << 20
+)
+
+// query runs a query on the session and returns its records, made of the requested fields, the first of which must
+// be the identifier. The identifiers are queried on their own first, so that the records can be told apart from the
+// separators in the free text of the last field.
+func (t *TTS) query(object ffi_wrapper.TTSQueryType, fields []string, filter *string) ([][]string, error) {
+	idRecords, err := t.queryResult(object, []string{fields[0]}, filter, nil)
+	if err != nil || len(fields) == 1 {
+		return idRecords, err
+	}
+	ids := make(map[string]bool, len(idRecords))
+	for _, r := range idRecords {
+		ids[r[0]] = true
+	}
+	records, err := t.queryResult(object, fields, filter, ids)
 	if err != nil {
-		return nil, fmt.Errorf("error querying voices: %v", err)
+		return nil, err
 	}
-	// Truncate at the null terminator, if any
-	if i := bytes.IndexByte(outBuf, 0); i >= 0 {
-		outBuf = outBuf[:i]
+	if len(records) != len(ids) {
+		return nil, fmt.Errorf("malformed query result: %d records for %d identifiers", len(records), len(ids))
 	}
-	outStr := string(outBuf)
-	lines := strings.Split(outStr, ";")
+	return records, nil
+}
 
-	voices := make([]Voice, len(lines))
-	for i, line := range lines {
-		parts := strings.Split(line, ",")
+// queryResult runs a query with a buffer large enough for the whole result, and parses it.
+func (t *TTS) queryResult(object ffi_wrapper.TTSQueryType, fields []string, filter *string, ids map[string]bool) ([][]string, error) {
+	for size := queryBufferSize; ; size *= 2 {
+		outBuf := make([]byte, size)
+		err := ttsLib.TTSQuery(t.hSession, object, strings.Join(fields, ","), filter, &outBuf, false, false)
+		if err != nil && !errors.Is(err, ffi_wrapper.ErrBufferTooSmall) {
+			return nil, err
+		}
+		// The result is complete if its null terminator comes before the last byte of the buffer
+		if i := bytes.IndexByte(outBuf, 0); err == nil && i >= 0 && i < size-1 {
+			return parseQueryResult(string(outBuf[:i]), len(fields), ids)
+		}
+		if size >= maxQueryBufferSize {
+			return nil, fmt.Errorf("query result larger than %d bytes", maxQueryBufferSize)
+		}
+		log.Debug().Int("size", size).Msg("Query result truncated, retrying with a larger buffer")
+	}
+}
+
+// voiceFilter builds the query filter of a voice filter, nil if it matches all voices.
+func voiceFilter(filter VoiceFilter) *string {
+	var conditions []string
+	if filter.Language != "" {
+		conditions = append(conditions, "MotherTongue="+filter.Language)
+	}
+	if filter.Gender != "" {
+		conditions = append(conditions, "Gender="+filter.Gender)
+	}
+	if len(conditions) == 0 {
+		return nil
+	}
+	s := strings.Join(conditions, ";")
+	return &s
+}
+
+func (t *TTS) GetVoices() ([]Voice, error) {
+	return t.FindVoices(VoiceFilter{})
+}
 
+func (t *TTS) FindVoices(filter VoiceFilter) ([]Voice, error) {
+	// Descriptions and demo sentences are free text, and each must be the last field of its query
+	records, err := t.query(ffi_wrapper.TTSQueryObjectVoice, []string{"Id", "Gender", "Age", "MotherTongue", "BaseSpeed", "BasePitch", "Description"}, voiceFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("error querying voices: %w", err)
+	}
+	demoRecords, err := t.query(ffi_wrapper.TTSQueryObjectVoice, []string{"Id", "DemoSentence"}, voiceFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("error querying voice demo sentences: %w", err)
+	}
+	demoSentences := make(map[string]string, len(demoRecords))
+	for _, parts := range demoRecords {
+		demoSentences[parts[0]] = parts[1]
+	}
+
+	voices := make([]Voice, len(records))
+	for i, parts := range records {
 		id := parts[0]
-		description := parts[1]
-		gender := parts[2]
-		age, err := strconv.Atoi(parts[3])
+		gender := parts[1]
+		age, err := strconv.Atoi(parts[2])
 		if err != nil {
-			return nil, fmt.Errorf("error parsing voice age: %v", err)
+			return nil, fmt.Errorf("error parsing age of voice %s: %w", id, err)
 		}
-		motherTongue := parts[4]
-		baseSpeed, err := strconv.Atoi(parts[5])
+		motherTongue := parts[3]
+		baseSpeed, err := strconv.Atoi(parts[4])
 		if err != nil {
-			return nil, fmt.Errorf("error parsing voice base speed: %v", err)
+			return nil, fmt.Errorf("error parsing base speed of voice %s: %w", id, err)
 		}
-		basePitch, err := strconv.Atoi(parts[6])
+		basePitch, err := strconv.Atoi(parts[5])
 		if err != nil {
-			return nil, fmt.Errorf("error parsing voice base pitch: %v", err)
+			return nil, fmt.Errorf("error parsing base pitch of voice %s: %w", id, err)
 		}
-		demoSentence, err := fixStringEncoding(strings.Join(parts[7:], ","))
+		description := parts[6]
+		demoSentence, err := fixStringEncoding(demoSentences[id])
 		if err != nil {
-			return nil, fmt.Errorf("error parsing voice demo sentence: %v", err)
+			return nil, fmt.Errorf("error parsing demo sentence of voice %s: %w", id, err)
 		}
 
 		voices[i] = Voice{
@@ -229,10 +399,35 @@ func (t *TTS) GetVoices() ([]Voice, error) {
 	return voices, nil
 }
 
+func (t *TTS) GetLanguages() ([]Language, error) {
+	records, err := t.query(ffi_wrapper.TTSQueryObjectLanguage, []string{"Id", "Description"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error querying languages: %w", err)
+	}
+	languages := make([]Language, len(records))
+	for i, parts := range records {
+		languages[i] = Language{Id: parts[0], Description: parts[1]}
+	}
+	return languages, nil
+}
+
+func (t *TTS) GetStyles() ([]Style, error) {
+	records, err := t.query(ffi_wrapper.TTSQueryObjectStyle, []string{"Id", "Description"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error querying styles: %w", err)
+	}
+	styles := make([]Style, len(records))
+	for i, parts := range records {
+		styles[i] = Style{Id: parts[0], Description: parts[1]}
+	}
+	return styles, nil
+}
+
 func (t *TTS) SetParam(name, value string) error {
 	err := ttsLib.TTSSetParam(t.phReader, name, value)
 	if err != nil {
-		return fmt.Errorf("error setting TTS parameter: %v", err)
+		observeEngineError("SetParam", err)
+		return fmt.Errorf("error setting TTS parameter: %w", err)
 	}
 	return nil
 }
@@ -251,50 +446,176 @@ func (t *TTS) ttsCallback(promptID uint32, eventType ffi_wrapper.TTSEventType, i
 	if t.debugEvents {
 		log.Debug().Uint32("promptID", promptID).Str("event", ffi_wrapper.TTSDescribeEvent(eventType, iData)).Msg("tts callback")
 	}
-	if eventType == ffi_wrapper.TTSEventEndOfSpeech {
+	events := t.events.Load()
+	sample := t.currentSample()
+	event := Event{Time: samplesDuration(sample, t.sampleRate)}
+	switch eventType {
+	case ffi_wrapper.TTSEventData:
+		// iData is the size in bytes of the audio rendered since the previous data event
+		t.renderedBytes.Add(int64(iData))
+	case ffi_wrapper.TTSEventText:
+		t.addWord(sample, ffi_wrapper.TTSEventString(iData))
+	case ffi_wrapper.TTSEventAudioStart:
+		event.Type = EventAudioStart
+		events.emit(event)
+	case ffi_wrapper.TTSEventSentence:
+		t.timings.add(timingMark{kind: markSentence, sample: sample})
+		event.Type = EventSentence
+		events.emit(event)
+	case ffi_wrapper.TTSEventParagraph:
+		event.Type, event.Text = EventParagraph, ffi_wrapper.TTSEventString(iData)
+		events.emit(event)
+	case ffi_wrapper.TTSEventBookmark:
+		event.Type, event.Text = EventBookmark, ffi_wrapper.TTSEventString(iData)
+		t.timings.add(timingMark{kind: markBookmark, sample: sample, text: event.Text})
+		events.emit(event)
+	case ffi_wrapper.TTSEventLanguageChange:
+		event.Type, event.Text = EventLanguageChange, ffi_wrapper.TTSEventString(iData)
+		events.emit(event)
+	case ffi_wrapper.TTSEventVoiceChange:
+		event.Type, event.Text = EventVoiceChange, ffi_wrapper.TTSEventString(iData)
+		events.emit(event)
+	case ffi_wrapper.TTSEventError:
+		event.Type, event.Text = EventError, ffi_wrapper.TTSEventString(iData)
+		events.emit(event)
+	case ffi_wrapper.TTSEventEndOfSpeech:
+		event.Type = EventEndOfSpeech
+		events.emit(event)
+		events.close()
 		t.currentPromptID = 0
+		if t.speechEnded != nil {
+			select {
+			case <-t.speechEnded:
+			default:
+				close(t.speechEnded)
+			}
+		}
 	}
 }
 
-type SpeechOptions struct {
-	Voice string `json:"voice"`
-	Speed *int32 `json:"speed"`
+// currentSample returns the position in samples of the audio rendered so far, which is the position of the event
+// being handled, since the engine reports the audio it renders before the events that follow it.
+func (t *TTS) currentSample() int64 {
+	frameSize := int64(t.channels)
+	if t.encoding == ffi_wrapper.TTSAudioEncTypeLinear {
+		frameSize *= 2
+	}
+	return t.renderedBytes.Load() / frameSize
 }
 
-func (t *TTS) SpeakStreaming(text string, options *SpeechOptions) (io.ReadCloser, error) {
+// addWord records a word mark for the text the engine reports it starts parsing. Only single words are recorded,
+// located in the prompt text after the previous one, since the engine may also report larger chunks of text.
+func (t *TTS) addWord(sample int64, word string) {
+	word = strings.TrimSpace(word)
+	if word == "" || strings.IndexFunc(word, unicode.IsSpace) >= 0 {
+		return
+	}
+	i := strings.Index(t.text[t.wordOffset:], word)
+	if i < 0 {
+		return
+	}
+	offset := t.wordOffset + i
+	t.wordOffset = offset + len(word)
+	t.timings.add(timingMark{kind: markWord, sample: sample, endSample: -1, text: word, textOffset: offset})
+}
+
+func (t *TTS) Timings() Timings {
+	return t.timings.build(t.text, t.currentSample(), t.sampleRate)
+}
+
+func (t *TTS) SpeakStreaming(ctx context.Context, text string, options *SpeechOptions) (io.ReadCloser, error) {
+	stream, err := t.speakStreaming(ctx, text, options, nil)
+	observeEngineError("SpeakStreaming", err)
+	return stream, err
+}
+
+func (t *TTS) SpeakEvents(ctx context.Context, text string, options *SpeechOptions) (io.ReadCloser, <-chan Event, error) {
+	events := newEventSink()
+	stream, err := t.speakStreaming(ctx, text, options, events)
+	observeEngineError("SpeakStreaming", err)
+	if err != nil {
+		events.close()
+		return nil, nil, err
+	}
+	return stream, events.ch, nil
+}
+
+// loadPersona loads the voice, language and style of the options. When the engine rejects them, the voice is loaded
+// alone, then with the language, to tell which one is unknown.
+func (t *TTS) loadPersona(options *SpeechOptions) error {
+	var language, style *string
+	if options.Language != "" {
+		language = &options.Language
+	}
+	if options.Style != "" {
+		style = &options.Style
+	}
+	err := ttsLib.TTSLoadPersona(t.phReader, options.Voice, language, style)
+	var engineErr *EngineError
+	if err == nil || !errors.As(err, &engineErr) || errors.Is(err, ErrLicense) {
+		return err
+	}
+	switch {
+	case ttsLib.TTSLoadPersona(t.phReader, options.Voice, nil, nil) != nil:
+		engineErr.Condition = ErrUnknownVoice
+	case language != nil && (style == nil || ttsLib.TTSLoadPersona(t.phReader, options.Voice, language, nil) != nil):
+		engineErr.Condition = ErrUnknownLanguage
+	case style != nil:
+		engineErr.Condition = ErrUnknownStyle
+	}
+	return err
+}
+
+func (t *TTS) speakStreaming(ctx context.Context, text string, options *SpeechOptions, events *eventSink) (io.ReadCloser, error) {
 	var err error
 
 	if t.currentPromptID != 0 {
 		return nil, errors.New("already speaking")
 	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	t.timings.reset()
+	t.text = text
+	t.renderedBytes.Store(0)
+	t.wordOffset = 0
 
 	// The .wav extension is important, otherwise the engine will write raw PCM data without a header
 	randInt := rand.Int()
 	pipeName := fmt.Sprintf(`\\.\pipe\loq7tts_pipe_%d_%d_%d.wav`, os.Getpid(), t.currentPromptID, randInt)
 	if t.pipe, err = npipe.Listen(pipeName); err != nil {
-		return nil, fmt.Errorf("error creating WAV data named pipe: %v", err)
+		return nil, fmt.Errorf("error creating WAV data named pipe: %w", err)
 	}
 
-	if err = ttsLib.TTSSetAudio(t.phReader, new("LTTS7AudioFile"), &pipeName, t.sampleRate, ffi_wrapper.TTSAudioEncTypeLinear, t.channels, 0); err != nil {
-		return nil, fmt.Errorf("error setting audio output: %v", err)
+	if err = ttsLib.TTSSetAudio(t.phReader, new("LTTS7AudioFile"), &pipeName, t.sampleRate, t.encoding, t.channels, 0); err != nil {
+		_ = t.pipe.Close()
+		return nil, fmt.Errorf("error setting audio output: %w", err)
 	}
 
 	if options != nil {
-		if err = ttsLib.TTSLoadPersona(t.phReader, options.Voice, nil); err != nil {
-			return nil, fmt.Errorf("error loading persona: %v", err)
+		if err = t.loadPersona(options); err != nil {
+			_ = t.pipe.Close()
+			return nil, fmt.Errorf("error loading persona: %w", err)
 		}
 		var speed int32 = 50
 		if options.Speed != nil {
 			speed = *options.Speed
 		}
 		if err = ttsLib.TTSSetSpeed(t.phReader, speed); err != nil {
-			return nil, fmt.Errorf("error setting speed: %v", err)
+			_ = t.pipe.Close()
+			return nil, fmt.Errorf("error setting speed: %w", err)
 		}
 	}
 
+	ended := make(chan struct{})
+	t.speechEnded = ended
+	t.events.Store(events)
 	promptId, err := ttsLib.TTSRead(t.phReader, text, true, false)
 	if err != nil {
-		return nil, fmt.Errorf("error starting TTS read: %v", err)
+		t.events.Store(nil)
+		_ = t.pipe.Close()
+		return nil, fmt.Errorf("error starting TTS read: %w", err)
 	}
 	t.currentPromptID = promptId
 
@@ -303,5 +624,63 @@ func (t *TTS) SpeakStreaming(text string, options *SpeechOptions) (io.ReadCloser
 		log.Panic().Err(err).Msg("error accepting connection on pipe")
 	}
 
-	return conn, nil
+	stream := &pipeStream{Conn: conn, listener: t.pipe, reader: t.phReader, ended: ended, events: events, metrics: startPrompt()}
+	stream.stopWatch = context.AfterFunc(ctx, func() {
+		log.Debug().Uint32("promptID", promptId).Msg("context done, stopping TTS prompt")
+		_ = stream.Close()
+	})
+	return stream, nil
+}
+
+// pipeStream closes the named pipe listener along with the connection, since sessions are reused for many prompts.
+// It also stops the prompt if closed before the end of the audio.
+type pipeStream struct {
+	net.Conn
+	listener *npipe.PipeListener
+
+	reader    ffi_wrapper.TTSHandle
+	ended     <-chan struct{}
+	events    *eventSink
+	stopWatch func() bool
+	eof       atomic.Bool
+	metrics   *promptMetrics
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (p *pipeStream) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	if err == io.EOF {
+		p.eof.Store(true)
+	}
+	return n, err
+}
+
+func (p *pipeStream) Close() error {
+	p.closeOnce.Do(func() {
+		p.stopWatch()
+		if !p.eof.Load() {
+			select {
+			case <-p.ended:
+			default:
+				// Stop the engine before closing the pipe, so that it does not keep rendering into a broken pipe
+				if err := ttsLib.TTSStop(p.reader); err != nil {
+					log.Warn().Err(err).Msg("error stopping TTS prompt")
+				}
+			}
+		}
+		p.closeErr = p.Conn.Close()
+		if err := p.listener.Close(); p.closeErr == nil {
+			p.closeErr = err
+		}
+		select {
+		case <-p.ended:
+		case <-time.After(stopTimeout):
+			log.Warn().Msg("TTS prompt did not end in time after the stream was closed")
+		}
+		p.events.close()
+		p.metrics.end()
+	})
+	return p.closeErr
 }
@@ -0,0 +1,62 @@
+package loquendo
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Engine metrics, registered with the default Prometheus registry.
+var (
+	metricSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "loqtts_engine_sessions",
+		Help: "Number of open TTS engine sessions.",
+	})
+	metricSessionsSpeaking = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "loqtts_engine_sessions_speaking",
+		Help: "Number of TTS engine sessions rendering a prompt.",
+	})
+	metricRenderSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "loqtts_engine_render_seconds",
+		Help:    "Time from the start of a prompt to the end of its audio stream.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+	metricEngineErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loqtts_engine_errors_total",
+		Help: "Number of failed TTS engine calls, by API call and result code.",
+	}, []string{"call", "code"})
+)
+
+// observeEngineError counts an error of an engine operation. Errors that do not come from the engine API are
+// counted with the operation name as call and an empty code, and cancellations are not counted.
+func observeEngineError(operation string, err error) {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	var engineErr *EngineError
+	if errors.As(err, &engineErr) {
+		metricEngineErrors.WithLabelValues(engineErr.Call, strconv.Itoa(int(engineErr.Code))).Inc()
+		return
+	}
+	metricEngineErrors.WithLabelValues(operation, "").Inc()
+}
+
+// promptMetrics tracks a prompt being rendered, from SpeakStreaming to the end of its stream.
+type promptMetrics struct {
+	start time.Time
+}
+
+func startPrompt() *promptMetrics {
+	metricSessionsSpeaking.Inc()
+	return &promptMetrics{start: time.Now()}
+}
+
+// end records the prompt duration. It must be called once.
+func (m *promptMetrics) end() {
+	metricSessionsSpeaking.Dec()
+	metricRenderSeconds.Observe(time.Since(m.start).Seconds())
+}
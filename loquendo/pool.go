@@ -0,0 +1,434 @@
+package loquendo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrPoolClosed is returned by Pool.Get after the pool has been closed.
+var ErrPoolClosed = errors.New("synthesizer pool closed")
+
+type PoolOptions struct {
+	MinSize             int           // MinSize is the number of sessions kept warm even when idle
+	MaxSize             int           // MaxSize is the maximum number of sessions, idle or borrowed
+	IdleTimeout         time.Duration // IdleTimeout is how long a session above MinSize may stay idle before being closed
+	HealthCheckInterval time.Duration // HealthCheckInterval is how often idle sessions are checked, 0 to disable
+	DebugEvents         bool          // DebugEvents enables engine event logging on every session
+}
+
+type PoolStats struct {
+	Size                int           `json:"size"`                  // Size is the number of open sessions
+	Idle                int           `json:"idle"`                  // Idle is the number of sessions ready to be borrowed
+	InUse               int           `json:"in_use"`                // InUse is the number of borrowed sessions
+	MaxSize             int           `json:"max_size"`              // MaxSize is the configured maximum number of sessions
+	Utilization         float64       `json:"utilization"`           // Utilization is InUse / MaxSize
+	Borrows             uint64        `json:"borrows"`               // Borrows is the total number of successful borrows
+	Waits               uint64        `json:"waits"`                 // Waits is the number of borrows that had to wait for a free session
+	TotalWait           time.Duration `json:"total_wait_ns"`         // TotalWait is the time spent waiting by all borrows
+	MaxWait             time.Duration `json:"max_wait_ns"`           // MaxWait is the longest time a borrow had to wait
+	Created             uint64        `json:"created"`               // Created is the number of sessions opened
+	Destroyed           uint64        `json:"destroyed"`             // Destroyed is the number of sessions closed
+	HealthCheckFailures uint64        `json:"health_check_failures"` // HealthCheckFailures is the number of sessions discarded by health checks
+}
+
+type pooledSynthesizer struct {
+	synth       Synthesizer
+	lastUsed    time.Time
+	lastChecked time.Time
+}
+
+// Pool keeps a set of warm Synthesizer sessions to be borrowed by concurrent users. Sessions are reset before
+// being handed out again, so parameters set by a borrower never leak into the next one.
+type Pool struct {
+	engine Engine
+	opts   PoolOptions
+
+	// slots holds one token per borrowed (or being created) session
+	slots chan struct{}
+	stop  chan struct{}
+	wg    sync.WaitGroup
+
+	mu        sync.Mutex
+	idle      []*pooledSynthesizer
+	borrowed  map[Synthesizer]*pooledSynthesizer
+	voices    []Voice
+	languages []Language
+	styles    []Style
+	closed    bool
+	stats     PoolStats
+}
+
+func NewPool(engine Engine, opts PoolOptions) (*Pool, error) {
+	if opts.MaxSize < 1 {
+		return nil, fmt.Errorf("invalid pool max size %d", opts.MaxSize)
+	}
+	if opts.MinSize < 0 || opts.MinSize > opts.MaxSize {
+		return nil, fmt.Errorf("invalid pool min size %d (max size is %d)", opts.MinSize, opts.MaxSize)
+	}
+
+	p := &Pool{
+		engine:   engine,
+		opts:     opts,
+		slots:    make(chan struct{}, opts.MaxSize),
+		stop:     make(chan struct{}),
+		borrowed: make(map[Synthesizer]*pooledSynthesizer),
+	}
+	p.stats.MaxSize = opts.MaxSize
+
+	// Open at least one session to make sure the engine works, and cache the voices, languages and styles
+	warm := max(opts.MinSize, 1)
+	for i := 0; i < warm; i++ {
+		ps, err := p.open()
+		if err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+		if i == 0 {
+			if err := p.cacheInventory(ps.synth); err != nil {
+				_ = ps.synth.Close()
+				_ = p.Close()
+				return nil, err
+			}
+		}
+		p.idle = append(p.idle, ps)
+	}
+
+	if opts.IdleTimeout > 0 || opts.HealthCheckInterval > 0 {
+		p.wg.Add(1)
+		go p.maintain()
+	}
+
+	return p, nil
+}
+
+// cacheInventory lists the voices, languages and styles installed in the engine.
+func (p *Pool) cacheInventory(synth Synthesizer) error {
+	var err error
+	if p.voices, err = synth.GetVoices(); err != nil {
+		return err
+	}
+	if p.languages, err = synth.GetLanguages(); err != nil {
+		return err
+	}
+	p.styles, err = synth.GetStyles()
+	return err
+}
+
+// Voices returns the voices installed in the engine, as listed when the pool was created.
+func (p *Pool) Voices() []Voice {
+	return p.voices
+}
+
+// Languages returns the languages installed in the engine, as listed when the pool was created.
+func (p *Pool) Languages() []Language {
+	return p.languages
+}
+
+// Styles returns the speaking styles installed in the engine, as listed when the pool was created.
+func (p *Pool) Styles() []Style {
+	return p.styles
+}
+
+func (p *Pool) open() (*pooledSynthesizer, error) {
+	synth, err := p.engine.NewSynthesizer()
+	if err != nil {
+		return nil, err
+	}
+	synth.SetDebugEvents(p.opts.DebugEvents)
+	now := time.Now()
+
+	p.mu.Lock()
+	p.stats.Created++
+	p.mu.Unlock()
+
+	return &pooledSynthesizer{synth: synth, lastUsed: now, lastChecked: now}, nil
+}
+
+func (p *Pool) destroy(ps *pooledSynthesizer) {
+	if err := ps.synth.Close(); err != nil {
+		log.Warn().Err(err).Msg("error closing pooled TTS session")
+	}
+	p.mu.Lock()
+	p.stats.Destroyed++
+	p.mu.Unlock()
+}
+
+// Get borrows a session, waiting for one to be returned if the pool is at its maximum size. The session must be
+// handed back with Put, or with Discard if it is no longer usable.
+func (p *Pool) Get(ctx context.Context) (Synthesizer, error) {
+	start := time.Now()
+	waited := false
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		waited = true
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.stop:
+			return nil, ErrPoolClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return p.borrow(time.Since(start), waited)
+}
+
+// TryGet borrows a session only if it does not have to wait for one, that is, if fewer than MaxSize sessions are
+// borrowed. It returns nil otherwise.
+func (p *Pool) TryGet() Synthesizer {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return nil
+	}
+	synth, err := p.borrow(0, false)
+	if err != nil {
+		log.Debug().Err(err).Msg("error borrowing TTS session")
+		return nil
+	}
+	return synth
+}
+
+// borrow takes an idle session, or opens a new one, once a slot has been acquired.
+func (p *Pool) borrow(wait time.Duration, waited bool) (Synthesizer, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+	var ps *pooledSynthesizer
+	if n := len(p.idle); n > 0 {
+		ps = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	if ps == nil {
+		var err error
+		if ps, err = p.open(); err != nil {
+			<-p.slots
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	p.borrowed[ps.synth] = ps
+	p.stats.Borrows++
+	if waited {
+		p.stats.Waits++
+	}
+	p.stats.TotalWait += wait
+	p.stats.MaxWait = max(p.stats.MaxWait, wait)
+	p.mu.Unlock()
+
+	log.Debug().Dur("wait", wait).Float64("utilization", p.Stats().Utilization).Msg("borrowed TTS session from pool")
+	return ps.synth, nil
+}
+
+// Put resets a borrowed session and returns it to the pool.
+func (p *Pool) Put(synth Synthesizer) {
+	p.mu.Lock()
+	ps, ok := p.borrowed[synth]
+	delete(p.borrowed, synth)
+	p.mu.Unlock()
+	if !ok {
+		log.Panic().Msg("returned TTS session does not belong to the pool")
+	}
+	defer func() { <-p.slots }()
+
+	if err := synth.Reset(); err != nil {
+		log.Warn().Err(err).Msg("error resetting TTS session, discarding it")
+		p.destroy(ps)
+		return
+	}
+	synth.SetDebugEvents(p.opts.DebugEvents)
+	ps.lastUsed = time.Now()
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.destroy(ps)
+		return
+	}
+	p.idle = append(p.idle, ps)
+	p.mu.Unlock()
+}
+
+// Discard closes a borrowed session instead of returning it to the pool.
+func (p *Pool) Discard(synth Synthesizer) {
+	p.mu.Lock()
+	ps, ok := p.borrowed[synth]
+	delete(p.borrowed, synth)
+	p.mu.Unlock()
+	if !ok {
+		log.Panic().Msg("discarded TTS session does not belong to the pool")
+	}
+	p.destroy(ps)
+	<-p.slots
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Idle = len(p.idle)
+	stats.InUse = len(p.borrowed)
+	stats.Size = stats.Idle + stats.InUse
+	stats.Utilization = float64(stats.InUse) / float64(stats.MaxSize)
+	return stats
+}
+
+// maintain periodically closes sessions idle for too long and health-checks the remaining ones.
+func (p *Pool) maintain() {
+	defer p.wg.Done()
+
+	interval := time.Minute
+	for _, d := range []time.Duration{p.opts.IdleTimeout, p.opts.HealthCheckInterval} {
+		if d > 0 {
+			interval = min(interval, max(d/2, time.Second))
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.evictIdle()
+			p.checkIdle()
+		}
+	}
+}
+
+func (p *Pool) evictIdle() {
+	if p.opts.IdleTimeout <= 0 {
+		return
+	}
+	var evicted []*pooledSynthesizer
+
+	p.mu.Lock()
+	keep := p.idle[:0]
+	size := len(p.idle) + len(p.borrowed)
+	// Oldest sessions are at the bottom of the stack
+	for _, ps := range p.idle {
+		if size > p.opts.MinSize && time.Since(ps.lastUsed) > p.opts.IdleTimeout {
+			evicted = append(evicted, ps)
+			size--
+		} else {
+			keep = append(keep, ps)
+		}
+	}
+	p.idle = keep
+	p.mu.Unlock()
+
+	for _, ps := range evicted {
+		log.Debug().Msg("closing idle TTS session")
+		p.destroy(ps)
+	}
+}
+
+func (p *Pool) checkIdle() {
+	if p.opts.HealthCheckInterval <= 0 {
+		return
+	}
+	for {
+		// Only check sessions when there's a free slot, so that checks never push the pool above its max size
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return
+		}
+
+		var ps *pooledSynthesizer
+		p.mu.Lock()
+		for i, candidate := range p.idle {
+			if time.Since(candidate.lastChecked) > p.opts.HealthCheckInterval {
+				ps = candidate
+				p.idle = append(p.idle[:i], p.idle[i+1:]...)
+				break
+			}
+		}
+		p.mu.Unlock()
+
+		if ps == nil {
+			<-p.slots
+			return
+		}
+
+		if _, err := ps.synth.GetVoices(); err != nil {
+			log.Warn().Err(err).Msg("TTS session failed health check, discarding it")
+			p.mu.Lock()
+			p.stats.HealthCheckFailures++
+			p.mu.Unlock()
+			p.destroy(ps)
+		} else {
+			ps.lastChecked = time.Now()
+			p.mu.Lock()
+			if p.closed {
+				// Close has already taken the idle sessions, so this one would never be closed
+				p.mu.Unlock()
+				p.destroy(ps)
+			} else {
+				// Put it back at its position in the LRU order, before the first session used after it
+				i := slices.IndexFunc(p.idle, func(other *pooledSynthesizer) bool { return other.lastUsed.After(ps.lastUsed) })
+				if i < 0 {
+					i = len(p.idle)
+				}
+				p.idle = slices.Insert(p.idle, i, ps)
+				p.mu.Unlock()
+			}
+		}
+		<-p.slots
+	}
+}
+
+// Close closes all idle sessions and stops the pool. Borrowed sessions are closed when they are returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.stop)
+	p.wg.Wait()
+
+	for _, ps := range idle {
+		p.destroy(ps)
+	}
+	return nil
+}
+
+// Drain waits until all borrowed sessions have been handed back, or the context is done. Once the pool is closed,
+// returned sessions are closed, so after Drain no session of the pool is left open.
+func (p *Pool) Drain(ctx context.Context) error {
+	acquired := 0
+	defer func() {
+		for ; acquired > 0; acquired-- {
+			<-p.slots
+		}
+	}()
+	// Every borrowed session holds a slot until it is handed back
+	for acquired < p.opts.MaxSize {
+		select {
+		case p.slots <- struct{}{}:
+			acquired++
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
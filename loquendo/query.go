@@ -0,0 +1,154 @@
+package loquendo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Engine query results are records separated by ';', made of fields separated by ','. The engine does not escape
+// the separators, so free text fields, such as descriptions and demo sentences, may contain them: queries must ask
+// for the identifier first and for at most one such field, as the last one. Fields between double quotes, with ""
+// for a quote, are also accepted.
+
+// parseQueryResult splits a query result into records of the given number of fields. The last field of a record
+// extends to the next ';' that is followed by the start of a record, or to the end of the result. A record starts
+// with one of the given identifiers, which must be known beforehand for the free text to be told apart from the
+// records, followed by all its fields but the last. With nil identifiers, any well-formed start is accepted, which
+// is only safe for results without free text.
+func parseQueryResult(result string, fields int, ids map[string]bool) ([][]string, error) {
+	if fields < 1 {
+		return nil, errors.New("query without fields")
+	}
+	t := queryTokenizer{s: result, fields: fields, ids: ids}
+	var records [][]string
+	for t.pos < len(t.s) {
+		record, err := t.record()
+		if err != nil {
+			return nil, fmt.Errorf("malformed query result, record %d: %w", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+type queryTokenizer struct {
+	s      string
+	pos    int
+	fields int
+	ids    map[string]bool // ids are the identifiers records start with, any if nil
+}
+
+// record reads the record at the current position, and moves past its terminating ';'.
+func (t *queryTokenizer) record() ([]string, error) {
+	record := make([]string, 0, t.fields)
+	for len(record) < t.fields-1 {
+		field, next, sep, err := t.field(t.pos)
+		if err != nil {
+			return nil, err
+		}
+		if sep != ',' {
+			return nil, fmt.Errorf("expected %d fields, got %d", t.fields, len(record)+1)
+		}
+		if len(record) == 0 && t.ids != nil && !t.ids[field] {
+			return nil, fmt.Errorf("unknown identifier %q", field)
+		}
+		record = append(record, field)
+		t.pos = next
+	}
+
+	if t.pos < len(t.s) && t.s[t.pos] == '"' {
+		field, next, sep, err := t.field(t.pos)
+		if err != nil {
+			return nil, err
+		}
+		if t.fields == 1 && t.ids != nil && !t.ids[field] {
+			return nil, fmt.Errorf("unknown identifier %q", field)
+		}
+		if sep == ',' {
+			return nil, fmt.Errorf("expected %d fields, got more", t.fields)
+		}
+		t.pos = next
+		return append(record, field), nil
+	}
+
+	// An unquoted last field may contain separators, so it only ends at a ';' followed by another record
+	end := t.pos
+	for {
+		i := strings.IndexByte(t.s[end:], ';')
+		if i < 0 {
+			end = len(t.s)
+			break
+		}
+		end += i
+		if t.startsRecord(end + 1) {
+			break
+		}
+		end++
+	}
+	if t.fields == 1 && t.ids != nil && !t.ids[t.s[t.pos:end]] {
+		return nil, fmt.Errorf("unknown identifier %q", t.s[t.pos:end])
+	}
+	record = append(record, t.s[t.pos:end])
+	t.pos = min(end+1, len(t.s))
+	return record, nil
+}
+
+// startsRecord tells whether a record, or the end of the result, starts at pos, that is, whether it is followed by
+// a known identifier and all the fields of a record but the last one.
+func (t *queryTokenizer) startsRecord(pos int) bool {
+	if pos >= len(t.s) {
+		return true
+	}
+	if t.fields == 1 {
+		if t.ids == nil {
+			return true
+		}
+		field, _, sep, err := t.field(pos)
+		return err == nil && sep != ',' && t.ids[field]
+	}
+	for n := 0; n < t.fields-1; n++ {
+		field, next, sep, err := t.field(pos)
+		if err != nil || sep != ',' || (n == 0 && t.ids != nil && !t.ids[field]) {
+			return false
+		}
+		pos = next
+	}
+	return true
+}
+
+// field reads the field at pos. It returns the field, the position after its separator, and the separator, 0 at
+// the end of the result.
+func (t *queryTokenizer) field(pos int) (string, int, byte, error) {
+	if pos < len(t.s) && t.s[pos] == '"' {
+		var b strings.Builder
+		pos++
+		for {
+			i := strings.IndexByte(t.s[pos:], '"')
+			if i < 0 {
+				return "", 0, 0, errors.New("unterminated quoted field")
+			}
+			b.WriteString(t.s[pos : pos+i])
+			pos += i + 1
+			if pos < len(t.s) && t.s[pos] == '"' {
+				b.WriteByte('"')
+				pos++
+				continue
+			}
+			break
+		}
+		if pos == len(t.s) {
+			return b.String(), pos, 0, nil
+		}
+		if sep := t.s[pos]; sep == ',' || sep == ';' {
+			return b.String(), pos + 1, sep, nil
+		}
+		return "", 0, 0, fmt.Errorf("unexpected %q after quoted field", t.s[pos])
+	}
+
+	i := strings.IndexAny(t.s[pos:], ",;")
+	if i < 0 {
+		return t.s[pos:], len(t.s), 0, nil
+	}
+	return t.s[pos : pos+i], pos + i + 1, t.s[pos+i], nil
+}
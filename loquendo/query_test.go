@@ -0,0 +1,80 @@
+package loquendo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQueryResult(t *testing.T) {
+	voices := map[string]bool{"Roberto": true, "Paola": true}
+	tests := []struct {
+		name   string
+		result string
+		fields int
+		ids    map[string]bool
+		want   [][]string
+	}{
+		{"empty", "", 2, nil, nil},
+		{"identifiers", "Roberto;Paola", 1, nil, [][]string{{"Roberto"}, {"Paola"}}},
+		{"records", "Roberto,male;Paola,female", 2, voices, [][]string{{"Roberto", "male"}, {"Paola", "female"}}},
+		{"trailing separator", "Roberto,male;Paola,female;", 2, voices, [][]string{{"Roberto", "male"}, {"Paola", "female"}}},
+		{
+			"comma in last field",
+			"Roberto,Ciao, sono Roberto.;Paola,Ciao, sono Paola.",
+			2, voices,
+			[][]string{{"Roberto", "Ciao, sono Roberto."}, {"Paola", "Ciao, sono Paola."}},
+		},
+		{
+			"semicolon and comma in last field",
+			"Paola,Ciao; sono Paola, una voce italiana.;Roberto,Ciao; io sono Roberto, e tu?",
+			2, voices,
+			[][]string{{"Paola", "Ciao; sono Paola, una voce italiana."}, {"Roberto", "Ciao; io sono Roberto, e tu?"}},
+		},
+		{
+			"separators in last field of the last record",
+			"Roberto,male,Voce; maschile, italiana",
+			3, voices,
+			[][]string{{"Roberto", "male", "Voce; maschile, italiana"}},
+		},
+		{
+			"last field ending with a known identifier",
+			"Roberto,Saluta; Paola,e poi;Paola,Ciao",
+			2, voices,
+			[][]string{{"Roberto", "Saluta; Paola,e poi"}, {"Paola", "Ciao"}},
+		},
+		{"quoted fields", `"Roberto","Ciao; ""Roberto"", qui";Paola,Ciao`, 2, voices, [][]string{{"Roberto", `Ciao; "Roberto", qui`}, {"Paola", "Ciao"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseQueryResult(tt.result, tt.fields, tt.ids)
+			if err != nil {
+				t.Fatalf("parseQueryResult(%q) error: %v", tt.result, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseQueryResult(%q) = %q, want %q", tt.result, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryResultErrors(t *testing.T) {
+	voices := map[string]bool{"Roberto": true, "Paola": true}
+	tests := []struct {
+		name   string
+		result string
+		fields int
+	}{
+		{"missing fields", "Roberto", 2},
+		{"unknown identifier", "Simon,male", 2},
+		{"unterminated quote", `Roberto,"Ciao`, 2},
+		{"text after quoted field", `Roberto,"Ciao"x`, 2},
+		{"too many quoted fields", `Roberto,"a","b"`, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := parseQueryResult(tt.result, tt.fields, voices); err == nil {
+				t.Errorf("parseQueryResult(%q) = %q, want an error", tt.result, got)
+			}
+		})
+	}
+}
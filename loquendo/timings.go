@@ -0,0 +1,253 @@
+package loquendo
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type SentenceTiming struct {
+	Index      int           `json:"index"`       // Index is the position of the sentence in the prompt
+	Text       string        `json:"text"`        // Text is the sentence text
+	TextOffset int           `json:"text_offset"` // TextOffset is the byte offset of the sentence in the input text
+	Start      time.Duration `json:"start"`       // Start is the time the sentence starts at in the audio
+	End        time.Duration `json:"end"`         // End is the time the sentence ends at in the audio
+}
+
+type WordTiming struct {
+	Text       string        `json:"text"`        // Text is the word text
+	TextOffset int           `json:"text_offset"` // TextOffset is the byte offset of the word in the input text
+	Sentence   int           `json:"sentence"`    // Sentence is the index of the sentence containing the word
+	Start      time.Duration `json:"start"`       // Start is the time the word starts at in the audio
+	End        time.Duration `json:"end"`         // End is the time the word ends at in the audio
+}
+
+type BookmarkTiming struct {
+	Name string        `json:"name"` // Name is the bookmark name, as written in the input text
+	Time time.Duration `json:"time"` // Time is the position of the bookmark in the audio
+}
+
+// Timings correlates the input text with the rendered audio.
+type Timings struct {
+	Duration  time.Duration    `json:"duration"`  // Duration is the total duration of the audio
+	Sentences []SentenceTiming `json:"sentences"` // Sentences are the sentence boundaries reported by the engine
+	Words     []WordTiming     `json:"words"`     // Words are the word boundaries, see WordsEstimated
+	Bookmarks []BookmarkTiming `json:"bookmarks"` // Bookmarks are the bookmarks found in the input text
+	// WordsEstimated is true if the engine does not report word boundaries and the word timings were interpolated
+	// within each sentence, proportionally to the word length.
+	WordsEstimated bool `json:"words_estimated"`
+}
+
+type markKind int
+
+const (
+	markSentence markKind = iota
+	markWord
+	markBookmark
+)
+
+// timingMark is an engine event, along with the audio position it occurred at.
+type timingMark struct {
+	kind       markKind
+	sample     int64
+	endSample  int64 // endSample is only set for words, negative if the word ends where the next mark starts
+	text       string
+	textOffset int
+}
+
+// timingRecorder collects timing marks while a prompt is being rendered. Marks may be added from the engine
+// callback thread.
+type timingRecorder struct {
+	mu    sync.Mutex
+	marks []timingMark
+}
+
+func (r *timingRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.marks = nil
+}
+
+func (r *timingRecorder) add(mark timingMark) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.marks = append(r.marks, mark)
+}
+
+type textSpan struct {
+	text   string
+	offset int
+}
+
+// splitSentences splits the text after sentence-ending punctuation followed by a space, and at line breaks.
+func splitSentences(text string) []textSpan {
+	var spans []textSpan
+	start := 0
+	flush := func(end int) {
+		if s := strings.TrimSpace(text[start:end]); s != "" {
+			spans = append(spans, textSpan{text: s, offset: start + strings.Index(text[start:end], s)})
+		}
+		start = end
+	}
+	for i, r := range text {
+		switch {
+		case r == '\n':
+			flush(i + 1)
+		case r == '.' || r == '!' || r == '?':
+			next, _ := utf8.DecodeRuneInString(text[i+1:])
+			if i+1 >= len(text) || unicode.IsSpace(next) {
+				flush(i + 1)
+			}
+		}
+	}
+	flush(len(text))
+	return spans
+}
+
+// splitWords returns the words of a text, with their offsets relative to the text.
+func splitWords(text string) []textSpan {
+	var spans []textSpan
+	start := -1
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				spans = append(spans, textSpan{text: text[start:i], offset: start})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, textSpan{text: text[start:], offset: start})
+	}
+	return spans
+}
+
+// build computes the timings of a prompt. Sentence marks are matched in order with the sentences of the input
+// text, since the engine only reports that a sentence started.
+func (r *timingRecorder) build(text string, totalSamples int64, sampleRate uint32) Timings {
+	r.mu.Lock()
+	marks := make([]timingMark, len(r.marks))
+	copy(marks, r.marks)
+	r.mu.Unlock()
+
+	for i := range marks {
+		if marks[i].kind != markWord || marks[i].endSample >= 0 {
+			continue
+		}
+		marks[i].endSample = totalSamples
+		for _, next := range marks[i+1:] {
+			if next.kind != markBookmark {
+				marks[i].endSample = max(next.sample, marks[i].sample)
+				break
+			}
+		}
+	}
+
+	toTime := func(sample int64) time.Duration {
+		return samplesDuration(sample, sampleRate)
+	}
+
+	timings := Timings{
+		Duration:  toTime(totalSamples),
+		Sentences: []SentenceTiming{},
+		Words:     []WordTiming{},
+		Bookmarks: []BookmarkTiming{},
+	}
+
+	var sentenceStarts []int64
+	for _, m := range marks {
+		switch m.kind {
+		case markSentence:
+			sentenceStarts = append(sentenceStarts, m.sample)
+		case markBookmark:
+			timings.Bookmarks = append(timings.Bookmarks, BookmarkTiming{Name: m.text, Time: toTime(m.sample)})
+		case markWord:
+			timings.Words = append(timings.Words, WordTiming{
+				Text:       m.text,
+				TextOffset: m.textOffset,
+				Start:      toTime(m.sample),
+				End:        toTime(m.endSample),
+			})
+		}
+	}
+
+	spans := splitSentences(text)
+	for i, start := range sentenceStarts {
+		end := totalSamples
+		if i+1 < len(sentenceStarts) {
+			end = sentenceStarts[i+1]
+		}
+		sentence := SentenceTiming{
+			Index: i,
+			Start: toTime(start),
+			End:   toTime(max(end, start)),
+		}
+		if i < len(spans) {
+			sentence.Text = spans[i].text
+			sentence.TextOffset = spans[i].offset
+			if i == len(sentenceStarts)-1 && len(spans) > len(sentenceStarts) {
+				// More sentences in the text than reported by the engine, the last one takes the remaining text
+				last := spans[len(spans)-1]
+				sentence.Text = text[sentence.TextOffset : last.offset+len(last.text)]
+			}
+		}
+		timings.Sentences = append(timings.Sentences, sentence)
+	}
+
+	for i := range timings.Words {
+		for _, s := range timings.Sentences {
+			if timings.Words[i].Start >= s.Start {
+				timings.Words[i].Sentence = s.Index
+			}
+		}
+	}
+
+	if len(timings.Words) == 0 {
+		timings.WordsEstimated = true
+		for _, s := range timings.Sentences {
+			timings.Words = append(timings.Words, estimateWords(s)...)
+		}
+	}
+
+	return timings
+}
+
+// estimateWords spreads the duration of a sentence over its words, proportionally to their length.
+func estimateWords(sentence SentenceTiming) []WordTiming {
+	words := splitWords(sentence.Text)
+	total := 0
+	for _, w := range words {
+		total += utf8.RuneCountInString(w.text)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	duration := sentence.End - sentence.Start
+	res := make([]WordTiming, len(words))
+	elapsed := 0
+	for i, w := range words {
+		length := utf8.RuneCountInString(w.text)
+		res[i] = WordTiming{
+			Text:       w.text,
+			TextOffset: sentence.TextOffset + w.offset,
+			Sentence:   sentence.Index,
+			Start:      sentence.Start + duration*time.Duration(elapsed)/time.Duration(total),
+			End:        sentence.Start + duration*time.Duration(elapsed+length)/time.Duration(total),
+		}
+		elapsed += length
+	}
+	return res
+}
+
+// samplesDuration converts a position in samples to a duration.
+func samplesDuration(samples int64, sampleRate uint32) time.Duration {
+	if sampleRate == 0 {
+		return 0
+	}
+	return time.Duration(samples) * time.Second / time.Duration(sampleRate)
+}
@@ -0,0 +1,89 @@
+// Package audio processes the WAV streams produced by the engine: header parsing, sample format and channel
+// conversion, resampling and encoding, without external tools.
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Encoding is the WAV format tag of the samples.
+type Encoding uint16
+
+const (
+	EncodingPCM  Encoding = 1
+	EncodingALaw Encoding = 6
+	EncodingULaw Encoding = 7
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingPCM:
+		return "pcm"
+	case EncodingALaw:
+		return "alaw"
+	case EncodingULaw:
+		return "ulaw"
+	default:
+		return fmt.Sprintf("format %d", uint16(e))
+	}
+}
+
+// Format describes a stream of interleaved samples.
+type Format struct {
+	Encoding      Encoding `json:"encoding"`
+	Channels      uint16   `json:"channels"`
+	SampleRate    uint32   `json:"sample_rate"`
+	BitsPerSample uint16   `json:"bits_per_sample"`
+}
+
+// PCM16 returns the 16-bit linear format with the given rate and channels.
+func PCM16(sampleRate uint32, channels uint16) Format {
+	return Format{Encoding: EncodingPCM, Channels: channels, SampleRate: sampleRate, BitsPerSample: 16}
+}
+
+// FrameSize is the size in bytes of one sample for every channel.
+func (f Format) FrameSize() int {
+	return int(f.Channels) * int(f.BitsPerSample) / 8
+}
+
+// IsPCM16 tells whether the samples are 16-bit linear, the format all the conversions work on.
+func (f Format) IsPCM16() bool {
+	return f.Encoding == EncodingPCM && f.BitsPerSample == 16
+}
+
+// Stream is a reader of raw samples in a known format. Closing it closes the source it was read from.
+type Stream struct {
+	io.Reader
+	Format Format
+	closer io.Closer
+}
+
+// NewStream wraps a reader of raw samples. The closer may be nil.
+func NewStream(r io.Reader, format Format, closer io.Closer) *Stream {
+	return &Stream{Reader: r, Format: format, closer: closer}
+}
+
+func (s *Stream) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// int16Samples decodes little-endian 16-bit samples, appending them to dst.
+func int16Samples(dst []int16, b []byte) []int16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		dst = append(dst, int16(binary.LittleEndian.Uint16(b[i:])))
+	}
+	return dst
+}
+
+// int16Bytes encodes samples as little-endian 16-bit, appending them to dst.
+func int16Bytes(dst []byte, samples []int16) []byte {
+	for _, s := range samples {
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(s))
+	}
+	return dst
+}
@@ -0,0 +1,68 @@
+package audio
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+// twoTones returns n samples of 440 Hz and 1 kHz sines at the given rate, with a peak of a third of full scale.
+func twoTones(n int, rate uint32) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		t := float64(i) / float64(rate)
+		samples[i] = int16(5000*math.Sin(2*math.Pi*440*t) + 5000*math.Sin(2*math.Pi*1000*t))
+	}
+	return samples
+}
+
+// interleave merges channels of equal length into interleaved samples.
+func interleave(channels ...[]int16) []int16 {
+	res := make([]int16, 0, len(channels)*len(channels[0]))
+	for i := range channels[0] {
+		for _, c := range channels {
+			res = append(res, c[i])
+		}
+	}
+	return res
+}
+
+// snr returns the ratio, in dB, of the power of want to the power of the difference between got and want.
+func snr(got, want []int16) float64 {
+	var signal, noise float64
+	for i := range want {
+		d := float64(got[i]) - float64(want[i])
+		signal += float64(want[i]) * float64(want[i])
+		noise += d * d
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+// seekBuffer is an in-memory io.WriteSeeker, standing for a file.
+type seekBuffer struct {
+	data []byte
+	pos  int
+}
+
+func (b *seekBuffer) Write(p []byte) (int, error) {
+	if end := b.pos + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	b.pos += copy(b.data[b.pos:], p)
+	return len(p), nil
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(b.pos)
+	case io.SeekEnd:
+		offset += int64(len(b.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.pos = int(offset)
+	return offset, nil
+}
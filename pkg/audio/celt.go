@@ -0,0 +1,529 @@
+package audio
+
+import (
+	"math"
+	"slices"
+)
+
+// celtEMeans are the mean band energies, in log2 units, subtracted before quantization.
+var celtEMeans = [celtBands]float64{
+	6.4375, 6.25, 5.75, 5.3125, 5.0625, 4.8125, 4.5, 4.375, 4.875, 4.6875, 4.5625,
+	4.4375, 4.875, 4.625, 4.3125, 4.5, 4.375, 4.625, 4.75, 4.4375, 3.75,
+}
+
+// celtIntraProbModel is the Laplace distribution of the intra-coded coarse energy of 20 ms frames: pairs of the
+// probability of 0 and the decay, for each band.
+var celtIntraProbModel = [42]uint{
+	22, 178, 63, 114, 74, 82, 84, 83, 92, 82, 103, 62, 96, 72, 96, 67, 101, 73, 107, 72, 113,
+	55, 118, 52, 125, 52, 118, 52, 117, 55, 135, 49, 137, 39, 157, 32, 145, 29, 97, 33, 77, 40,
+}
+
+var (
+	celtSmallEnergyICDF = []uint8{2, 1, 0}
+	celtSpreadICDF      = []uint8{25, 23, 2, 0}
+	celtTrimICDF        = []uint8{126, 124, 119, 109, 87, 41, 19, 9, 4, 2, 0}
+)
+
+const (
+	celtBetaIntra   = 4915.0 / 32768
+	celtPreemphasis = 27853.0 / 32768
+	celtTrim        = 5
+	celtMinEnergy   = -28 // band energies are not coded below this, in log2 units
+)
+
+// celtEncoder encodes mono 48 kHz frames as CELT-only Opus packets of a constant size. It codes every frame as
+// intra, with long blocks and no post-filter, so that the frames are independent but for the overlap of the
+// transform.
+type celtEncoder struct {
+	end        int // number of coded bands, set by the bandwidth
+	frameBytes int
+
+	preemph    float64              // last input sample, for the pre-emphasis
+	overlap    [celtOverlap]float64 // pre-emphasized samples of the previous frame, overlapping this one
+	lastCoded  int
+	caps       [celtBands]int
+	window     [celtOverlap]float64
+	mdct       *dct4
+	folded     []float64
+	freq       []float64
+	normalized []float64
+}
+
+func newCeltEncoder(end, frameBytes int) *celtEncoder {
+	e := &celtEncoder{
+		end:        end,
+		frameBytes: frameBytes,
+		caps:       celtCaps(),
+		mdct:       newDCT4(celtFrameSize),
+		folded:     make([]float64, celtFrameSize),
+		freq:       make([]float64, celtFrameSize),
+		normalized: make([]float64, celtFrameSize),
+	}
+	for i := range e.window {
+		s := math.Sin(0.5 * math.Pi * (float64(i) + 0.5) / celtOverlap)
+		e.window[i] = math.Sin(0.5 * math.Pi * s * s)
+	}
+	return e
+}
+
+// encode codes a frame of celtFrameSize samples, scaled to 16-bit, returning the packet without its TOC byte.
+func (e *celtEncoder) encode(pcm []float64) []byte {
+	// The frame spans the overlap kept from the previous frame followed by the new samples
+	var input [celtOverlap + celtFrameSize]float64
+	copy(input[:], e.overlap[:])
+	for i, s := range pcm {
+		input[celtOverlap+i] = s - e.preemph*celtPreemphasis
+		e.preemph = s
+	}
+	silent := true
+	for _, s := range input {
+		silent = silent && s == 0
+	}
+	copy(e.overlap[:], input[celtFrameSize:])
+
+	buf := make([]byte, e.frameBytes)
+	enc := newRangeEncoder(buf)
+	enc.bitLogP(silent, 15)
+	if silent {
+		// The decoder ignores the rest of a silent frame, so it is sent as short as possible, but longer than one
+		// byte, which would signal a lost frame
+		enc.done()
+		return buf[:max(enc.offs, 2)]
+	}
+	e.forward(input[:])
+
+	totalBits := e.frameBytes * 8
+	if enc.tell()+16 <= totalBits {
+		enc.bitLogP(false, 1) // no post-filter
+	}
+	if enc.tell()+3 <= totalBits {
+		enc.bitLogP(false, 3) // not transient
+	}
+
+	var bandE, bandLogE, errs [celtBands]float64
+	for i := 0; i < e.end; i++ {
+		lo, hi := celtEBands[i]<<celtLM, celtEBands[i+1]<<celtLM
+		sum := 1e-27
+		for _, x := range e.freq[lo:hi] {
+			sum += x * x
+		}
+		bandE[i] = math.Sqrt(sum)
+		for j := lo; j < hi; j++ {
+			e.normalized[j] = e.freq[j] / (1e-27 + bandE[i])
+		}
+		bandLogE[i] = max(math.Log2(bandE[i])-celtEMeans[i], celtMinEnergy)
+	}
+	e.quantCoarseEnergy(enc, &bandLogE, &errs, totalBits)
+	e.encodeTF(enc, totalBits)
+	if enc.tell()+4 <= totalBits {
+		enc.icdf(0, celtSpreadICDF, 5) // no spreading rotation
+	}
+
+	// No band gets a dynamic allocation boost
+	totalFrac := totalBits << bitRes
+	tell := enc.tellFrac()
+	for i := 0; i < e.end; i++ {
+		if tell+6<<bitRes < totalFrac && e.caps[i] > 0 {
+			enc.bitLogP(false, 6)
+			tell = enc.tellFrac()
+		}
+	}
+	if tell+6<<bitRes <= totalFrac {
+		enc.icdf(celtTrim, celtTrimICDF, 7)
+	}
+
+	bits := totalFrac - enc.tellFrac() - 1
+	alloc := celtComputeAllocation(enc, e.end, &e.caps, celtTrim, bits, e.lastCoded)
+	if e.lastCoded != 0 {
+		e.lastCoded = min(e.lastCoded+1, max(e.lastCoded-1, alloc.codedBands))
+	} else {
+		e.lastCoded = alloc.codedBands
+	}
+
+	e.quantFineEnergy(enc, alloc, &errs)
+	e.quantBands(enc, alloc, totalFrac)
+	e.quantEnergyFinalise(enc, alloc, &errs, totalBits-enc.tell())
+	enc.done()
+	return buf
+}
+
+// forward computes the MDCT of the pre-emphasized input, whose first and last celtOverlap samples are windowed.
+func (e *celtEncoder) forward(input []float64) {
+	// Fold the windowed input into celtFrameSize samples, so that the transform is a DCT-IV
+	const half = celtOverlap / 2
+	v := e.folded
+	for m := range half {
+		v[m] = e.window[m+half]*input[m+half] - e.window[half-1-m]*input[half-1-m]
+	}
+	copy(v[half:celtFrameSize-half], input[celtOverlap:celtFrameSize])
+	for m := celtFrameSize - half; m < celtFrameSize; m++ {
+		t := m - (celtFrameSize - half)
+		v[m] = e.window[celtOverlap-1-t]*input[m+half] + e.window[t]*input[2*celtFrameSize+celtOverlap-half-1-m]
+	}
+	// The inverse transform of the decoder is a DCT-IV with its output reversed and negated
+	slices.Reverse(v)
+	e.mdct.transform(v, e.freq)
+	for i := range e.freq {
+		e.freq[i] *= -2.0 / celtFrameSize
+	}
+}
+
+// laplaceEncode codes the energy delta qi with the Laplace distribution of probability fs for 0 and decay,
+// returning the value coded, which is smaller in magnitude if qi is out of range.
+func laplaceEncode(enc *rangeEncoder, qi int, fs, decay uint32) int {
+	const minP, nMin = 1, 16
+	var fl uint32
+	if qi != 0 {
+		s := 0
+		if qi < 0 {
+			s = -1
+		}
+		val := (qi + s) ^ s
+		fl = fs
+		fs = (32768 - minP*2*nMin - fs) * (16384 - decay) >> 15
+		i := 1
+		for ; fs > 0 && i < val; i++ {
+			fs *= 2
+			fl += fs + 2*minP
+			fs = fs * decay >> 15
+		}
+		if fs == 0 {
+			ndiMax := int(32768-fl+minP-1) / minP
+			ndiMax = (ndiMax - s) >> 1
+			di := min(val-i, ndiMax-1)
+			fl += uint32((2*di + 1 + s) * minP)
+			fs = min(minP, 32768-fl)
+			qi = (i + di + s) ^ s
+		} else {
+			fs += minP
+			if s == 0 {
+				fl += fs
+			}
+		}
+	}
+	enc.encodeBin(fl, fl+fs, 15)
+	return qi
+}
+
+// quantCoarseEnergy codes the band energies in steps of 6 dB, predicted from the lower bands only.
+func (e *celtEncoder) quantCoarseEnergy(enc *rangeEncoder, bandLogE, errs *[celtBands]float64, budget int) {
+	if enc.tell()+3 <= budget {
+		enc.bitLogP(true, 3) // intra
+	}
+	prev := 0.0
+	for i := 0; i < e.end; i++ {
+		f := bandLogE[i] - prev
+		qi := int(math.Floor(0.5 + f))
+		tell := enc.tell()
+		bitsLeft := budget - tell - 3*(e.end-i)
+		if i != 0 && bitsLeft < 30 {
+			if bitsLeft < 24 {
+				qi = min(1, qi)
+			}
+			if bitsLeft < 16 {
+				qi = max(-1, qi)
+			}
+		}
+		switch {
+		case budget-tell >= 15:
+			pi := 2 * min(i, 20)
+			qi = laplaceEncode(enc, qi, uint32(celtIntraProbModel[pi]<<7), uint32(celtIntraProbModel[pi+1]<<6))
+		case budget-tell >= 2:
+			qi = max(-1, min(qi, 1))
+			s := 2 * qi
+			if qi < 0 {
+				s = -s - 1
+			}
+			enc.icdf(s, celtSmallEnergyICDF, 2)
+		case budget-tell >= 1:
+			qi = min(0, qi)
+			enc.bitLogP(qi != 0, 1)
+		default:
+			qi = -1
+		}
+		errs[i] = f - float64(qi)
+		q := float64(qi)
+		prev += q - celtBetaIntra*q
+	}
+}
+
+// encodeTF codes the time-frequency resolution changes, which are all none.
+func (e *celtEncoder) encodeTF(enc *rangeEncoder, totalBits int) {
+	budget := totalBits
+	tell := enc.tell()
+	logp := uint(4)
+	if tell+int(logp)+1 <= budget {
+		budget-- // reserved for the selection, which is not coded when nothing changes
+	}
+	for i := 0; i < e.end; i++ {
+		if tell+int(logp) <= budget {
+			enc.bitLogP(false, logp)
+			tell = enc.tell()
+		}
+		logp = 5
+	}
+}
+
+// quantFineEnergy refines the band energies with the bits given by the allocation.
+func (e *celtEncoder) quantFineEnergy(enc *rangeEncoder, alloc *celtAllocation, errs *[celtBands]float64) {
+	for i := 0; i < e.end; i++ {
+		bits := alloc.fineBits[i]
+		if bits <= 0 {
+			continue
+		}
+		frac := 1 << uint(bits)
+		q2 := int(math.Floor((errs[i] + 0.5) * float64(frac)))
+		q2 = max(0, min(q2, frac-1))
+		enc.rawBits(uint32(q2), bits)
+		errs[i] -= (float64(q2)+0.5)/float64(frac) - 0.5
+	}
+}
+
+// quantEnergyFinalise spends the bits left over on one more bit of energy for some bands.
+func (e *celtEncoder) quantEnergyFinalise(enc *rangeEncoder, alloc *celtAllocation, errs *[celtBands]float64,
+	bitsLeft int) {
+	for prio := 0; prio < 2; prio++ {
+		for i := 0; i < e.end && bitsLeft >= 1; i++ {
+			if alloc.fineBits[i] >= celtMaxFine || alloc.finePriority[i] != prio {
+				continue
+			}
+			q2 := uint32(0)
+			if errs[i] >= 0 {
+				q2 = 1
+			}
+			enc.rawBits(q2, 1)
+			errs[i] -= (float64(q2) - 0.5) / float64(int(1)<<uint(alloc.fineBits[i]+1))
+			bitsLeft--
+		}
+	}
+}
+
+// quantBands codes the normalized shape of each band with pyramid vector quantization.
+func (e *celtEncoder) quantBands(enc *rangeEncoder, alloc *celtAllocation, totalBits int) {
+	balance := alloc.balance
+	for i := 0; i < e.end; i++ {
+		x := e.normalized[celtEBands[i]<<celtLM : celtEBands[i+1]<<celtLM]
+		tell := enc.tellFrac()
+		if i != 0 {
+			balance -= tell
+		}
+		remaining := totalBits - tell - 1
+		b := 0
+		if i <= alloc.codedBands-1 {
+			currBalance := balance / min(3, alloc.codedBands-i)
+			b = max(0, min(16383, min(remaining+1, alloc.pulses[i]+currBalance)))
+		}
+		q := &bandQuantizer{enc: enc, band: i, remaining: remaining}
+		q.partition(x, b, celtLM)
+		balance += alloc.pulses[i] + tell
+	}
+}
+
+// bandQuantizer codes the shape of a band, splitting it in halves while there are too many bits for one PVQ
+// codeword.
+type bandQuantizer struct {
+	enc       *rangeEncoder
+	band      int
+	remaining int
+}
+
+func (q *bandQuantizer) partition(x []float64, b, lm int) {
+	n := len(x)
+	cache := celtCache.pulseBits(q.band, lm)
+	if lm != -1 && b > cache[cache[0]]+12 && n > 2 {
+		n >>= 1
+		lm--
+		mid, side := x[:n], x[n:]
+		itheta, delta := q.theta(mid, side, n, &b, lm)
+		mbits := max(0, min(b, (b-delta)/2))
+		sbits := b - mbits
+		rebalance := q.remaining
+		if mbits >= sbits {
+			q.partition(mid, mbits, lm)
+			rebalance = mbits - (rebalance - q.remaining)
+			if rebalance > 3<<bitRes && itheta != 0 {
+				sbits += rebalance - 3<<bitRes
+			}
+			q.partition(side, sbits, lm)
+		} else {
+			q.partition(side, sbits, lm)
+			rebalance = sbits - (rebalance - q.remaining)
+			if rebalance > 3<<bitRes && itheta != 16384 {
+				mbits += rebalance - 3<<bitRes
+			}
+			q.partition(mid, mbits, lm)
+		}
+		return
+	}
+
+	pulses := celtCache.bits2pulses(q.band, lm, b)
+	bits := celtCache.pulses2bits(q.band, lm, pulses)
+	q.remaining -= bits
+	for q.remaining < 0 && pulses > 0 {
+		q.remaining += bits
+		pulses--
+		bits = celtCache.pulses2bits(q.band, lm, pulses)
+		q.remaining -= bits
+	}
+	if pulses != 0 {
+		k := celtGetPulses(pulses)
+		y := pvqSearch(x, k)
+		u := pvqTable(n, k)
+		q.enc.uint(pvqIndex(y, u), uint32(u[n][k]+u[n][k+1]))
+	}
+}
+
+// theta codes the angle between the energies of the two halves of a split band, returning it with the difference
+// between the bits to give the halves. The bits used are taken out of b.
+func (q *bandQuantizer) theta(x, y []float64, n int, b *int, lm int) (int, int) {
+	pulseCap := celtLogN[q.band] + lm<<bitRes
+	offset := pulseCap>>1 - celtQThetaOff
+	qn := celtComputeQN(n, *b, offset, pulseCap)
+
+	var ex, ey float64 = 1e-15, 1e-15
+	for i := range x {
+		ex += x[i] * x[i]
+		ey += y[i] * y[i]
+	}
+	itheta := int(math.Floor(0.5 + 16384*0.63662*math.Atan2(math.Sqrt(ey), math.Sqrt(ex))))
+
+	tell := q.enc.tellFrac()
+	if qn != 1 {
+		itheta = (itheta*qn + 8192) >> 14
+		ft := ((qn >> 1) + 1) * ((qn >> 1) + 1)
+		var fs, fl int
+		if itheta <= qn>>1 {
+			fs = itheta + 1
+			fl = itheta * (itheta + 1) >> 1
+		} else {
+			fs = qn + 1 - itheta
+			fl = ft - ((qn + 1 - itheta) * (qn + 2 - itheta) >> 1)
+		}
+		q.enc.encode(uint32(fl), uint32(fl+fs), uint32(ft))
+		itheta = itheta * 16384 / qn
+	} else {
+		itheta = 0
+	}
+	qalloc := q.enc.tellFrac() - tell
+	*b -= qalloc
+	q.remaining -= qalloc
+
+	switch itheta {
+	case 0:
+		return itheta, -16384
+	case 16384:
+		return itheta, 16384
+	}
+	imid := celtBitexactCos(itheta)
+	iside := celtBitexactCos(16384 - itheta)
+	return itheta, fracMul16((n-1)<<7, celtBitexactLog2Tan(iside, imid))
+}
+
+// celtComputeQN returns the number of steps to quantize the split angle with.
+func celtComputeQN(n, b, offset, pulseCap int) int {
+	exp2Table8 := [8]int{16384, 17866, 19483, 21247, 23170, 25267, 27554, 30048}
+	n2 := 2*n - 1
+	qb := (b + n2*offset) / n2
+	qb = min(b-pulseCap-4<<bitRes, qb)
+	qb = min(8<<bitRes, qb)
+	if qb < 1<<bitRes>>1 {
+		return 1
+	}
+	qn := exp2Table8[qb&7] >> uint(14-qb>>bitRes)
+	return (qn + 1) >> 1 << 1
+}
+
+func fracMul16(a, b int) int {
+	return (16384 + int(int16(a))*int(int16(b))) >> 15
+}
+
+func celtBitexactCos(x int) int {
+	x2 := (4096 + x*x) >> 13
+	x2 = (32767 - x2) + fracMul16(x2, -7651+fracMul16(x2, 8277+fracMul16(-626, x2)))
+	return 1 + x2
+}
+
+func celtBitexactLog2Tan(isin, icos int) int {
+	lc := ilog(uint32(icos))
+	ls := ilog(uint32(isin))
+	icos <<= uint(15 - lc)
+	isin <<= uint(15 - ls)
+	return (ls-lc)*(1<<11) + fracMul16(isin, fracMul16(isin, -2597)+7932) - fracMul16(icos, fracMul16(icos, -2597)+7932)
+}
+
+// pvqSearch finds the vector of k pulses whose direction is the closest to x.
+func pvqSearch(x []float64, k int) []int {
+	n := len(x)
+	y := make([]int, n)
+	abs := make([]float64, n)
+	sum := 0.0
+	for i, v := range x {
+		abs[i] = math.Abs(v)
+		sum += abs[i]
+	}
+	if !(sum > 1e-15) {
+		abs[0], sum = 1, 1
+		for i := 1; i < n; i++ {
+			abs[i] = 0
+		}
+	}
+	// Start from the projection on the pyramid, then add the remaining pulses one at a time
+	pulses := 0
+	var xy, yy float64
+	if k > n>>1 {
+		scale := float64(k-1) / sum
+		for i, a := range abs {
+			y[i] = int(math.Floor(a * scale))
+			pulses += y[i]
+			xy += a * float64(y[i])
+			yy += float64(y[i] * y[i])
+		}
+	}
+	for ; pulses < k; pulses++ {
+		best, bestNum, bestDen := 0, -1.0, 1.0
+		for i, a := range abs {
+			num := (xy + a) * (xy + a)
+			den := yy + float64(2*y[i]+1)
+			if num*bestDen > bestNum*den {
+				best, bestNum, bestDen = i, num, den
+			}
+		}
+		xy += abs[best]
+		yy += float64(2*y[best] + 1)
+		y[best]++
+	}
+	for i, v := range x {
+		if v < 0 {
+			y[i] = -y[i]
+		}
+	}
+	return y
+}
+
+// pvqIndex returns the index of the pulse vector y among the codewords with the same number of pulses, given the
+// table of U from pvqTable.
+func pvqIndex(y []int, u [][]uint64) uint32 {
+	n := len(y)
+	j := n - 1
+	var i uint64
+	if y[j] < 0 {
+		i = 1
+	}
+	k := iabs(y[j])
+	for j > 0 {
+		j--
+		i += u[n-j][k]
+		k += iabs(y[j])
+		if y[j] < 0 {
+			i += u[n-j][k+1]
+		}
+	}
+	return uint32(i)
+}
+
+func iabs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
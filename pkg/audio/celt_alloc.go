@@ -0,0 +1,482 @@
+package audio
+
+// CELT mode parameters for 48 kHz with 20 ms frames (RFC 6716, section 4.3). Band edges are in units of the
+// 2.5 ms transform, 200 Hz wide bins.
+const (
+	celtBands      = 21
+	celtLM         = 3 // log2 of the number of 2.5 ms blocks in a frame
+	celtFrameSize  = 120 << celtLM
+	celtOverlap    = 120
+	celtMaxFine    = 8
+	celtFineOffset = 21
+	celtQThetaOff  = 4
+	celtMaxPseudo  = 40
+	celtLogMaxPsd  = 6
+	celtAllocSteps = 6
+)
+
+var celtEBands = [celtBands + 1]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 10, 12, 14, 16, 20, 24, 28, 34, 40, 48, 60, 78, 100}
+
+// celtLogN is log2 of the band widths, in 1/8 bits.
+var celtLogN = [celtBands]int{0, 0, 0, 0, 0, 0, 0, 0, 8, 8, 8, 8, 16, 16, 16, 21, 21, 24, 29, 34, 36}
+
+// celtAllocVectors are the static bit allocations per band, in 1/32 bit per bin, from the lowest to the highest
+// quality.
+var celtAllocVectors = [11][celtBands]int{
+	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	{90, 80, 75, 69, 63, 56, 49, 40, 34, 29, 20, 18, 10, 0, 0, 0, 0, 0, 0, 0, 0},
+	{110, 100, 90, 84, 78, 71, 65, 58, 51, 45, 39, 32, 26, 20, 12, 0, 0, 0, 0, 0, 0},
+	{118, 110, 103, 93, 86, 80, 75, 70, 65, 59, 53, 47, 40, 31, 23, 15, 4, 0, 0, 0, 0},
+	{126, 119, 112, 104, 95, 89, 83, 78, 72, 66, 60, 54, 47, 39, 32, 25, 17, 12, 1, 0, 0},
+	{134, 127, 120, 114, 103, 97, 91, 85, 78, 72, 66, 60, 54, 47, 41, 35, 29, 23, 16, 10, 1},
+	{144, 137, 130, 124, 113, 107, 101, 95, 88, 82, 76, 70, 64, 57, 51, 45, 39, 33, 26, 15, 1},
+	{152, 145, 138, 132, 123, 117, 111, 105, 98, 92, 86, 80, 74, 67, 61, 55, 49, 43, 36, 20, 1},
+	{162, 155, 148, 142, 133, 127, 121, 115, 108, 102, 96, 90, 84, 77, 71, 65, 59, 53, 46, 30, 1},
+	{172, 165, 158, 152, 143, 137, 131, 125, 118, 112, 106, 100, 94, 87, 81, 75, 69, 63, 56, 45, 20},
+	{200, 200, 200, 200, 200, 200, 200, 200, 198, 193, 188, 183, 178, 173, 168, 163, 158, 153, 148, 129, 104},
+}
+
+// celtGetPulses maps a pseudo-pulse index to a number of pulses.
+func celtGetPulses(i int) int {
+	if i < 8 {
+		return i
+	}
+	return (8 + i&7) << uint(i>>3-1)
+}
+
+// pvqTable returns U(m, j) for m up to n and j up to k+1, the number of codewords of m dimensions with j-1 pulses
+// and a positive first coefficient, such that V(m, j) = U(m, j) + U(m, j+1). Counts saturate well above 32 bits.
+func pvqTable(n, k int) [][]uint64 {
+	const limit = 1 << 40
+	// U(m, j) = U(m-1, j) + U(m, j-1) + U(m-1, j-1), with U(m, 0) = 0 and U(1, j) = 1
+	u := make([][]uint64, n+1)
+	u[0] = make([]uint64, k+2)
+	for m := 1; m <= n; m++ {
+		u[m] = make([]uint64, k+2)
+		for j := 1; j <= k+1; j++ {
+			if m == 1 {
+				u[m][j] = 1
+				continue
+			}
+			u[m][j] = min(u[m-1][j]+u[m][j-1]+u[m-1][j-1], limit)
+		}
+	}
+	return u
+}
+
+// pvqV returns V(n, k), the number of codewords of n dimensions with k pulses, saturated well above 32 bits.
+func pvqV(n, k int) uint64 {
+	u := pvqTable(n, k)
+	return u[n][k] + u[n][k+1]
+}
+
+// celtLog2Frac returns log2(val) with frac fractional bits, rounded up.
+func celtLog2Frac(val uint32, frac int) int {
+	l := ilog(val)
+	if val&(val-1) == 0 {
+		return (l - 1) << uint(frac)
+	}
+	if l > 16 {
+		val = ((val - 1) >> uint(l-16)) + 1
+	} else {
+		val <<= uint(16 - l)
+	}
+	l = (l - 1) << uint(frac)
+	for ; frac >= 0; frac-- {
+		b := int(val >> 16)
+		l += b << uint(frac)
+		val = (val + uint32(b)) >> uint(b)
+		val = (val*val + 0x7FFF) >> 15
+	}
+	if val > 0x8000 {
+		l++
+	}
+	return l
+}
+
+// celtCache holds, for each band and each transform size, the cost in 1/8 bits of coding 1 to K pseudo-pulses,
+// and the caps on the bits per band.
+var celtCache = newCeltPulseCache()
+
+type celtPulseCache struct {
+	index [(celtLM + 2) * celtBands]int
+	bits  []int
+	caps  [(celtLM + 1) * 2 * celtBands]int
+}
+
+func newCeltPulseCache() *celtPulseCache {
+	c := &celtPulseCache{}
+	sizes := map[int]int{}
+	for i := 0; i <= celtLM+1; i++ {
+		for j := 0; j < celtBands; j++ {
+			n := (celtEBands[j+1] - celtEBands[j]) << uint(i) >> 1
+			c.index[i*celtBands+j] = -1
+			if n == 0 {
+				continue
+			}
+			if at, ok := sizes[n]; ok {
+				c.index[i*celtBands+j] = at
+				continue
+			}
+			k := 0
+			for k < celtMaxPseudo && pvqV(n, celtGetPulses(k+1)) < 1<<32 {
+				k++
+			}
+			at := len(c.bits)
+			sizes[n] = at
+			c.index[i*celtBands+j] = at
+			c.bits = append(c.bits, k)
+			for p := 1; p <= k; p++ {
+				c.bits = append(c.bits, celtLog2Frac(uint32(pvqV(n, celtGetPulses(p))), bitRes)-1)
+			}
+		}
+	}
+	c.computeCaps()
+	return c
+}
+
+// computeCaps finds the maximum rate for each band at which the band reliably uses the bits it is given.
+func (c *celtPulseCache) computeCaps() {
+	at := 0
+	for i := 0; i <= celtLM; i++ {
+		for ch := 1; ch <= 2; ch++ {
+			for j := 0; j < celtBands; j++ {
+				n0 := celtEBands[j+1] - celtEBands[j]
+				var maxBits int
+				if n0<<uint(i) == 1 {
+					maxBits = ch * (1 + celtMaxFine) << bitRes
+				} else {
+					lm0 := 0
+					if n0 > 2 {
+						n0 >>= 1
+						lm0--
+					} else if n0 <= 1 {
+						lm0 = min(i, 1)
+						n0 <<= uint(lm0)
+					}
+					p := c.bits[c.index[(lm0+1)*celtBands+j]:]
+					maxBits = p[p[0]] + 1
+					n := n0
+					for k := 0; k < i-lm0; k++ {
+						maxBits <<= 1
+						offset := (celtLogN[j]+(lm0+k)<<bitRes)>>1 - celtQThetaOff
+						num := 459 * ((2*n-1)*offset + maxBits)
+						den := (2*n-1)<<9 - 459
+						maxBits += min((num+den>>1)/den, 57)
+						n <<= 1
+					}
+					if ch == 2 {
+						maxBits <<= 1
+						qthetaOffset, scale, limit := celtQThetaOff, 487, 61
+						if n == 2 {
+							qthetaOffset, scale, limit = 16, 512, 64
+						}
+						offset := (celtLogN[j]+i<<bitRes)>>1 - qthetaOffset
+						ndof := 2*n - 1
+						if n == 2 {
+							ndof--
+						}
+						num := scale * (maxBits + ndof*offset)
+						den := ndof<<9 - scale
+						maxBits += min((num+den>>1)/den, limit)
+					}
+					ndof := ch * n
+					if ch == 2 && n > 2 {
+						ndof++
+					}
+					offset := (celtLogN[j]+i<<bitRes)>>1 - celtFineOffset
+					if n == 2 {
+						offset += 1 << bitRes >> 2
+					}
+					num := maxBits + ndof*offset
+					den := (ndof - 1) << bitRes
+					maxBits += ch * min((num+den>>1)/den, celtMaxFine) << bitRes
+				}
+				c.caps[at] = 4*maxBits/(ch*((celtEBands[j+1]-celtEBands[j])<<uint(i))) - 64
+				at++
+			}
+		}
+	}
+}
+
+// pulseBits returns the cost table for band i split down to log2 block count lm, indexed by pseudo-pulses.
+func (c *celtPulseCache) pulseBits(i, lm int) []int {
+	return c.bits[c.index[(lm+1)*celtBands+i]:]
+}
+
+// bits2pulses returns the number of pseudo-pulses whose cost is the closest to bits.
+func (c *celtPulseCache) bits2pulses(i, lm, bits int) int {
+	cache := c.pulseBits(i, lm)
+	lo, hi := 0, cache[0]
+	bits--
+	for range celtLogMaxPsd {
+		mid := (lo + hi + 1) >> 1
+		if cache[mid] >= bits {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	loBits := -1
+	if lo != 0 {
+		loBits = cache[lo]
+	}
+	if bits-loBits <= cache[hi]-bits {
+		return lo
+	}
+	return hi
+}
+
+// pulses2bits returns the cost of coding q pseudo-pulses.
+func (c *celtPulseCache) pulses2bits(i, lm, q int) int {
+	if q == 0 {
+		return 0
+	}
+	return c.pulseBits(i, lm)[q] + 1
+}
+
+// celtCaps returns the maximum bits each band of a mono frame can use, in 1/8 bits.
+func celtCaps() [celtBands]int {
+	var caps [celtBands]int
+	for i := range caps {
+		n := (celtEBands[i+1] - celtEBands[i]) << celtLM
+		caps[i] = (celtCache.caps[celtBands*(2*celtLM)+i] + 64) * n >> 2
+	}
+	return caps
+}
+
+// celtAllocation holds the bit allocation of a mono frame.
+type celtAllocation struct {
+	codedBands   int
+	balance      int
+	pulses       [celtBands]int // bits for the PVQ of each band, in 1/8 bits
+	fineBits     [celtBands]int
+	finePriority [celtBands]int
+}
+
+// celtComputeAllocation splits total 1/8 bits between the bands, coding the band skipping decisions (RFC 6716,
+// section 4.3.3). Bands from prevCoded on are skipped with some hysteresis.
+func celtComputeAllocation(enc *rangeEncoder, end int, caps *[celtBands]int, trim, total, prevCoded int) *celtAllocation {
+	const c = 1
+	total = max(total, 0)
+	skipStart := 0
+	skipRsv := 0
+	if total >= 1<<bitRes {
+		skipRsv = 1 << bitRes
+	}
+	total -= skipRsv
+
+	var thresh, trimOffset, bits1, bits2 [celtBands]int
+	for j := 0; j < end; j++ {
+		width := celtEBands[j+1] - celtEBands[j]
+		thresh[j] = max(c<<bitRes, (3*width<<celtLM<<bitRes)>>4)
+		trimOffset[j] = c * width * (trim - 5 - celtLM) * (end - j - 1) * (1 << (celtLM + bitRes)) >> 6
+		if width<<celtLM == 1 {
+			trimOffset[j] -= c << bitRes
+		}
+	}
+	lo, hi := 1, len(celtAllocVectors)-1
+	for lo <= hi {
+		done := false
+		psum := 0
+		mid := (lo + hi) >> 1
+		for j := end - 1; j >= 0; j-- {
+			width := celtEBands[j+1] - celtEBands[j]
+			bitsj := c * width * celtAllocVectors[mid][j] << celtLM >> 2
+			if bitsj > 0 {
+				bitsj = max(0, bitsj+trimOffset[j])
+			}
+			if bitsj >= thresh[j] || done {
+				done = true
+				psum += min(bitsj, caps[j])
+			} else if bitsj >= c<<bitRes {
+				psum += c << bitRes
+			}
+		}
+		if psum > total {
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+	hi = lo
+	lo--
+	for j := 0; j < end; j++ {
+		width := celtEBands[j+1] - celtEBands[j]
+		bits1j := c * width * celtAllocVectors[lo][j] << celtLM >> 2
+		bits2j := caps[j]
+		if hi < len(celtAllocVectors) {
+			bits2j = c * width * celtAllocVectors[hi][j] << celtLM >> 2
+		}
+		if bits1j > 0 {
+			bits1j = max(0, bits1j+trimOffset[j])
+		}
+		if bits2j > 0 {
+			bits2j = max(0, bits2j+trimOffset[j])
+		}
+		bits1[j] = bits1j
+		bits2[j] = max(0, bits2j-bits1j)
+	}
+	return celtInterpBits2Pulses(enc, end, skipStart, &bits1, &bits2, &thresh, caps, total, skipRsv, prevCoded)
+}
+
+func celtInterpBits2Pulses(enc *rangeEncoder, end, skipStart int, bits1, bits2, thresh, caps *[celtBands]int,
+	total, skipRsv, prevCoded int) *celtAllocation {
+	const c = 1
+	allocFloor := c << bitRes
+	logM := celtLM << bitRes
+	a := &celtAllocation{}
+	bits := &a.pulses
+
+	lo, hi := 0, 1<<celtAllocSteps
+	for range celtAllocSteps {
+		mid := (lo + hi) >> 1
+		psum := 0
+		done := false
+		for j := end - 1; j >= 0; j-- {
+			tmp := bits1[j] + (mid * bits2[j] >> celtAllocSteps)
+			if tmp >= thresh[j] || done {
+				done = true
+				psum += min(tmp, caps[j])
+			} else if tmp >= allocFloor {
+				psum += allocFloor
+			}
+		}
+		if psum > total {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	psum := 0
+	done := false
+	for j := end - 1; j >= 0; j-- {
+		tmp := bits1[j] + (lo * bits2[j] >> celtAllocSteps)
+		if tmp < thresh[j] && !done {
+			if tmp >= allocFloor {
+				tmp = allocFloor
+			} else {
+				tmp = 0
+			}
+		} else {
+			done = true
+		}
+		tmp = min(tmp, caps[j])
+		bits[j] = tmp
+		psum += tmp
+	}
+
+	// Decide which bands to skip, working backwards from the end
+	codedBands := end
+	for ; ; codedBands-- {
+		j := codedBands - 1
+		if j <= skipStart {
+			total += skipRsv
+			break
+		}
+		left := total - psum
+		percoeff := left / celtEBands[codedBands]
+		left -= celtEBands[codedBands] * percoeff
+		rem := max(left-celtEBands[j], 0)
+		bandWidth := celtEBands[codedBands] - celtEBands[j]
+		bandBits := bits[j] + percoeff*bandWidth + rem
+		if bandBits >= max(thresh[j], allocFloor+1<<bitRes) {
+			depthThreshold := 0
+			if codedBands > 17 {
+				depthThreshold = 9
+				if j < prevCoded {
+					depthThreshold = 7
+				}
+			}
+			if codedBands <= 2 || bandBits > (depthThreshold*bandWidth<<celtLM<<bitRes)>>4 {
+				enc.bitLogP(true, 1)
+				break
+			}
+			enc.bitLogP(false, 1)
+			psum += 1 << bitRes
+			bandBits -= 1 << bitRes
+		}
+		psum -= bits[j]
+		if bandBits >= allocFloor {
+			psum += allocFloor
+			bits[j] = allocFloor
+		} else {
+			bits[j] = 0
+		}
+	}
+	a.codedBands = codedBands
+
+	// Allocate the remaining bits
+	left := total - psum
+	percoeff := left / celtEBands[codedBands]
+	left -= celtEBands[codedBands] * percoeff
+	for j := 0; j < codedBands; j++ {
+		bits[j] += percoeff * (celtEBands[j+1] - celtEBands[j])
+	}
+	for j := 0; j < codedBands; j++ {
+		tmp := min(left, celtEBands[j+1]-celtEBands[j])
+		bits[j] += tmp
+		left -= tmp
+	}
+
+	balance := 0
+	j := 0
+	for ; j < codedBands; j++ {
+		n := (celtEBands[j+1] - celtEBands[j]) << celtLM
+		bit := bits[j] + balance
+		var excess int
+		if n > 1 {
+			excess = max(bit-caps[j], 0)
+			bits[j] = bit - excess
+			den := c * n
+			nclogn := den * (celtLogN[j] + logM)
+			offset := nclogn>>1 - den*celtFineOffset
+			if n == 2 {
+				offset += den << bitRes >> 2
+			}
+			if bits[j]+offset < den*2<<bitRes {
+				offset += nclogn >> 2
+			} else if bits[j]+offset < den*3<<bitRes {
+				offset += nclogn >> 3
+			}
+			ebits := max(0, bits[j]+offset+den<<(bitRes-1))
+			ebits = ebits / den >> bitRes
+			if c*ebits > bits[j]>>bitRes {
+				ebits = bits[j] >> bitRes
+			}
+			ebits = min(ebits, celtMaxFine)
+			a.fineBits[j] = ebits
+			a.finePriority[j] = b2i(ebits*(den<<bitRes) >= bits[j]+offset)
+			bits[j] -= c * ebits << bitRes
+		} else {
+			excess = max(0, bit-c<<bitRes)
+			bits[j] = bit - excess
+			a.fineBits[j] = 0
+			a.finePriority[j] = 1
+		}
+		if excess > 0 {
+			extraFine := min(excess>>bitRes, celtMaxFine-a.fineBits[j])
+			a.fineBits[j] += extraFine
+			extraBits := extraFine * c << bitRes
+			a.finePriority[j] = b2i(extraBits >= excess-balance)
+			excess -= extraBits
+		}
+		balance = excess
+	}
+	a.balance = balance
+
+	// The skipped bands use all their bits for fine energy
+	for ; j < end; j++ {
+		a.fineBits[j] = bits[j] >> bitRes
+		bits[j] = 0
+		a.finePriority[j] = b2i(a.fineBits[j] < 1)
+	}
+	return a
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+package audio
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// dct4 computes DCT-IV transforms of a fixed even size with a complex FFT of half the size.
+type dct4 struct {
+	n          int
+	pre, post  []complex128
+	fft        *fft
+	buf, spect []complex128
+}
+
+func newDCT4(n int) *dct4 {
+	d := &dct4{
+		n:     n,
+		pre:   make([]complex128, n/2),
+		post:  make([]complex128, n/2),
+		fft:   newFFT(n / 2),
+		buf:   make([]complex128, n/2),
+		spect: make([]complex128, n/2),
+	}
+	for i := range d.pre {
+		d.pre[i] = cmplx.Exp(complex(0, -math.Pi*float64(4*i+1)/float64(4*n)))
+		d.post[i] = cmplx.Exp(complex(0, -math.Pi*float64(i)/float64(n)))
+	}
+	return d
+}
+
+// transform sets out[k] to the sum of in[m] cos(pi/n (m+1/2) (k+1/2)).
+func (d *dct4) transform(in, out []float64) {
+	n := d.n
+	for i := range d.buf {
+		d.buf[i] = complex(in[2*i], in[n-1-2*i]) * d.pre[i]
+	}
+	d.fft.transform(d.buf, d.spect)
+	for k, c := range d.spect {
+		c *= d.post[k]
+		out[2*k] = real(c)
+		out[n-1-2*k] = -imag(c)
+	}
+}
+
+// fft is a mixed radix FFT, for sizes whose prime factors are small.
+type fft struct {
+	n       int
+	factors []int
+	twiddle []complex128
+	scratch []complex128
+}
+
+func newFFT(n int) *fft {
+	f := &fft{n: n, twiddle: make([]complex128, n), scratch: make([]complex128, n)}
+	for i := range f.twiddle {
+		f.twiddle[i] = cmplx.Exp(complex(0, -2*math.Pi*float64(i)/float64(n)))
+	}
+	for m := n; m > 1; {
+		p := 2
+		for m%p != 0 {
+			p++
+		}
+		f.factors = append(f.factors, p)
+		m /= p
+	}
+	return f
+}
+
+// transform sets out to the unscaled forward DFT of in.
+func (f *fft) transform(in, out []complex128) {
+	f.step(in, out, f.scratch, 1, f.factors)
+}
+
+// step computes the DFT of the len(out) samples of in taken every stride, by decimation in time.
+func (f *fft) step(in, out, scratch []complex128, stride int, factors []int) {
+	m := len(out)
+	if m == 1 {
+		out[0] = in[0]
+		return
+	}
+	p := factors[0]
+	sub := m / p
+	// Transform each of the p interleaved subsequences into consecutive parts of scratch
+	for r := range p {
+		f.step(in[r*stride:], scratch[r*sub:(r+1)*sub], out[r*sub:(r+1)*sub], stride*p, factors[1:])
+	}
+	tw := f.n / m
+	for k := range sub {
+		for q := range p {
+			var acc complex128
+			for r := range p {
+				acc += scratch[r*sub+k] * f.twiddle[(r*(k+q*sub)*tw)%f.n]
+			}
+			out[k+q*sub] = acc
+		}
+	}
+}
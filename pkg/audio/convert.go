@@ -0,0 +1,318 @@
+package audio
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// transformBufferSize is the amount of input read at once by the conversions.
+const transformBufferSize = 16384
+
+// transformReader reads whole frames from the source stream and passes their samples through a conversion
+// function, which is called one last time with final set once the source is exhausted.
+type transformReader struct {
+	src       io.Reader
+	frameSize int
+	decode    func(dst []int16, b []byte) []int16
+	convert   func(in []int16, final bool) []int16
+
+	buf     []byte
+	partial int
+	samples []int16
+	out     []byte
+	pending []byte
+	done    bool
+	err     error
+}
+
+func newTransform(src *Stream, convert func(in []int16, final bool) []int16) *transformReader {
+	return &transformReader{
+		src:       src.Reader,
+		frameSize: src.Format.FrameSize(),
+		decode:    decoderFor(src.Format),
+		convert:   convert,
+		buf:       make([]byte, transformBufferSize),
+	}
+}
+
+// decoderFor returns the function that decodes samples in the given format to 16-bit linear.
+func decoderFor(format Format) func(dst []int16, b []byte) []int16 {
+	switch format.Encoding {
+	case EncodingULaw:
+		return func(dst []int16, b []byte) []int16 {
+			for _, v := range b {
+				dst = append(dst, DecodeULaw(v))
+			}
+			return dst
+		}
+	case EncodingALaw:
+		return func(dst []int16, b []byte) []int16 {
+			for _, v := range b {
+				dst = append(dst, DecodeALaw(v))
+			}
+			return dst
+		}
+	default:
+		return int16Samples
+	}
+}
+
+func (t *transformReader) Read(p []byte) (int, error) {
+	for len(t.pending) == 0 {
+		if t.done {
+			return 0, t.err
+		}
+		n, err := t.src.Read(t.buf[t.partial:])
+		n += t.partial
+		whole := n - n%t.frameSize
+		t.samples = t.decode(t.samples[:0], t.buf[:whole])
+		t.partial = copy(t.buf, t.buf[whole:n])
+
+		final := false
+		if err == io.EOF {
+			final, t.done, t.err = true, true, io.EOF
+		} else if err != nil {
+			t.done, t.err = true, err
+			return 0, err
+		}
+		t.out = int16Bytes(t.out[:0], t.convert(t.samples, final))
+		t.pending = t.out
+	}
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+// ToPCM16 converts G.711 streams to 16-bit linear samples. 16-bit linear streams are returned as is.
+func ToPCM16(src *Stream) (*Stream, error) {
+	if src.Format.IsPCM16() {
+		return src, nil
+	}
+	switch src.Format.Encoding {
+	case EncodingULaw, EncodingALaw:
+		if src.Format.BitsPerSample != 8 {
+			return nil, fmt.Errorf("unsupported %s sample size %d", src.Format.Encoding, src.Format.BitsPerSample)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported sample format %s, %d bits", src.Format.Encoding, src.Format.BitsPerSample)
+	}
+	identity := func(in []int16, final bool) []int16 { return in }
+	return NewStream(newTransform(src, identity), PCM16(src.Format.SampleRate, src.Format.Channels), src), nil
+}
+
+// ConvertChannels mixes a stereo stream down to mono, or duplicates a mono stream to stereo.
+func ConvertChannels(src *Stream, channels uint16) (*Stream, error) {
+	from := src.Format.Channels
+	if from == channels {
+		return src, nil
+	}
+	src, err := ToPCM16(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []int16
+	var convert func(in []int16, final bool) []int16
+	switch {
+	case from == 2 && channels == 1:
+		convert = func(in []int16, final bool) []int16 {
+			out = out[:0]
+			for i := 0; i+1 < len(in); i += 2 {
+				out = append(out, int16((int32(in[i])+int32(in[i+1]))/2))
+			}
+			return out
+		}
+	case from == 1 && channels == 2:
+		convert = func(in []int16, final bool) []int16 {
+			out = out[:0]
+			for _, s := range in {
+				out = append(out, s, s)
+			}
+			return out
+		}
+	default:
+		return nil, fmt.Errorf("unsupported channel conversion from %d to %d", from, channels)
+	}
+	return NewStream(newTransform(src, convert), PCM16(src.Format.SampleRate, channels), src), nil
+}
+
+// Resampling filter parameters: the windowed sinc spans resampleTaps zero crossings on each side, and is
+// tabulated with resamplePhases points between zero crossings.
+const (
+	resampleTaps   = 16
+	resamplePhases = 256
+)
+
+// resampleKernel is the right half of a Blackman-windowed sinc.
+var resampleKernel = func() []float64 {
+	kernel := make([]float64, resampleTaps*resamplePhases+1)
+	for i := range kernel {
+		x := float64(i) / resamplePhases
+		sinc := 1.0
+		if x != 0 {
+			sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+		}
+		w := float64(i)/float64(len(kernel)-1)*0.5 + 0.5 // position in the full window, from the center
+		window := 0.42 - 0.5*math.Cos(2*math.Pi*w) + 0.08*math.Cos(4*math.Pi*w)
+		kernel[i] = sinc * window
+	}
+	return kernel
+}()
+
+// resampler converts the sample rate of interleaved samples with band-limited interpolation.
+type resampler struct {
+	channels int
+	step     float64 // step is the distance between output samples, in input samples
+	scale    float64 // scale is the cutoff frequency relative to the input Nyquist frequency
+	width    int     // width is the number of input samples on each side of an output sample
+
+	history [][]float64 // history holds the input samples still needed, for each channel
+	pos     float64     // pos is the position of the next output sample in history
+	inputs  int64
+	outputs int64
+	out     []int16
+}
+
+func newResampler(channels int, from, to uint32) *resampler {
+	scale := min(1, float64(to)/float64(from))
+	width := int(math.Ceil(resampleTaps / scale))
+	r := &resampler{
+		channels: channels,
+		step:     float64(from) / float64(to),
+		scale:    scale,
+		width:    width,
+		history:  make([][]float64, channels),
+		pos:      float64(width),
+	}
+	// Leading silence, so that the first output sample has a full window
+	for c := range r.history {
+		r.history[c] = make([]float64, width)
+	}
+	return r
+}
+
+func (r *resampler) kernel(x float64) float64 {
+	x = math.Abs(x) * r.scale * resamplePhases
+	i := int(x)
+	if i >= len(resampleKernel)-1 {
+		return 0
+	}
+	frac := x - float64(i)
+	return resampleKernel[i] + (resampleKernel[i+1]-resampleKernel[i])*frac
+}
+
+func (r *resampler) convert(in []int16, final bool) []int16 {
+	for i, s := range in {
+		r.history[i%r.channels] = append(r.history[i%r.channels], float64(s))
+	}
+	r.inputs += int64(len(in) / r.channels)
+
+	expected := int64(-1)
+	if final {
+		// Trailing silence, so that the last output samples have a full window
+		expected = int64(math.Ceil(float64(r.inputs) / r.step))
+		for c := range r.history {
+			r.history[c] = append(r.history[c], make([]float64, r.width+1)...)
+		}
+	}
+
+	r.out = r.out[:0]
+	available := len(r.history[0])
+	for int(r.pos)+r.width < available && (expected < 0 || r.outputs < expected) {
+		center := int(r.pos)
+		frac := r.pos - float64(center)
+		for c := 0; c < r.channels; c++ {
+			h := r.history[c]
+			var acc float64
+			for j := center - r.width + 1; j <= center+r.width; j++ {
+				acc += h[j] * r.kernel(float64(j-center)-frac)
+			}
+			acc *= r.scale
+			r.out = append(r.out, int16(max(math.MinInt16, min(math.MaxInt16, math.Round(acc)))))
+		}
+		r.outputs++
+		r.pos += r.step
+	}
+
+	// Drop the samples no longer needed by the window
+	if drop := int(r.pos) - r.width; drop > 0 {
+		for c := range r.history {
+			r.history[c] = append(r.history[c][:0], r.history[c][drop:]...)
+		}
+		r.pos -= float64(drop)
+	}
+	return r.out
+}
+
+// Resample converts the stream to the given sample rate.
+func Resample(src *Stream, sampleRate uint32) (*Stream, error) {
+	if src.Format.SampleRate == sampleRate {
+		return src, nil
+	}
+	if sampleRate == 0 || src.Format.SampleRate == 0 {
+		return nil, fmt.Errorf("invalid resampling from %d Hz to %d Hz", src.Format.SampleRate, sampleRate)
+	}
+	src, err := ToPCM16(src)
+	if err != nil {
+		return nil, err
+	}
+	r := newResampler(int(src.Format.Channels), src.Format.SampleRate, sampleRate)
+	return NewStream(newTransform(src, r.convert), PCM16(sampleRate, src.Format.Channels), src), nil
+}
+
+// Convert converts the stream to the given format, which must be 16-bit linear or G.711.
+func Convert(src *Stream, format Format) (*Stream, error) {
+	if src.Format == format {
+		return src, nil
+	}
+	stream, err := ConvertChannels(src, format.Channels)
+	if err != nil {
+		return nil, err
+	}
+	if stream, err = Resample(stream, format.SampleRate); err != nil {
+		return nil, err
+	}
+	if stream, err = ToPCM16(stream); err != nil {
+		return nil, err
+	}
+	switch {
+	case format.IsPCM16():
+		return stream, nil
+	case format.Encoding == EncodingULaw || format.Encoding == EncodingALaw:
+		encode := EncodeULaw
+		if format.Encoding == EncodingALaw {
+			encode = EncodeALaw
+		}
+		return NewStream(&g711Encoder{src: stream, encode: encode}, format, stream), nil
+	default:
+		return nil, fmt.Errorf("unsupported sample format %s, %d bits", format.Encoding, format.BitsPerSample)
+	}
+}
+
+// g711Encoder compands a 16-bit linear stream.
+type g711Encoder struct {
+	src     io.Reader
+	encode  func(int16) byte
+	buf     []byte
+	partial int
+}
+
+func (g *g711Encoder) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if cap(g.buf) < 2*len(p) {
+		old := g.buf[:g.partial]
+		g.buf = make([]byte, 2*len(p))
+		copy(g.buf, old)
+	}
+	n, err := g.src.Read(g.buf[g.partial : 2*len(p)])
+	n += g.partial
+	whole := n - n%2
+	for i := 0; i < whole; i += 2 {
+		p[i/2] = g.encode(int16(uint16(g.buf[i]) | uint16(g.buf[i+1])<<8))
+	}
+	g.partial = copy(g.buf, g.buf[whole:n])
+	return whole / 2, err
+}
@@ -0,0 +1,132 @@
+package audio
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"slices"
+	"testing"
+)
+
+func pcmStream(samples []int16, format Format) *Stream {
+	return NewStream(bytes.NewReader(int16Bytes(nil, samples)), format, nil)
+}
+
+func readSamples(t *testing.T, stream *Stream) []int16 {
+	t.Helper()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("error reading stream: %v", err)
+	}
+	if len(data)%stream.Format.FrameSize() != 0 {
+		t.Fatalf("read %d bytes, not a whole number of %d-byte frames", len(data), stream.Format.FrameSize())
+	}
+	return int16Samples(nil, data)
+}
+
+func TestResample(t *testing.T) {
+	tests := []struct {
+		from, to uint32
+		channels uint16
+		frames   int
+	}{
+		{22050, 48000, 1, 22050},
+		{48000, 16000, 1, 48001},
+		{44100, 32000, 2, 10000},
+		{8000, 11025, 2, 7},
+		{24000, 24000, 1, 100},
+	}
+	for _, tt := range tests {
+		var channels [][]int16
+		for range tt.channels {
+			channels = append(channels, twoTones(tt.frames, tt.from))
+		}
+		// Read the input in small pieces, so that the conversion is done over many calls
+		src := pcmStream(interleave(channels...), PCM16(tt.from, tt.channels))
+		src.Reader = &oneByteReader{src.Reader}
+
+		stream, err := Resample(src, tt.to)
+		if err != nil {
+			t.Fatalf("Resample(%d, %d) error: %v", tt.from, tt.to, err)
+		}
+		if want := PCM16(tt.to, tt.channels); stream.Format != want {
+			t.Errorf("Resample(%d, %d) format = %+v, want %+v", tt.from, tt.to, stream.Format, want)
+		}
+		got := readSamples(t, stream)
+		wantFrames := int(math.Ceil(float64(tt.frames) * float64(tt.to) / float64(tt.from)))
+		if len(got) != wantFrames*int(tt.channels) {
+			t.Errorf("Resample(%d, %d) of %d frames = %d frames, want %d", tt.from, tt.to, tt.frames, len(got)/int(tt.channels), wantFrames)
+			continue
+		}
+
+		// The tones are well below both Nyquist frequencies, so they come out unchanged, but for the edges where
+		// the filter sees the silence around the input
+		want := twoTones(wantFrames, tt.to)
+		edge := 64
+		if wantFrames <= 2*edge {
+			continue
+		}
+		for c := range int(tt.channels) {
+			var channel []int16
+			for i := c; i < len(got); i += int(tt.channels) {
+				channel = append(channel, got[i])
+			}
+			if s := snr(channel[edge:wantFrames-edge], want[edge:wantFrames-edge]); s < 40 {
+				t.Errorf("Resample(%d, %d) channel %d SNR = %.1f dB, want at least 40 dB", tt.from, tt.to, c, s)
+			}
+		}
+	}
+}
+
+func TestConvertChannels(t *testing.T) {
+	left, right := []int16{0, 100, -100, 32767, -32768}, []int16{0, 300, 100, 32767, -32767}
+	stream, err := ConvertChannels(pcmStream(interleave(left, right), PCM16(8000, 2)), 1)
+	if err != nil {
+		t.Fatalf("ConvertChannels() error: %v", err)
+	}
+	if got, want := readSamples(t, stream), []int16{0, 200, 0, 32767, -32767}; !slices.Equal(got, want) {
+		t.Errorf("stereo to mono = %v, want %v", got, want)
+	}
+
+	if stream, err = ConvertChannels(pcmStream(left, PCM16(8000, 1)), 2); err != nil {
+		t.Fatalf("ConvertChannels() error: %v", err)
+	}
+	if got, want := readSamples(t, stream), interleave(left, left); !slices.Equal(got, want) {
+		t.Errorf("mono to stereo = %v, want %v", got, want)
+	}
+}
+
+func TestConvertG711(t *testing.T) {
+	samples := twoTones(300, 8000)
+	for _, encoding := range []Encoding{EncodingULaw, EncodingALaw} {
+		format := Format{Encoding: encoding, Channels: 1, SampleRate: 8000, BitsPerSample: 8}
+		companded, err := Convert(pcmStream(samples, PCM16(8000, 1)), format)
+		if err != nil {
+			t.Fatalf("Convert(%s) error: %v", encoding, err)
+		}
+		linear, err := ToPCM16(NewStream(companded, format, nil))
+		if err != nil {
+			t.Fatalf("ToPCM16(%s) error: %v", encoding, err)
+		}
+		got := readSamples(t, linear)
+		if len(got) != len(samples) {
+			t.Fatalf("%s round trip = %d samples, want %d", encoding, len(got), len(samples))
+		}
+		// G.711 keeps about 38 dB of SNR over its range
+		if s := snr(got, samples); s < 30 {
+			t.Errorf("%s round trip SNR = %.1f dB, want at least 30 dB", encoding, s)
+		}
+	}
+}
+
+// oneByteReader reads at most a byte at a time.
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
@@ -0,0 +1,86 @@
+package audio
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// NewEncoderFunc creates an encoder that writes samples of the given format to w. Closing the encoder flushes it,
+// without closing w.
+type NewEncoderFunc func(w io.Writer, format Format) (io.WriteCloser, error)
+
+var encoders = map[string]NewEncoderFunc{
+	"wav":  NewWAVEncoder,
+	"flac": NewFLACEncoder,
+	"opus": NewOpusEncoder,
+}
+
+// Encoders lists the names of the formats that can be encoded in-process.
+func Encoders() []string {
+	names := make([]string, 0, len(encoders))
+	for name := range encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasEncoder tells whether the format can be encoded in-process.
+func HasEncoder(name string) bool {
+	_, ok := encoders[name]
+	return ok
+}
+
+// NewEncoder creates an encoder for the named format.
+func NewEncoder(name string, w io.Writer, format Format) (io.WriteCloser, error) {
+	newEncoder, ok := encoders[name]
+	if !ok {
+		return nil, fmt.Errorf("no encoder for format %s", name)
+	}
+	return newEncoder(w, format)
+}
+
+// Encode returns a reader of the stream encoded in the named format. The encoder converts G.711 samples to linear.
+// Closing the reader stops the encoding and closes the stream.
+func Encode(src *Stream, name string) (io.ReadCloser, error) {
+	stream := src
+	if name != "wav" {
+		var err error
+		if stream, err = ToPCM16(src); err != nil {
+			return nil, err
+		}
+	}
+	// Check the format beforehand, since the encoder blocks writing its header until the output is read
+	if _, err := NewEncoder(name, io.Discard, stream.Format); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := NewEncoder(name, pw, stream.Format)
+		if err != nil {
+			_ = stream.Close()
+			_ = pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(enc, stream)
+		if cErr := enc.Close(); err == nil {
+			err = cErr
+		}
+		_ = stream.Close()
+		_ = pw.CloseWithError(err)
+	}()
+	return &encodedStream{PipeReader: pr, src: stream}, nil
+}
+
+// encodedStream closes the source stream along with the reader, so that a producer blocked on the source stops.
+type encodedStream struct {
+	*io.PipeReader
+	src io.Closer
+}
+
+func (s *encodedStream) Close() error {
+	err := s.PipeReader.Close()
+	_ = s.src.Close()
+	return err
+}
@@ -0,0 +1,463 @@
+package audio
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+)
+
+// flacBlockSize is the number of samples per channel in each FLAC frame.
+const flacBlockSize = 4096
+
+// flacMaxPartitionOrder bounds the number of Rice partitions, 2^order, of the residuals.
+const flacMaxPartitionOrder = 6
+
+// flacEncoder encodes 16-bit linear samples as FLAC, using the fixed linear predictors and Rice coding, with
+// stereo decorrelation. Since the output is streamed, the total length and MD5 signature in the stream header
+// are only filled in on Close if the destination is seekable.
+type flacEncoder struct {
+	w      io.Writer
+	format Format
+
+	buf     []byte
+	frame   uint64
+	samples uint64
+	md5     hash.Hash
+
+	minFrameSize, maxFrameSize int
+	bw                         bitWriter
+	residual                   []int32
+}
+
+// NewFLACEncoder returns an encoder that writes 16-bit linear samples, with up to 8 channels, as a FLAC stream.
+func NewFLACEncoder(w io.Writer, format Format) (io.WriteCloser, error) {
+	if !format.IsPCM16() {
+		return nil, fmt.Errorf("unsupported FLAC input format %s, %d bits", format.Encoding, format.BitsPerSample)
+	}
+	if format.Channels == 0 || format.Channels > 8 {
+		return nil, fmt.Errorf("unsupported FLAC channel count %d", format.Channels)
+	}
+	if format.SampleRate == 0 || format.SampleRate >= 1<<20 {
+		return nil, fmt.Errorf("unsupported FLAC sample rate %d", format.SampleRate)
+	}
+	e := &flacEncoder{w: w, format: format, md5: md5.New(), minFrameSize: math.MaxInt}
+	if _, err := w.Write(e.streamHeader()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// streamHeader returns the "fLaC" marker followed by the STREAMINFO metadata block.
+func (e *flacEncoder) streamHeader() []byte {
+	var bw bitWriter
+	bw.writeBytes([]byte("fLaC"))
+	bw.writeBits(1, 1) // last metadata block
+	bw.writeBits(0, 7) // STREAMINFO
+	bw.writeBits(34, 24)
+	bw.writeBits(flacBlockSize, 16)
+	bw.writeBits(flacBlockSize, 16)
+	if e.samples > 0 {
+		bw.writeBits(uint64(e.minFrameSize), 24)
+		bw.writeBits(uint64(e.maxFrameSize), 24)
+	} else {
+		bw.writeBits(0, 48) // unknown frame sizes
+	}
+	bw.writeBits(uint64(e.format.SampleRate), 20)
+	bw.writeBits(uint64(e.format.Channels-1), 3)
+	bw.writeBits(15, 5) // 16 bits per sample
+	bw.writeBits(e.samples, 36)
+	if e.samples > 0 {
+		bw.writeBytes(e.md5.Sum(nil))
+	} else {
+		bw.writeBytes(make([]byte, md5.Size))
+	}
+	return bw.bytes()
+}
+
+func (e *flacEncoder) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	blockBytes := flacBlockSize * e.format.FrameSize()
+	offset := 0
+	for len(e.buf)-offset >= blockBytes {
+		if err := e.writeFrame(e.buf[offset : offset+blockBytes]); err != nil {
+			return 0, err
+		}
+		offset += blockBytes
+	}
+	e.buf = append(e.buf[:0], e.buf[offset:]...)
+	return len(p), nil
+}
+
+func (e *flacEncoder) Close() error {
+	if len(e.buf) >= e.format.FrameSize() {
+		if err := e.writeFrame(e.buf[:len(e.buf)-len(e.buf)%e.format.FrameSize()]); err != nil {
+			return err
+		}
+	}
+	e.buf = nil
+
+	ws, ok := e.w.(io.WriteSeeker)
+	if !ok || e.samples == 0 {
+		return nil
+	}
+	if _, err := ws.Seek(0, io.SeekStart); err != nil {
+		// Not actually seekable, i.e. a pipe
+		return nil
+	}
+	if _, err := ws.Write(e.streamHeader()); err != nil {
+		return err
+	}
+	_, err := ws.Seek(0, io.SeekEnd)
+	return err
+}
+
+// Channel assignments of a frame
+const (
+	flacLeftSide  = 8
+	flacRightSide = 9
+	flacMidSide   = 10
+)
+
+func (e *flacEncoder) writeFrame(data []byte) error {
+	e.md5.Write(data)
+	channels := int(e.format.Channels)
+	blockSize := len(data) / e.format.FrameSize()
+
+	samples := make([][]int32, channels)
+	for c := range channels {
+		samples[c] = make([]int32, blockSize)
+	}
+	for i := 0; i < blockSize; i++ {
+		for c := range channels {
+			samples[c][i] = int32(int16(binary.LittleEndian.Uint16(data[(i*channels+c)*2:])))
+		}
+	}
+
+	// For stereo, pick the cheapest among independent, left/side, right/side and mid/side
+	assignment := uint64(channels - 1)
+	subframes := samples
+	bits := make([]int, channels)
+	for c := range bits {
+		bits[c] = 16
+	}
+	if channels == 2 {
+		left, right := samples[0], samples[1]
+		mid, side := make([]int32, blockSize), make([]int32, blockSize)
+		for i := range blockSize {
+			mid[i] = (left[i] + right[i]) >> 1
+			side[i] = left[i] - right[i]
+		}
+		leftCost, rightCost := e.estimate(left, 16), e.estimate(right, 16)
+		midCost, sideCost := e.estimate(mid, 16), e.estimate(side, 17)
+		best := leftCost + rightCost
+		if cost := leftCost + sideCost; cost < best {
+			best, assignment, subframes, bits = cost, flacLeftSide, [][]int32{left, side}, []int{16, 17}
+		}
+		if cost := sideCost + rightCost; cost < best {
+			best, assignment, subframes, bits = cost, flacRightSide, [][]int32{side, right}, []int{17, 16}
+		}
+		if cost := midCost + sideCost; cost < best {
+			assignment, subframes, bits = flacMidSide, [][]int32{mid, side}, []int{16, 17}
+		}
+	}
+
+	bw := &e.bw
+	bw.reset()
+	bw.writeBits(0xFFF8, 16) // sync code, fixed block size
+	if blockSize == flacBlockSize {
+		bw.writeBits(0b1100, 4)
+	} else {
+		bw.writeBits(0b0111, 4) // 16-bit block size at the end of the header
+	}
+	bw.writeBits(flacSampleRateCode(e.format.SampleRate), 4)
+	bw.writeBits(assignment, 4)
+	bw.writeBits(0b100, 3) // 16 bits per sample
+	bw.writeBits(0, 1)
+	bw.writeUTF8(e.frame)
+	if blockSize != flacBlockSize {
+		bw.writeBits(uint64(blockSize-1), 16)
+	}
+	bw.writeBits(uint64(crc8(bw.bytes())), 8)
+
+	for c, s := range subframes {
+		e.writeSubframe(s, bits[c])
+	}
+	bw.align()
+	bw.writeBits(uint64(crc16(bw.bytes())), 16)
+
+	frame := bw.bytes()
+	e.frame++
+	e.samples += uint64(blockSize)
+	e.minFrameSize = min(e.minFrameSize, len(frame))
+	e.maxFrameSize = max(e.maxFrameSize, len(frame))
+	_, err := e.w.Write(frame)
+	return err
+}
+
+func flacSampleRateCode(rate uint32) uint64 {
+	switch rate {
+	case 8000:
+		return 0b0100
+	case 16000:
+		return 0b0101
+	case 22050:
+		return 0b0110
+	case 24000:
+		return 0b0111
+	case 32000:
+		return 0b1000
+	case 44100:
+		return 0b1001
+	case 48000:
+		return 0b1010
+	case 96000:
+		return 0b1011
+	default:
+		return 0 // from STREAMINFO
+	}
+}
+
+// fixedResidual computes the residual of the fixed predictor of the given order.
+func fixedResidual(dst []int32, s []int32, order int) []int32 {
+	dst = dst[:0]
+	for i := order; i < len(s); i++ {
+		var r int32
+		switch order {
+		case 0:
+			r = s[i]
+		case 1:
+			r = s[i] - s[i-1]
+		case 2:
+			r = s[i] - 2*s[i-1] + s[i-2]
+		case 3:
+			r = s[i] - 3*s[i-1] + 3*s[i-2] - s[i-3]
+		case 4:
+			r = s[i] - 4*s[i-1] + 6*s[i-2] - 4*s[i-3] + s[i-4]
+		}
+		dst = append(dst, r)
+	}
+	return dst
+}
+
+// bestFixedOrder returns the fixed predictor order with the smallest residual, and the cost in bits of the
+// subframe using it.
+func (e *flacEncoder) bestFixedOrder(s []int32, bits int) (int, int) {
+	bestOrder, bestCost := -1, math.MaxInt
+	for order := 0; order <= min(4, len(s)-1); order++ {
+		e.residual = fixedResidual(e.residual, s, order)
+		_, cost := riceCost(e.residual, len(s), order)
+		cost += order * bits
+		if cost < bestCost {
+			bestOrder, bestCost = order, cost
+		}
+	}
+	return bestOrder, bestCost
+}
+
+// estimate returns the size in bits of the subframe that encodes the samples.
+func (e *flacEncoder) estimate(s []int32, bits int) int {
+	_, cost := e.bestFixedOrder(s, bits)
+	return min(cost, len(s)*bits)
+}
+
+func (e *flacEncoder) writeSubframe(s []int32, bits int) {
+	bw := &e.bw
+	constant := true
+	for _, v := range s[1:] {
+		if v != s[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		bw.writeBits(0b00000000, 8)
+		bw.writeSigned(s[0], bits)
+		return
+	}
+
+	order, cost := e.bestFixedOrder(s, bits)
+	if order < 0 || cost >= len(s)*bits {
+		bw.writeBits(0b00000010, 8) // verbatim
+		for _, v := range s {
+			bw.writeSigned(v, bits)
+		}
+		return
+	}
+
+	bw.writeBits(uint64(0b00010000|order<<1), 8) // fixed predictor
+	for _, v := range s[:order] {
+		bw.writeSigned(v, bits)
+	}
+	e.residual = fixedResidual(e.residual, s, order)
+	partitionOrder, _ := riceCost(e.residual, len(s), order)
+	bw.writeBits(0, 2) // Rice coding with 4-bit parameters
+	bw.writeBits(uint64(partitionOrder), 4)
+	partitions := 1 << partitionOrder
+	start := 0
+	for p := range partitions {
+		n := len(s) >> partitionOrder
+		if p == 0 {
+			n -= order
+		}
+		part := e.residual[start : start+n]
+		start += n
+		k := riceParameter(part)
+		bw.writeBits(uint64(k), 4)
+		for _, r := range part {
+			u := uint64(uint32(r<<1) ^ uint32(r>>31))
+			bw.writeUnary(u >> k)
+			bw.writeBits(u&(1<<k-1), k)
+		}
+	}
+}
+
+// riceParameter returns the Rice parameter that codes the residuals in the fewest bits.
+func riceParameter(residual []int32) int {
+	var sum uint64
+	for _, r := range residual {
+		sum += uint64(uint32(r<<1) ^ uint32(r>>31))
+	}
+	best, bestCost := 0, uint64(math.MaxUint64)
+	for k := 0; k <= 14; k++ {
+		cost := uint64(len(residual))*uint64(k+1) + sum>>k
+		if cost < bestCost {
+			best, bestCost = k, cost
+		}
+	}
+	return best
+}
+
+// riceCost returns the best partition order for the residuals of a block, and the cost in bits of the
+// residual section. The cost of each partition is estimated from the sum of its values.
+func riceCost(residual []int32, blockSize, order int) (int, int) {
+	bestOrder, bestCost := 0, math.MaxInt
+	for partitionOrder := 0; partitionOrder <= flacMaxPartitionOrder; partitionOrder++ {
+		if blockSize%(1<<partitionOrder) != 0 || blockSize>>partitionOrder <= order {
+			break
+		}
+		cost := 6
+		start := 0
+		for p := range 1 << partitionOrder {
+			n := blockSize >> partitionOrder
+			if p == 0 {
+				n -= order
+			}
+			part := residual[start : start+n]
+			start += n
+			k := riceParameter(part)
+			var sum uint64
+			for _, r := range part {
+				sum += uint64(uint32(r<<1) ^ uint32(r>>31))
+			}
+			cost += 4 + n*(k+1) + int(sum>>k)
+		}
+		if cost < bestCost {
+			bestOrder, bestCost = partitionOrder, cost
+		}
+	}
+	return bestOrder, bestCost
+}
+
+// bitWriter accumulates big-endian bit fields.
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) reset() {
+	b.buf = b.buf[:0]
+	b.acc = 0
+	b.nbits = 0
+}
+
+func (b *bitWriter) writeBits(v uint64, n int) {
+	for n > 0 {
+		chunk := min(n, 32)
+		n -= chunk
+		b.acc = b.acc<<chunk | (v>>n)&(1<<chunk-1)
+		b.nbits += uint(chunk)
+		for b.nbits >= 8 {
+			b.nbits -= 8
+			b.buf = append(b.buf, byte(b.acc>>b.nbits))
+		}
+	}
+}
+
+func (b *bitWriter) writeSigned(v int32, n int) {
+	b.writeBits(uint64(v)&(1<<n-1), n)
+}
+
+func (b *bitWriter) writeUnary(q uint64) {
+	for ; q >= 32; q -= 32 {
+		b.writeBits(0, 32)
+	}
+	b.writeBits(1, int(q)+1)
+}
+
+func (b *bitWriter) writeBytes(p []byte) {
+	for _, v := range p {
+		b.writeBits(uint64(v), 8)
+	}
+}
+
+// writeUTF8 writes the frame number with the UTF-8-like variable length coding of FLAC.
+func (b *bitWriter) writeUTF8(v uint64) {
+	if v < 0x80 {
+		b.writeBits(v, 8)
+		return
+	}
+	n := 2
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	b.writeBits((0xFF00>>n)&0xFF|v>>(6*(n-1)), 8)
+	for i := n - 2; i >= 0; i-- {
+		b.writeBits(0x80|(v>>(6*i))&0x3F, 8)
+	}
+}
+
+// align pads the last byte with zeros.
+func (b *bitWriter) align() {
+	if b.nbits > 0 {
+		b.writeBits(0, int(8-b.nbits))
+	}
+}
+
+// bytes returns the complete bytes written so far.
+func (b *bitWriter) bytes() []byte {
+	return b.buf
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, v := range data {
+		crc ^= v
+		for range 8 {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, v := range data {
+		crc ^= uint16(v) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,390 @@
+package audio
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// bitReader reads big-endian bit fields.
+type bitReader struct {
+	data []byte
+	pos  int // position in bits
+}
+
+func (b *bitReader) read(n int) (uint64, error) {
+	if b.pos+n > 8*len(b.data) {
+		return 0, errors.New("unexpected end of data")
+	}
+	var v uint64
+	for range n {
+		v = v<<1 | uint64(b.data[b.pos/8]>>(7-b.pos%8)&1)
+		b.pos++
+	}
+	return v, nil
+}
+
+func (b *bitReader) readSigned(n int) (int32, error) {
+	v, err := b.read(n)
+	return int32(int64(v<<(64-n)) >> (64 - n)), err
+}
+
+func (b *bitReader) readUnary() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := b.read(1)
+		if err != nil || bit == 1 {
+			return q, err
+		}
+		q++
+	}
+}
+
+// flacStream is a decoded FLAC stream.
+type flacStream struct {
+	format  Format
+	total   uint64
+	md5     []byte
+	samples []int16 // interleaved
+}
+
+// decodeFLAC decodes the subset of FLAC written by the encoder: fixed predictors and Rice coding, without
+// escaped partitions or wasted bits, checking the frame numbers and CRCs.
+func decodeFLAC(data []byte) (*flacStream, error) {
+	if !bytes.HasPrefix(data, []byte("fLaC")) {
+		return nil, errors.New("missing fLaC marker")
+	}
+	br := &bitReader{data: data, pos: 32}
+	fields := []int{1, 7, 24, 16, 16, 24, 24, 20, 3, 5, 36}
+	values := make([]uint64, len(fields))
+	for i, n := range fields {
+		values[i], _ = br.read(n)
+	}
+	if values[0] != 1 || values[1] != 0 || values[2] != 34 {
+		return nil, fmt.Errorf("expected a single STREAMINFO block, got last %d, type %d, size %d", values[0], values[1], values[2])
+	}
+	s := &flacStream{
+		format: PCM16(uint32(values[7]), uint16(values[8]+1)),
+		total:  values[10],
+		md5:    data[br.pos/8 : br.pos/8+md5.Size],
+	}
+	if values[9] != 15 {
+		return nil, fmt.Errorf("unexpected sample size %d", values[9]+1)
+	}
+	br.pos += 8 * md5.Size
+
+	for frame := uint64(0); br.pos < 8*len(data); frame++ {
+		if err := s.decodeFrame(br, frame); err != nil {
+			return nil, fmt.Errorf("frame %d: %w", frame, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *flacStream) decodeFrame(br *bitReader, frame uint64) error {
+	start := br.pos / 8
+	if sync, _ := br.read(16); sync != 0xFFF8 {
+		return fmt.Errorf("invalid sync code %#x", sync)
+	}
+	blockCode, _ := br.read(4)
+	rateCode, _ := br.read(4)
+	assignment, _ := br.read(4)
+	sizeCode, _ := br.read(3)
+	if reserved, _ := br.read(1); sizeCode != 0b100 || reserved != 0 {
+		return fmt.Errorf("unexpected sample size code %d", sizeCode)
+	}
+	if want := flacSampleRateCode(s.format.SampleRate); rateCode != want {
+		return fmt.Errorf("sample rate code %d, want %d", rateCode, want)
+	}
+	number, err := readFLACUTF8(br)
+	if err != nil {
+		return err
+	}
+	if number != frame {
+		return fmt.Errorf("frame number %d", number)
+	}
+	blockSize := flacBlockSize
+	switch blockCode {
+	case 0b1100:
+	case 0b0111:
+		v, _ := br.read(16)
+		blockSize = int(v) + 1
+	default:
+		return fmt.Errorf("unexpected block size code %d", blockCode)
+	}
+	crc := crc8(br.data[start : br.pos/8])
+	if v, _ := br.read(8); byte(v) != crc {
+		return fmt.Errorf("header CRC %#x, want %#x", v, crc)
+	}
+
+	channels := int(s.format.Channels)
+	bits := make([]int, channels)
+	for c := range bits {
+		bits[c] = 16
+	}
+	switch {
+	case assignment == flacLeftSide || assignment == flacMidSide:
+		bits[1] = 17
+	case assignment == flacRightSide:
+		bits[0] = 17
+	case int(assignment) != channels-1:
+		return fmt.Errorf("channel assignment %d for %d channels", assignment, channels)
+	}
+	subframes := make([][]int32, channels)
+	for c := range subframes {
+		if subframes[c], err = decodeFLACSubframe(br, blockSize, bits[c]); err != nil {
+			return fmt.Errorf("subframe %d: %w", c, err)
+		}
+	}
+	for i := range blockSize {
+		switch assignment {
+		case flacLeftSide:
+			subframes[1][i] = subframes[0][i] - subframes[1][i]
+		case flacRightSide:
+			subframes[0][i] += subframes[1][i]
+		case flacMidSide:
+			mid, side := subframes[0][i]<<1|subframes[1][i]&1, subframes[1][i]
+			subframes[0][i], subframes[1][i] = (mid+side)>>1, (mid-side)>>1
+		}
+	}
+
+	if br.pos%8 != 0 {
+		if pad, _ := br.read(8 - br.pos%8); pad != 0 {
+			return errors.New("non-zero padding")
+		}
+	}
+	frameCRC := crc16(br.data[start : br.pos/8])
+	if v, _ := br.read(16); uint16(v) != frameCRC {
+		return fmt.Errorf("frame CRC %#x, want %#x", v, frameCRC)
+	}
+	for i := range blockSize {
+		for c := range channels {
+			s.samples = append(s.samples, int16(subframes[c][i]))
+		}
+	}
+	return nil
+}
+
+func readFLACUTF8(br *bitReader) (uint64, error) {
+	first, err := br.read(8)
+	if err != nil || first < 0x80 {
+		return first, err
+	}
+	n := 0
+	for first&(0x80>>n) != 0 {
+		n++
+	}
+	v := first & (0x7F >> n)
+	for range n - 1 {
+		b, _ := br.read(8)
+		if b&0xC0 != 0x80 {
+			return 0, fmt.Errorf("invalid frame number continuation byte %#x", b)
+		}
+		v = v<<6 | b&0x3F
+	}
+	return v, nil
+}
+
+func decodeFLACSubframe(br *bitReader, blockSize, bits int) ([]int32, error) {
+	header, err := br.read(8)
+	if err != nil {
+		return nil, err
+	}
+	if header&0x81 != 0 {
+		return nil, fmt.Errorf("invalid subframe header %#x, or wasted bits", header)
+	}
+	s := make([]int32, 0, blockSize)
+	kind := header >> 1
+	switch {
+	case kind == 0: // constant
+		v, err := br.readSigned(bits)
+		for range blockSize {
+			s = append(s, v)
+		}
+		return s, err
+	case kind == 1: // verbatim
+		for range blockSize {
+			v, err := br.readSigned(bits)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+		}
+		return s, nil
+	case kind >= 8 && kind <= 12: // fixed predictor
+	default:
+		return nil, fmt.Errorf("unexpected subframe type %#x", kind)
+	}
+
+	order := int(kind - 8)
+	for range order {
+		v, err := br.readSigned(bits)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, v)
+	}
+	if method, _ := br.read(2); method != 0 {
+		return nil, fmt.Errorf("unexpected residual coding method %d", method)
+	}
+	partitionOrder, _ := br.read(4)
+	for p := range 1 << partitionOrder {
+		n := blockSize >> partitionOrder
+		if p == 0 {
+			n -= order
+		}
+		k, _ := br.read(4)
+		if k == 15 {
+			return nil, errors.New("unexpected escaped partition")
+		}
+		for range n {
+			q, err := br.readUnary()
+			if err != nil {
+				return nil, err
+			}
+			low, err := br.read(int(k))
+			if err != nil {
+				return nil, err
+			}
+			u := q<<k | low
+			r := int32(u>>1) ^ -int32(u&1)
+			i := len(s)
+			var prediction int32
+			switch order {
+			case 1:
+				prediction = s[i-1]
+			case 2:
+				prediction = 2*s[i-1] - s[i-2]
+			case 3:
+				prediction = 3*s[i-1] - 3*s[i-2] + s[i-3]
+			case 4:
+				prediction = 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+			}
+			s = append(s, prediction+r)
+		}
+	}
+	return s, nil
+}
+
+func TestFLACRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	noise := func(n int) []int16 {
+		s := make([]int16, n)
+		for i := range s {
+			s[i] = int16(rnd.IntN(65536) - 32768)
+		}
+		return s
+	}
+	// More than two blocks, so that the last block is short
+	const frames = 2*flacBlockSize + 1000
+	tones := twoTones(frames, 32000)
+	silence := make([]int16, frames)
+	inverted := make([]int16, frames)
+	for i, s := range tones {
+		inverted[i] = -s
+	}
+	// Vary the signal from block to block, so that each stereo decorrelation and subframe type is used
+	varied := func(blocks ...[]int16) []int16 {
+		var s []int16
+		for i := range frames {
+			s = append(s, blocks[i/flacBlockSize][i])
+		}
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		rate     uint32
+		channels [][]int16
+	}{
+		{"mono", 32000, [][]int16{tones}},
+		{"mono noise and silence", 16000, [][]int16{varied(noise(frames), silence, tones)}},
+		{"stereo", 44100, [][]int16{tones, varied(tones, inverted, noise(frames))}},
+		{"stereo uncommon rate", 11025, [][]int16{varied(tones, silence, tones), varied(silence, tones, tones)}},
+		{"short", 8000, [][]int16{tones[:1], tones[:1]}},
+		{"three channels", 48000, [][]int16{tones, inverted, silence}},
+		// Frame numbers from 128 on take two bytes
+		{"many frames", 8000, [][]int16{twoTones(130*flacBlockSize, 8000)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := PCM16(tt.rate, uint16(len(tt.channels)))
+			samples := interleave(tt.channels...)
+			data := int16Bytes(nil, samples)
+
+			var file seekBuffer
+			enc, err := NewFLACEncoder(&file, format)
+			if err != nil {
+				t.Fatalf("NewFLACEncoder() error: %v", err)
+			}
+			// Write in pieces that do not match the blocks or even the frames
+			for chunk := slices.Clip(data); len(chunk) > 0; {
+				n := min(len(chunk), 1+rnd.IntN(10000))
+				if _, err := enc.Write(chunk[:n]); err != nil {
+					t.Fatalf("Write() error: %v", err)
+				}
+				chunk = chunk[n:]
+			}
+			if err := enc.Close(); err != nil {
+				t.Fatalf("Close() error: %v", err)
+			}
+
+			decoded, err := decodeFLAC(file.data)
+			if err != nil {
+				t.Fatalf("decodeFLAC() error: %v", err)
+			}
+			if decoded.format != format {
+				t.Errorf("format = %+v, want %+v", decoded.format, format)
+			}
+			if decoded.total != uint64(len(tt.channels[0])) {
+				t.Errorf("total samples = %d, want %d", decoded.total, len(tt.channels[0]))
+			}
+			if sum := md5.Sum(data); !bytes.Equal(decoded.md5, sum[:]) {
+				t.Errorf("MD5 = %x, want %x", decoded.md5, sum)
+			}
+			if !slices.Equal(decoded.samples, samples) {
+				t.Errorf("decoded samples differ from the input")
+			}
+		})
+	}
+}
+
+func TestFLACStreamed(t *testing.T) {
+	samples := twoTones(5000, 22050)
+	var out bytes.Buffer
+	enc, err := NewFLACEncoder(&out, PCM16(22050, 1))
+	if err != nil {
+		t.Fatalf("NewFLACEncoder() error: %v", err)
+	}
+	_, _ = enc.Write(int16Bytes(nil, samples))
+	_ = enc.Close()
+
+	decoded, err := decodeFLAC(out.Bytes())
+	if err != nil {
+		t.Fatalf("decodeFLAC() error: %v", err)
+	}
+	// Without seeking, the total length and signature are left unknown
+	if decoded.total != 0 || !bytes.Equal(decoded.md5, make([]byte, md5.Size)) {
+		t.Errorf("total samples = %d, MD5 = %x, want them unknown", decoded.total, decoded.md5)
+	}
+	if !slices.Equal(decoded.samples, samples) {
+		t.Errorf("decoded samples differ from the input")
+	}
+}
+
+func TestFLACEncoderFormats(t *testing.T) {
+	for _, format := range []Format{
+		{Encoding: EncodingULaw, Channels: 1, SampleRate: 8000, BitsPerSample: 8},
+		PCM16(16000, 0),
+		PCM16(16000, 9),
+		PCM16(0, 1),
+	} {
+		if _, err := NewFLACEncoder(&bytes.Buffer{}, format); err == nil {
+			t.Errorf("NewFLACEncoder(%+v) succeeded, want an error", format)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package audio
+
+// EncodeULaw encodes a sample with G.711 mu-law.
+func EncodeULaw(sample int16) byte {
+	const bias = 0x84
+	const clip = 32635
+
+	s := int(sample)
+	sign := 0
+	if s < 0 {
+		sign = 0x80
+		s = -s
+	}
+	s = min(s, clip) + bias
+
+	exponent := 7
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (s >> (exponent + 3)) & 0x0F
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+// DecodeULaw decodes a G.711 mu-law sample.
+func DecodeULaw(b byte) int16 {
+	b = ^b
+	exponent := int(b>>4) & 0x07
+	s := ((int(b&0x0F) << 3) + 0x84) << exponent
+	s -= 0x84
+	if b&0x80 != 0 {
+		return int16(-s)
+	}
+	return int16(s)
+}
+
+// EncodeALaw encodes a sample with G.711 A-law.
+func EncodeALaw(sample int16) byte {
+	s := int(sample) >> 3 // A-law works on 13-bit samples
+	sign := 0x80
+	if s < 0 {
+		sign = 0
+		s = -s - 1
+	}
+	s = min(s, 0xFFF)
+
+	var encoded int
+	if s < 32 {
+		encoded = s >> 1
+	} else {
+		exponent := 1
+		for v := s >> 5; v > 1; v >>= 1 {
+			exponent++
+		}
+		encoded = exponent<<4 | (s>>exponent)&0x0F
+	}
+	return byte(sign|encoded) ^ 0x55
+}
+
+// DecodeALaw decodes a G.711 A-law sample.
+func DecodeALaw(b byte) int16 {
+	b ^= 0x55
+	exponent := int(b>>4) & 0x07
+	mantissa := int(b & 0x0F)
+	var s int
+	if exponent == 0 {
+		s = mantissa<<4 + 8
+	} else {
+		s = (mantissa<<4 + 0x108) << (exponent - 1)
+	}
+	if b&0x80 == 0 {
+		return int16(-s)
+	}
+	return int16(s)
+}
@@ -0,0 +1,73 @@
+package audio
+
+import "testing"
+
+func TestULaw(t *testing.T) {
+	decodes := []struct {
+		code byte
+		want int16
+	}{
+		{0x00, -32124}, {0x0F, -16764}, {0x7E, -8}, {0x7F, 0},
+		{0x80, 32124}, {0x8F, 16764}, {0xFE, 8}, {0xFF, 0},
+	}
+	for _, tt := range decodes {
+		if got := DecodeULaw(tt.code); got != tt.want {
+			t.Errorf("DecodeULaw(%#02x) = %d, want %d", tt.code, got, tt.want)
+		}
+	}
+
+	encodes := []struct {
+		sample int16
+		want   byte
+	}{
+		{0, 0xFF}, {-1, 0x7F}, {8, 0xFE}, {-8, 0x7E}, {1000, 0xCE}, {-1000, 0x4E},
+		{32124, 0x80}, {32767, 0x80}, {-32768, 0x00},
+	}
+	for _, tt := range encodes {
+		if got := EncodeULaw(tt.sample); got != tt.want {
+			t.Errorf("EncodeULaw(%d) = %#02x, want %#02x", tt.sample, got, tt.want)
+		}
+	}
+
+	for code := range 256 {
+		if code == 0x7F {
+			continue // negative zero, encoded back as positive zero
+		}
+		if got := EncodeULaw(DecodeULaw(byte(code))); got != byte(code) {
+			t.Errorf("EncodeULaw(DecodeULaw(%#02x)) = %#02x", code, got)
+		}
+	}
+}
+
+func TestALaw(t *testing.T) {
+	decodes := []struct {
+		code byte
+		want int16
+	}{
+		{0x55, -8}, {0xD5, 8}, {0x5A, -248}, {0xDA, 248}, {0x40, -344}, {0xC0, 344}, {0x2A, -32256}, {0xAA, 32256},
+	}
+	for _, tt := range decodes {
+		if got := DecodeALaw(tt.code); got != tt.want {
+			t.Errorf("DecodeALaw(%#02x) = %d, want %d", tt.code, got, tt.want)
+		}
+	}
+
+	encodes := []struct {
+		sample int16
+		want   byte
+	}{
+		{0, 0xD5}, {-1, 0x55}, {8, 0xD5}, {-8, 0x55}, {248, 0xDA}, {-248, 0x5A}, {344, 0xC0}, {-344, 0x40},
+		{32256, 0xAA}, {32767, 0xAA}, {-32768, 0x2A},
+	}
+	for _, tt := range encodes {
+		if got := EncodeALaw(tt.sample); got != tt.want {
+			t.Errorf("EncodeALaw(%d) = %#02x, want %#02x", tt.sample, got, tt.want)
+		}
+	}
+
+	for code := range 256 {
+		if got := EncodeALaw(DecodeALaw(byte(code))); got != byte(code) {
+			t.Errorf("EncodeALaw(DecodeALaw(%#02x)) = %#02x", code, got)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Ogg page header flags.
+const (
+	oggBOS = 0x02
+	oggEOS = 0x04
+)
+
+// oggCRCTable is the table of the CRC-32 of Ogg pages, with the polynomial 0x04C11DB7, unreflected.
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for range 8 {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+// oggWriter writes packets of a single logical stream as Ogg pages (RFC 3533).
+type oggWriter struct {
+	w        io.Writer
+	serial   uint32
+	sequence uint32
+	packets  [][]byte
+	segments int
+	granule  int64 // granule position at the end of the last queued packet
+}
+
+// oggMaxSegments is the maximum number of lacing values in a page.
+const oggMaxSegments = 255
+
+func oggSegments(packet []byte) int {
+	return len(packet)/255 + 1
+}
+
+// add queues a packet ending at the granule position for the next page, writing the pending page first if the
+// packet does not fit.
+func (o *oggWriter) add(packet []byte, granule int64) error {
+	if o.segments+oggSegments(packet) > oggMaxSegments {
+		if err := o.flush(0); err != nil {
+			return err
+		}
+	}
+	o.packets = append(o.packets, packet)
+	o.segments += oggSegments(packet)
+	o.granule = granule
+	return nil
+}
+
+// flush writes the queued packets as a page.
+func (o *oggWriter) flush(flags byte) error {
+	if o.sequence == 0 {
+		flags |= oggBOS
+	}
+	header := make([]byte, 27, 27+o.segments)
+	copy(header, "OggS")
+	header[5] = flags
+	binary.LittleEndian.PutUint64(header[6:], uint64(o.granule))
+	binary.LittleEndian.PutUint32(header[14:], o.serial)
+	binary.LittleEndian.PutUint32(header[18:], o.sequence)
+	header[26] = byte(o.segments)
+	size := 0
+	for _, p := range o.packets {
+		for n := len(p); ; n -= 255 {
+			if n < 255 {
+				header = append(header, byte(n))
+				break
+			}
+			header = append(header, 255)
+		}
+		size += len(p)
+	}
+	page := make([]byte, 0, len(header)+size)
+	page = append(page, header...)
+	for _, p := range o.packets {
+		page = append(page, p...)
+	}
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+
+	o.sequence++
+	o.packets = o.packets[:0]
+	o.segments = 0
+	_, err := o.w.Write(page)
+	return err
+}
@@ -0,0 +1,158 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+)
+
+// Opus stream parameters: the samples are resampled to 48 kHz and coded as 20 ms CELT frames of a constant
+// 64 kbit/s.
+const (
+	opusSampleRate = 48000
+	opusFrameBytes = 160
+	opusPreSkip    = celtOverlap // delay of the transform, in samples
+	opusPageFrames = 10          // frames per Ogg page, so that streamed audio is flushed every 200 ms
+	opusVendor     = "loq7tts-server"
+)
+
+// opusEncoder encodes mono 16-bit linear samples as an Ogg/Opus stream (RFC 7845), using only the CELT layer of
+// Opus.
+type opusEncoder struct {
+	w      io.Writer
+	format Format
+
+	ogg       oggWriter
+	celt      *celtEncoder
+	toc       byte
+	resampler *resampler
+
+	buf     []byte    // bytes of an incomplete input sample
+	pcm     []float64 // 48 kHz samples not yet coded
+	samples int64     // 48 kHz samples received
+	frames  int64
+}
+
+// NewOpusEncoder returns an encoder that writes mono 16-bit linear samples as an Ogg/Opus stream.
+func NewOpusEncoder(w io.Writer, format Format) (io.WriteCloser, error) {
+	if !format.IsPCM16() {
+		return nil, fmt.Errorf("unsupported Opus input format %s, %d bits", format.Encoding, format.BitsPerSample)
+	}
+	if format.Channels != 1 {
+		return nil, fmt.Errorf("unsupported Opus channel count %d", format.Channels)
+	}
+	if format.SampleRate == 0 {
+		return nil, fmt.Errorf("unsupported Opus sample rate %d", format.SampleRate)
+	}
+	// Code the bands up to the Nyquist frequency of the input, with the matching Opus bandwidth
+	bands, config := 21, 31 // fullband, 20 kHz
+	switch {
+	case format.SampleRate <= 8000:
+		bands, config = 13, 19 // narrowband, 4 kHz
+	case format.SampleRate <= 16000:
+		bands, config = 17, 23 // wideband, 8 kHz
+	case format.SampleRate <= 24000:
+		bands, config = 19, 27 // super-wideband, 12 kHz
+	}
+	e := &opusEncoder{
+		w:      w,
+		format: format,
+		ogg:    oggWriter{w: w, serial: rand.Uint32()},
+		celt:   newCeltEncoder(bands, opusFrameBytes),
+		toc:    byte(config << 3), // mono, one frame
+	}
+	if format.SampleRate != opusSampleRate {
+		e.resampler = newResampler(1, format.SampleRate, opusSampleRate)
+	}
+	if err := e.writeHeaders(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// writeHeaders writes the identification and comment headers, each on its own page.
+func (e *opusEncoder) writeHeaders() error {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = 1 // channels
+	binary.LittleEndian.PutUint16(head[10:], opusPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], e.format.SampleRate)
+	// Output gain and channel mapping family 0 are left zero
+	if err := e.ogg.add(head, 0); err != nil {
+		return err
+	}
+	if err := e.ogg.flush(0); err != nil {
+		return err
+	}
+
+	tags := make([]byte, 0, 16+len(opusVendor))
+	tags = append(tags, "OpusTags"...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(opusVendor)))
+	tags = append(tags, opusVendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0) // no user comments
+	if err := e.ogg.add(tags, 0); err != nil {
+		return err
+	}
+	return e.ogg.flush(0)
+}
+
+func (e *opusEncoder) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	whole := len(e.buf) - len(e.buf)%2
+	samples := int16Samples(make([]int16, 0, whole/2), e.buf[:whole])
+	e.buf = append(e.buf[:0], e.buf[whole:]...)
+	if err := e.encode(samples, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// encode resamples the samples and codes the complete frames.
+func (e *opusEncoder) encode(samples []int16, final bool) error {
+	if e.resampler != nil {
+		samples = e.resampler.convert(samples, final)
+	}
+	for _, s := range samples {
+		e.pcm = append(e.pcm, float64(s))
+	}
+	e.samples += int64(len(samples))
+	for len(e.pcm) >= celtFrameSize {
+		if err := e.encodeFrame(e.pcm[:celtFrameSize]); err != nil {
+			return err
+		}
+		e.pcm = e.pcm[:copy(e.pcm, e.pcm[celtFrameSize:])]
+		if e.frames%opusPageFrames == 0 {
+			if err := e.ogg.flush(0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *opusEncoder) encodeFrame(pcm []float64) error {
+	packet := append([]byte{e.toc}, e.celt.encode(pcm)...)
+	e.frames++
+	return e.ogg.add(packet, e.frames*celtFrameSize)
+}
+
+// Close codes the remaining samples, followed by silence until the decoder has output all of them, and writes the
+// last page, whose granule position tells the decoder to drop the padding.
+func (e *opusEncoder) Close() error {
+	if err := e.encode(nil, true); err != nil {
+		return err
+	}
+	end := opusPreSkip + e.samples
+	// There are always samples left to pad, since the decoder output lags the input by the pre-skip
+	for e.frames*celtFrameSize < end {
+		e.pcm = append(e.pcm, make([]float64, celtFrameSize-len(e.pcm))...)
+		if err := e.encodeFrame(e.pcm); err != nil {
+			return err
+		}
+		e.pcm = e.pcm[:0]
+	}
+	e.ogg.granule = end
+	return e.ogg.flush(oggEOS)
+}
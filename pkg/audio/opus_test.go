@@ -0,0 +1,285 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// oggPage is a parsed Ogg page, with the packets that end in it.
+type oggPage struct {
+	flags    byte
+	granule  int64
+	serial   uint32
+	sequence uint32
+	packets  [][]byte
+}
+
+// oggCRC computes the CRC of a page bit by bit, independently of the table of the writer.
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc ^= uint32(b) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// readOggPages parses a stream of Ogg pages, checking their structure and CRCs.
+func readOggPages(data []byte) ([]oggPage, error) {
+	var pages []oggPage
+	var packet []byte
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" || data[4] != 0 {
+			return nil, fmt.Errorf("page %d: invalid header", len(pages))
+		}
+		headerSize := 27 + int(data[26])
+		if len(data) < headerSize {
+			return nil, fmt.Errorf("page %d: truncated segment table", len(pages))
+		}
+		size := headerSize
+		for _, lacing := range data[27:headerSize] {
+			size += int(lacing)
+		}
+		if len(data) < size {
+			return nil, fmt.Errorf("page %d: truncated body", len(pages))
+		}
+		raw := bytes.Clone(data[:size])
+		binary.LittleEndian.PutUint32(raw[22:], 0)
+		if got, want := binary.LittleEndian.Uint32(data[22:]), oggCRC(raw); got != want {
+			return nil, fmt.Errorf("page %d: CRC %#08x, want %#08x", len(pages), got, want)
+		}
+
+		page := oggPage{
+			flags:    data[5],
+			granule:  int64(binary.LittleEndian.Uint64(data[6:])),
+			serial:   binary.LittleEndian.Uint32(data[14:]),
+			sequence: binary.LittleEndian.Uint32(data[18:]),
+		}
+		if page.flags&0x01 != 0 {
+			return nil, fmt.Errorf("page %d: unexpected continued packet", len(pages))
+		}
+		body := data[headerSize:size]
+		for _, lacing := range data[27:headerSize] {
+			packet = append(packet, body[:lacing]...)
+			body = body[lacing:]
+			if lacing < 255 {
+				page.packets = append(page.packets, packet)
+				packet = nil
+			}
+		}
+		pages = append(pages, page)
+		data = data[size:]
+	}
+	if packet != nil {
+		return nil, errors.New("unterminated packet at the end of the stream")
+	}
+	return pages, nil
+}
+
+// encodeOpus encodes the mono samples with the in-process encoder, writing them in pieces of odd sizes.
+func encodeOpus(t *testing.T, samples []int16, rate uint32) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	enc, err := NewOpusEncoder(&out, PCM16(rate, 1))
+	if err != nil {
+		t.Fatalf("NewOpusEncoder() error: %v", err)
+	}
+	data := int16Bytes(nil, samples)
+	for len(data) > 0 {
+		n := min(len(data), 1001)
+		if _, err := enc.Write(data[:n]); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+		data = data[n:]
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	return out.Bytes()
+}
+
+// opusLength returns the number of samples the decoder outputs at 48 kHz for n input samples.
+func opusLength(n int, rate uint32) int64 {
+	return int64(math.Ceil(float64(n) * opusSampleRate / float64(rate)))
+}
+
+func TestOpusStream(t *testing.T) {
+	tests := []struct {
+		rate   uint32
+		config byte
+	}{
+		{8000, 19},
+		{11025, 23},
+		{16000, 23},
+		{22050, 27},
+		{24000, 27},
+		{32000, 31},
+		{48000, 31},
+	}
+	for _, tt := range tests {
+		for _, n := range []int{0, 1, int(tt.rate)*7/10 + 13, int(tt.rate) * 3} {
+			t.Run(fmt.Sprintf("%d Hz %d samples", tt.rate, n), func(t *testing.T) {
+				pages, err := readOggPages(encodeOpus(t, twoTones(n, tt.rate), tt.rate))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(pages) < 3 {
+					t.Fatalf("got %d pages, want headers and audio", len(pages))
+				}
+				for i, page := range pages {
+					if page.serial != pages[0].serial || page.sequence != uint32(i) {
+						t.Errorf("page %d: serial %#x, sequence %d", i, page.serial, page.sequence)
+					}
+					var flags byte
+					if i == 0 {
+						flags = oggBOS
+					} else if i == len(pages)-1 {
+						flags = oggEOS
+					}
+					if page.flags != flags {
+						t.Errorf("page %d: flags %#x, want %#x", i, page.flags, flags)
+					}
+				}
+
+				// Headers, each alone on its page
+				for i, magic := range []string{"OpusHead", "OpusTags"} {
+					if len(pages[i].packets) != 1 || !bytes.HasPrefix(pages[i].packets[0], []byte(magic)) || pages[i].granule != 0 {
+						t.Fatalf("page %d: %d packets at granule %d, want a single %s packet at 0", i, len(pages[i].packets), pages[i].granule, magic)
+					}
+				}
+				head := pages[0].packets[0]
+				if len(head) != 19 || head[8] != 1 || head[9] != 1 || head[18] != 0 {
+					t.Errorf("OpusHead %x: want version 1, 1 channel, mapping family 0", head)
+				}
+				if preSkip := binary.LittleEndian.Uint16(head[10:]); preSkip != opusPreSkip {
+					t.Errorf("pre-skip = %d, want %d", preSkip, opusPreSkip)
+				}
+				if rate := binary.LittleEndian.Uint32(head[12:]); rate != tt.rate {
+					t.Errorf("input sample rate = %d, want %d", rate, tt.rate)
+				}
+				if gain := binary.LittleEndian.Uint16(head[16:]); gain != 0 {
+					t.Errorf("output gain = %d, want 0", gain)
+				}
+				tags := pages[1].packets[0]
+				if vendor := binary.LittleEndian.Uint32(tags[8:]); len(tags) != 16+int(vendor) || binary.LittleEndian.Uint32(tags[12+vendor:]) != 0 {
+					t.Errorf("OpusTags %q: want a vendor string and no comments", tags)
+				}
+
+				// Audio pages, flushed every opusPageFrames frames of 20 ms, but for the last
+				frames := int64(0)
+				for i, page := range pages[2:] {
+					last := i == len(pages)-3
+					if !last && len(page.packets) != opusPageFrames {
+						t.Errorf("audio page %d: %d packets, want %d", i, len(page.packets), opusPageFrames)
+					}
+					for _, packet := range page.packets {
+						if len(packet) < 3 || len(packet) > 1+opusFrameBytes || packet[0] != tt.config<<3 {
+							t.Fatalf("audio page %d: packet of %d bytes with TOC %#x, want mono config %d and at most %d bytes",
+								i, len(packet), packet[0], tt.config, 1+opusFrameBytes)
+						}
+					}
+					frames += int64(len(page.packets))
+					if !last && page.granule != frames*celtFrameSize {
+						t.Errorf("audio page %d: granule %d, want %d", i, page.granule, frames*celtFrameSize)
+					}
+				}
+				// The last granule position trims the padding of the last frame
+				end := pages[len(pages)-1].granule
+				if want := opusPreSkip + opusLength(n, tt.rate); end != want {
+					t.Errorf("end granule = %d, want %d", end, want)
+				}
+				if end > frames*celtFrameSize || end <= (frames-1)*celtFrameSize {
+					t.Errorf("end granule %d for %d frames: want it in the last frame", end, frames)
+				}
+			})
+		}
+	}
+}
+
+func TestOpusSilence(t *testing.T) {
+	pages, err := readOggPages(encodeOpus(t, make([]int16, 48000), 48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range pages[2:] {
+		for _, packet := range page.packets {
+			// Silent frames are coded in a single byte, padded to two so as not to signal a lost frame
+			if len(packet) != 3 {
+				t.Fatalf("silent packet of %d bytes, want 3", len(packet))
+			}
+		}
+	}
+}
+
+func TestOpusEncoderFormats(t *testing.T) {
+	for _, format := range []Format{
+		PCM16(48000, 2),
+		PCM16(48000, 0),
+		PCM16(0, 1),
+		{Encoding: EncodingALaw, Channels: 1, SampleRate: 8000, BitsPerSample: 8},
+	} {
+		if _, err := NewOpusEncoder(io.Discard, format); err == nil {
+			t.Errorf("NewOpusEncoder(%+v) succeeded, want an error", format)
+		}
+	}
+}
+
+// TestOpusReferenceDecoder decodes the output with opusdec, from opus-tools and libopus, when it is installed.
+func TestOpusReferenceDecoder(t *testing.T) {
+	opusdec, err := exec.LookPath("opusdec")
+	if err != nil {
+		t.Skip("opusdec not found")
+	}
+	for _, rate := range []uint32{8000, 16000, 24000, 48000} {
+		t.Run(fmt.Sprintf("%d Hz", rate), func(t *testing.T) {
+			n := int(rate)*2 + 77
+			dir := t.TempDir()
+			in, out := filepath.Join(dir, "in.opus"), filepath.Join(dir, "out.wav")
+			if err := os.WriteFile(in, encodeOpus(t, twoTones(n, rate), rate), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(opusdec, "--quiet", "--no-dither", "--force-wav", "--rate", "48000", in, out)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("opusdec error: %v\n%s", err, output)
+			}
+
+			f, err := os.Open(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			stream, err := ReadWAV(f)
+			if err != nil {
+				t.Fatalf("ReadWAV() error: %v", err)
+			}
+			if stream.Format.Channels != 1 || stream.Format.SampleRate != opusSampleRate || stream.Format.BitsPerSample != 16 {
+				t.Fatalf("decoded format %+v, want 48 kHz 16-bit mono", stream.Format)
+			}
+			decoded := readSamples(t, stream)
+			if want := opusLength(n, rate); int64(len(decoded)) != want {
+				t.Fatalf("decoded %d samples, want %d", len(decoded), want)
+			}
+			// The tones are below the bandwidth of every rate, so the decoded audio matches them, but for the first
+			// and last frames
+			want := twoTones(len(decoded), opusSampleRate)
+			edge := celtFrameSize
+			if s := snr(decoded[edge:len(decoded)-edge], want[edge:len(want)-edge]); s < 12 {
+				t.Errorf("SNR = %.1f dB, want at least 12 dB", s)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package audio
+
+import "math/bits"
+
+// Range coder parameters of the Opus entropy coder (RFC 6716, section 4.1). Fractional bit counts are in 1/8 bits.
+const (
+	ecSymBits   = 8
+	ecCodeBits  = 32
+	ecSymMax    = 1<<ecSymBits - 1
+	ecCodeShift = ecCodeBits - ecSymBits - 1
+	ecCodeTop   = 1 << (ecCodeBits - 1)
+	ecCodeBot   = ecCodeTop >> ecSymBits
+	ecUintBits  = 8
+	ecWindow    = 32
+	bitRes      = 3
+)
+
+// rangeEncoder is the Opus range encoder, writing into a buffer of fixed size. Range coded symbols fill the buffer
+// from the start and raw bits from the end.
+type rangeEncoder struct {
+	buf        []byte
+	offs       int
+	endOffs    int
+	endWindow  uint32
+	nendBits   int
+	nbitsTotal int
+	rng        uint32
+	val        uint32
+	ext        int
+	rem        int
+	err        bool
+}
+
+func newRangeEncoder(buf []byte) *rangeEncoder {
+	return &rangeEncoder{buf: buf, nbitsTotal: ecCodeBits + 1, rng: ecCodeTop, rem: -1}
+}
+
+func ilog(x uint32) int {
+	return bits.Len32(x)
+}
+
+func (e *rangeEncoder) writeByte(b uint32) {
+	if e.offs+e.endOffs >= len(e.buf) {
+		e.err = true
+		return
+	}
+	e.buf[e.offs] = byte(b)
+	e.offs++
+}
+
+func (e *rangeEncoder) writeByteAtEnd(b uint32) {
+	if e.offs+e.endOffs >= len(e.buf) {
+		e.err = true
+		return
+	}
+	e.endOffs++
+	e.buf[len(e.buf)-e.endOffs] = byte(b)
+}
+
+// carryOut outputs a byte, holding back runs of 0xFF until the carry out of them is known.
+func (e *rangeEncoder) carryOut(c int) {
+	if c == ecSymMax {
+		e.ext++
+		return
+	}
+	carry := c >> ecSymBits
+	if e.rem >= 0 {
+		e.writeByte(uint32(e.rem + carry))
+	}
+	for ; e.ext > 0; e.ext-- {
+		e.writeByte(uint32((ecSymMax + carry) & ecSymMax))
+	}
+	e.rem = c & ecSymMax
+}
+
+func (e *rangeEncoder) normalize() {
+	for e.rng <= ecCodeBot {
+		e.carryOut(int(e.val >> ecCodeShift))
+		e.val = (e.val << ecSymBits) & (ecCodeTop - 1)
+		e.rng <<= ecSymBits
+		e.nbitsTotal += ecSymBits
+	}
+}
+
+// encode codes the symbol with the cumulative frequency range [fl, fh) out of ft.
+func (e *rangeEncoder) encode(fl, fh, ft uint32) {
+	r := e.rng / ft
+	if fl > 0 {
+		e.val += e.rng - r*(ft-fl)
+		e.rng = r * (fh - fl)
+	} else {
+		e.rng -= r * (ft - fh)
+	}
+	e.normalize()
+}
+
+// encodeBin is encode with ft = 1<<bits.
+func (e *rangeEncoder) encodeBin(fl, fh uint32, bits uint) {
+	r := e.rng >> bits
+	if fl > 0 {
+		e.val += e.rng - r*((1<<bits)-fl)
+		e.rng = r * (fh - fl)
+	} else {
+		e.rng -= r * ((1 << bits) - fh)
+	}
+	e.normalize()
+}
+
+// bitLogP codes a bit whose probability of being set is 1/2^logp.
+func (e *rangeEncoder) bitLogP(bit bool, logp uint) {
+	r := e.rng
+	l := e.val
+	s := r >> logp
+	r -= s
+	if bit {
+		e.val = l + r
+		e.rng = s
+	} else {
+		e.rng = r
+	}
+	e.normalize()
+}
+
+// icdf codes the symbol s with the inverse cumulative distribution icdf, out of 1<<ftb.
+func (e *rangeEncoder) icdf(s int, icdf []uint8, ftb uint) {
+	r := e.rng >> ftb
+	if s > 0 {
+		e.val += e.rng - r*uint32(icdf[s-1])
+		e.rng = r * uint32(icdf[s-1]-icdf[s])
+	} else {
+		e.rng -= r * uint32(icdf[s])
+	}
+	e.normalize()
+}
+
+// uint codes fl uniformly in [0, ft).
+func (e *rangeEncoder) uint(fl, ft uint32) {
+	ft--
+	ftb := ilog(ft)
+	if ftb > ecUintBits {
+		ftb -= ecUintBits
+		ft1 := (ft >> uint(ftb)) + 1
+		fl1 := fl >> uint(ftb)
+		e.encode(fl1, fl1+1, ft1)
+		e.rawBits(fl&(1<<uint(ftb)-1), ftb)
+	} else {
+		e.encode(fl, fl+1, ft+1)
+	}
+}
+
+// rawBits writes bits outside of the range coder, at the end of the buffer.
+func (e *rangeEncoder) rawBits(fl uint32, n int) {
+	window := e.endWindow
+	used := e.nendBits
+	if used+n > ecWindow {
+		for used >= ecSymBits {
+			e.writeByteAtEnd(window & ecSymMax)
+			window >>= ecSymBits
+			used -= ecSymBits
+		}
+	}
+	window |= fl << uint(used)
+	used += n
+	e.endWindow = window
+	e.nendBits = used
+	e.nbitsTotal += n
+}
+
+// tell returns the number of bits used so far, rounded up.
+func (e *rangeEncoder) tell() int {
+	return e.nbitsTotal - ilog(e.rng)
+}
+
+// tellFrac returns the number of bits used so far in 1/8 bits, rounded up.
+func (e *rangeEncoder) tellFrac() int {
+	nbits := e.nbitsTotal << bitRes
+	l := ilog(e.rng)
+	r := e.rng >> uint(l-16)
+	for i := bitRes; i > 0; i-- {
+		r = r * r >> 15
+		b := int(r >> 16)
+		l = l<<1 | b
+		r >>= uint(b)
+	}
+	return nbits - l
+}
+
+// done flushes the coder state, leaving the buffer holding the complete frame.
+func (e *rangeEncoder) done() {
+	l := ecCodeBits - ilog(e.rng)
+	msk := uint32(ecCodeTop-1) >> uint(l)
+	end := (e.val + msk) &^ msk
+	if end|msk >= e.val+e.rng {
+		l++
+		msk >>= 1
+		end = (e.val + msk) &^ msk
+	}
+	for l > 0 {
+		e.carryOut(int(end >> ecCodeShift))
+		end = (end << ecSymBits) & (ecCodeTop - 1)
+		l -= ecSymBits
+	}
+	if e.rem >= 0 || e.ext > 0 {
+		e.carryOut(0)
+	}
+	window := e.endWindow
+	used := e.nendBits
+	for used >= ecSymBits {
+		e.writeByteAtEnd(window & ecSymMax)
+		window >>= ecSymBits
+		used -= ecSymBits
+	}
+	if e.err {
+		return
+	}
+	clear(e.buf[e.offs : len(e.buf)-e.endOffs])
+	if used > 0 {
+		if e.endOffs >= len(e.buf) {
+			e.err = true
+			return
+		}
+		l = -l
+		if e.offs+e.endOffs >= len(e.buf) && l < used {
+			window &= 1<<uint(l) - 1
+			e.err = true
+		}
+		e.buf[len(e.buf)-e.endOffs-1] |= byte(window)
+	}
+}
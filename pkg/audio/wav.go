@@ -0,0 +1,150 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// WAVHeaderSize is the size of the canonical header written by WAVHeader.
+const WAVHeaderSize = 44
+
+// unknownSize is the chunk size used when streaming, before the length of the data is known.
+const unknownSize = 0xFFFFFFFF
+
+// WAVHeader returns a canonical 44-byte header for dataLen bytes of samples.
+func WAVHeader(format Format, dataLen uint32) []byte {
+	riffLen := uint32(unknownSize)
+	if dataLen != unknownSize {
+		riffLen = 36 + dataLen
+	}
+	header := make([]byte, WAVHeaderSize)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], riffLen)
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], uint16(format.Encoding))
+	binary.LittleEndian.PutUint16(header[22:], format.Channels)
+	binary.LittleEndian.PutUint32(header[24:], format.SampleRate)
+	binary.LittleEndian.PutUint32(header[28:], format.SampleRate*uint32(format.FrameSize()))
+	binary.LittleEndian.PutUint16(header[32:], uint16(format.FrameSize()))
+	binary.LittleEndian.PutUint16(header[34:], format.BitsPerSample)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], dataLen)
+	return header
+}
+
+// ReadWAV consumes the RIFF header and all the chunks preceding the sample data, and returns a stream that yields
+// the raw samples only.
+func ReadWAV(reader io.ReadCloser) (*Stream, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(reader, riff[:]); err != nil {
+		return nil, fmt.Errorf("error reading WAV header: %w", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errors.New("not a WAV stream")
+	}
+
+	var format *Format
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(reader, chunk[:]); err != nil {
+			return nil, fmt.Errorf("error reading WAV chunk header: %w", err)
+		}
+		id := string(chunk[0:4])
+		size := binary.LittleEndian.Uint32(chunk[4:8])
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, fmt.Errorf("invalid WAV fmt chunk size %d", size)
+			}
+			body := make([]byte, size+size%2)
+			if _, err := io.ReadFull(reader, body); err != nil {
+				return nil, fmt.Errorf("error reading WAV fmt chunk: %w", err)
+			}
+			format = &Format{
+				Encoding:      Encoding(binary.LittleEndian.Uint16(body[0:2])),
+				Channels:      binary.LittleEndian.Uint16(body[2:4]),
+				SampleRate:    binary.LittleEndian.Uint32(body[4:8]),
+				BitsPerSample: binary.LittleEndian.Uint16(body[14:16]),
+			}
+			if format.Channels == 0 || format.BitsPerSample == 0 {
+				return nil, fmt.Errorf("invalid WAV format %+v", *format)
+			}
+		case "data":
+			if format == nil {
+				return nil, errors.New("WAV data chunk found before fmt chunk")
+			}
+			// When streaming the size is unknown, and it's either left at zero or set to the maximum
+			var data io.Reader = reader
+			if size != 0 && size != unknownSize {
+				data = io.LimitReader(reader, int64(size))
+			}
+			return NewStream(data, *format, reader), nil
+		default:
+			if _, err := io.CopyN(io.Discard, reader, int64(size+size%2)); err != nil {
+				return nil, fmt.Errorf("error skipping WAV %q chunk: %w", id, err)
+			}
+		}
+	}
+}
+
+// FixWAVSizes writes the real RIFF and data chunk sizes into a complete WAV file, when they were left unknown while
+// streaming. It reports whether the file was recognized.
+func FixWAVSizes(wav []byte) bool {
+	if len(wav) < 12 || string(wav[0:4]) != "RIFF" || string(wav[8:12]) != "WAVE" || int64(len(wav))-8 > unknownSize {
+		return false
+	}
+	for pos := int64(12); pos+8 <= int64(len(wav)); {
+		size := binary.LittleEndian.Uint32(wav[pos+4 : pos+8])
+		if string(wav[pos:pos+4]) == "data" {
+			if size == 0 || size == unknownSize {
+				binary.LittleEndian.PutUint32(wav[pos+4:], uint32(int64(len(wav))-pos-8))
+			}
+			binary.LittleEndian.PutUint32(wav[4:], uint32(len(wav)-8))
+			return true
+		}
+		pos += 8 + int64(size) + int64(size%2)
+	}
+	return false
+}
+
+// wavEncoder writes the samples after a header with an unknown length, which is fixed on Close if the
+// destination is seekable.
+type wavEncoder struct {
+	w       io.Writer
+	format  Format
+	dataLen int64
+}
+
+// NewWAVEncoder returns an encoder that writes the samples as a WAV file, in the given format.
+func NewWAVEncoder(w io.Writer, format Format) (io.WriteCloser, error) {
+	if _, err := w.Write(WAVHeader(format, unknownSize)); err != nil {
+		return nil, err
+	}
+	return &wavEncoder{w: w, format: format}, nil
+}
+
+func (e *wavEncoder) Write(p []byte) (int, error) {
+	n, err := e.w.Write(p)
+	e.dataLen += int64(n)
+	return n, err
+}
+
+func (e *wavEncoder) Close() error {
+	ws, ok := e.w.(io.WriteSeeker)
+	if !ok || e.dataLen > unknownSize-36 {
+		return nil
+	}
+	if _, err := ws.Seek(0, io.SeekStart); err != nil {
+		// Not actually seekable, i.e. a pipe
+		return nil
+	}
+	if _, err := ws.Write(WAVHeader(e.format, uint32(e.dataLen))); err != nil {
+		return err
+	}
+	_, err := ws.Seek(0, io.SeekEnd)
+	return err
+}
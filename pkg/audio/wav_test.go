@@ -0,0 +1,105 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// streamedWAV returns a WAV file with unknown sizes, as written while streaming, with the given chunks between
+// the fmt and data chunks.
+func streamedWAV(format Format, extra []byte, data []byte) []byte {
+	header := WAVHeader(format, unknownSize)
+	wav := append([]byte{}, header[:36]...)
+	wav = append(wav, extra...)
+	wav = append(wav, header[36:]...)
+	return append(wav, data...)
+}
+
+func TestFixWAVSizes(t *testing.T) {
+	format := PCM16(16000, 1)
+	data := int16Bytes(nil, twoTones(1001, 16000))
+	list := append([]byte("LIST\x05\x00\x00\x00INFOx"), 0) // odd size, padded
+	tests := []struct {
+		name   string
+		wav    []byte
+		data   []byte
+		dataAt int
+	}{
+		{"canonical", streamedWAV(format, nil, data), data, 40},
+		{"extra chunk", streamedWAV(format, list, data), data, 40 + len(list)},
+		{"empty", streamedWAV(format, nil, nil), nil, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !FixWAVSizes(tt.wav) {
+				t.Fatal("FixWAVSizes() = false, want true")
+			}
+			if got, want := binary.LittleEndian.Uint32(tt.wav[4:]), uint32(len(tt.wav)-8); got != want {
+				t.Errorf("RIFF size = %d, want %d", got, want)
+			}
+			if got := binary.LittleEndian.Uint32(tt.wav[tt.dataAt:]); got != uint32(len(tt.data)) {
+				t.Errorf("data size = %d, want %d", got, len(tt.data))
+			}
+
+			stream, err := ReadWAV(io.NopCloser(bytes.NewReader(tt.wav)))
+			if err != nil {
+				t.Fatalf("ReadWAV() error: %v", err)
+			}
+			got, _ := io.ReadAll(stream)
+			if stream.Format != format || !bytes.Equal(got, tt.data) {
+				t.Errorf("ReadWAV() = %+v, %d bytes, want %+v, %d bytes", stream.Format, len(got), format, len(tt.data))
+			}
+		})
+	}
+
+	t.Run("known sizes", func(t *testing.T) {
+		wav := append(WAVHeader(format, uint32(len(data))), data...)
+		// Trailing bytes after the data chunk must not be counted in it
+		wav = append(wav, "junk"...)
+		if !FixWAVSizes(wav) {
+			t.Fatal("FixWAVSizes() = false, want true")
+		}
+		if got := binary.LittleEndian.Uint32(wav[40:]); got != uint32(len(data)) {
+			t.Errorf("data size = %d, want %d", got, len(data))
+		}
+	})
+
+	for _, invalid := range [][]byte{nil, []byte("RIFF\x00\x00\x00\x00AVI "), WAVHeader(format, unknownSize)[:36]} {
+		if FixWAVSizes(invalid) {
+			t.Errorf("FixWAVSizes(%q) = true, want false", invalid)
+		}
+	}
+}
+
+func TestWAVEncoder(t *testing.T) {
+	format := PCM16(22050, 2)
+	data := int16Bytes(nil, interleave(twoTones(500, 22050), twoTones(500, 22050)))
+
+	var file seekBuffer
+	enc, err := NewWAVEncoder(&file, format)
+	if err != nil {
+		t.Fatalf("NewWAVEncoder() error: %v", err)
+	}
+	if _, err := enc.Write(data); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	if want := append(WAVHeader(format, uint32(len(data))), data...); !bytes.Equal(file.data, want) {
+		t.Errorf("seekable output has header %x, want %x", file.data[:WAVHeaderSize], want[:WAVHeaderSize])
+	}
+
+	// Without seeking, the sizes are left unknown
+	var stream bytes.Buffer
+	if enc, err = NewWAVEncoder(&stream, format); err != nil {
+		t.Fatalf("NewWAVEncoder() error: %v", err)
+	}
+	_, _ = enc.Write(data)
+	_ = enc.Close()
+	if want := streamedWAV(format, nil, data); !bytes.Equal(stream.Bytes(), want) {
+		t.Errorf("streamed output has header %x, want %x", stream.Bytes()[:WAVHeaderSize], want[:WAVHeaderSize])
+	}
+}
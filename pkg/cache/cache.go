@@ -0,0 +1,170 @@
+// Package cache stores synthesized audio by content key, with an LRU size cap and a time to live.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Entry describes a cached item.
+type Entry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`      // Size is the size of the data and metadata in bytes
+	Created  time.Time `json:"created"`   // Created is when the item was stored
+	LastUsed time.Time `json:"last_used"` // LastUsed is when the item was last stored or read
+	Hits     uint64    `json:"hits"`      // Hits is the number of reads since the item was stored, or loaded from disk
+}
+
+type Stats struct {
+	Backend   string `json:"backend"`
+	Entries   int    `json:"entries"`
+	Size      int64  `json:"size"`      // Size is the total size of the items in bytes
+	MaxSize   int64  `json:"max_size"`  // MaxSize is the size above which the least recently used items are evicted
+	TTL       int64  `json:"ttl"`       // TTL is the time to live of the items in seconds, 0 if they do not expire
+	Hits      uint64 `json:"hits"`      // Hits is the number of successful reads
+	Misses    uint64 `json:"misses"`    // Misses is the number of reads of missing or expired items
+	Evictions uint64 `json:"evictions"` // Evictions is the number of items dropped for size or age
+}
+
+// Cache is a store of items made of data and opaque metadata. It is safe for concurrent use.
+type Cache interface {
+	// Get returns the item stored with the key, unless it has expired.
+	Get(key string) (data, meta []byte, ok bool)
+	// Put stores an item, evicting the least recently used ones if the cache grows above its maximum size.
+	Put(key string, data, meta []byte) error
+	// Delete removes an item, and tells whether it was present.
+	Delete(key string) bool
+	// Purge removes all the items.
+	Purge() error
+	// Entries lists the items, most recently used first.
+	Entries() []Entry
+	Stats() Stats
+}
+
+// index tracks the items of a cache in LRU order and enforces its limits. The backends hold its lock while
+// accessing their storage, and are notified of the items to drop through remove.
+type index struct {
+	maxSize int64
+	ttl     time.Duration
+	remove  func(key string)
+
+	mu      sync.Mutex
+	order   *list.List // order holds *Entry, most recently used first
+	entries map[string]*list.Element
+	size    int64
+	stats   Stats
+}
+
+func newIndex(backend string, maxSize int64, ttl time.Duration, remove func(key string)) *index {
+	return &index{
+		maxSize: maxSize,
+		ttl:     ttl,
+		remove:  remove,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		stats:   Stats{Backend: backend, MaxSize: maxSize, TTL: int64(ttl / time.Second)},
+	}
+}
+
+func (x *index) expired(e *Entry, now time.Time) bool {
+	return x.ttl > 0 && now.Sub(e.Created) >= x.ttl
+}
+
+// lookup finds a live item and marks it as used, counting the hit or the miss. The lock must be held.
+func (x *index) lookup(key string) (*Entry, bool) {
+	now := time.Now()
+	el, ok := x.entries[key]
+	if ok && x.expired(el.Value.(*Entry), now) {
+		x.drop(el)
+		x.stats.Evictions++
+		ok = false
+	}
+	if !ok {
+		x.stats.Misses++
+		return nil, false
+	}
+	e := el.Value.(*Entry)
+	e.LastUsed = now
+	e.Hits++
+	x.order.MoveToFront(el)
+	x.stats.Hits++
+	return e, true
+}
+
+// add records an item, replacing the one with the same key, and evicts items above the size limit. It returns false
+// if the item alone is larger than the limit, in which case it is not recorded. The lock must be held.
+func (x *index) add(e *Entry) bool {
+	if el, ok := x.entries[e.Key]; ok {
+		x.drop(el)
+	}
+	if x.maxSize > 0 && e.Size > x.maxSize {
+		return false
+	}
+	x.entries[e.Key] = x.order.PushFront(e)
+	x.size += e.Size
+	x.evict(e.Key)
+	return true
+}
+
+// evict drops expired items and the least recently used ones above the size limit, except the given key. The lock
+// must be held.
+func (x *index) evict(keep string) {
+	now := time.Now()
+	for el := x.order.Back(); el != nil; {
+		prev := el.Prev()
+		e := el.Value.(*Entry)
+		if e.Key != keep && (x.expired(e, now) || (x.maxSize > 0 && x.size > x.maxSize)) {
+			x.drop(el)
+			x.stats.Evictions++
+		}
+		el = prev
+	}
+}
+
+// drop removes an item from the index and from the backend. The lock must be held.
+func (x *index) drop(el *list.Element) {
+	e := x.order.Remove(el).(*Entry)
+	delete(x.entries, e.Key)
+	x.size -= e.Size
+	x.remove(e.Key)
+}
+
+func (x *index) delete(key string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	el, ok := x.entries[key]
+	if ok {
+		x.drop(el)
+	}
+	return ok
+}
+
+func (x *index) purge() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for el := x.order.Front(); el != nil; el = x.order.Front() {
+		x.drop(el)
+	}
+}
+
+func (x *index) list() []Entry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.evict("")
+	res := make([]Entry, 0, x.order.Len())
+	for el := x.order.Front(); el != nil; el = el.Next() {
+		res = append(res, *el.Value.(*Entry))
+	}
+	return res
+}
+
+func (x *index) statistics() Stats {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.evict("")
+	stats := x.stats
+	stats.Entries = x.order.Len()
+	stats.Size = x.size
+	return stats
+}
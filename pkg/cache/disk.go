@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Extensions of the files of an item. The modification time of the data file is its last use, the one of the
+// metadata file its creation.
+const (
+	dataExt = ".data"
+	metaExt = ".meta"
+	// tmpPrefix is the prefix of the files being written, removed at startup if left over
+	tmpPrefix = "tmp-"
+)
+
+// Disk is a cache that stores each item as a pair of files in a directory, and survives restarts.
+type Disk struct {
+	*index
+	dir string
+}
+
+// NewDisk opens a disk cache in dir, creating it if needed, holding up to maxSize bytes, 0 for no limit, for ttl,
+// 0 for no expiry. The items already in the directory are loaded, and evicted if they exceed the limits.
+func NewDisk(dir string, maxSize int64, ttl time.Duration) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+	d := &Disk{dir: dir}
+	d.index = newIndex("disk", maxSize, ttl, d.removeFiles)
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ValidKey tells whether a key can be used as a file name, that is, whether it is made of letters, digits, dashes
+// and underscores only.
+func ValidKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Disk) path(key, ext string) string {
+	return filepath.Join(d.dir, key+ext)
+}
+
+func (d *Disk) removeFiles(key string) {
+	for _, ext := range []string{dataExt, metaExt} {
+		if err := os.Remove(d.path(key, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Str("key", key).Msg("error removing cache file")
+		}
+	}
+}
+
+func (d *Disk) load() error {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return fmt.Errorf("error reading cache directory: %w", err)
+	}
+	var entries []*Entry
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), tmpPrefix) {
+			_ = os.Remove(filepath.Join(d.dir, f.Name()))
+			continue
+		}
+		key, ok := strings.CutSuffix(f.Name(), dataExt)
+		if !ok || !ValidKey(key) {
+			continue
+		}
+		data, dErr := os.Stat(d.path(key, dataExt))
+		meta, mErr := os.Stat(d.path(key, metaExt))
+		if dErr != nil || mErr != nil {
+			// Incomplete item, left by an interrupted write
+			d.removeFiles(key)
+			continue
+		}
+		entries = append(entries, &Entry{
+			Key:      key,
+			Size:     data.Size() + meta.Size(),
+			Created:  meta.ModTime(),
+			LastUsed: data.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.Before(entries[j].LastUsed) })
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range entries {
+		d.entries[e.Key] = d.order.PushFront(e)
+		d.size += e.Size
+	}
+	d.evict("")
+	log.Debug().Int("entries", d.order.Len()).Int64("size", d.size).Str("dir", d.dir).Msg("loaded disk cache")
+	return nil
+}
+
+func (d *Disk) Get(key string) ([]byte, []byte, bool) {
+	if !ValidKey(key) {
+		return nil, nil, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.lookup(key)
+	if !ok {
+		return nil, nil, false
+	}
+	data, err := os.ReadFile(d.path(key, dataExt))
+	var meta []byte
+	if err == nil {
+		meta, err = os.ReadFile(d.path(key, metaExt))
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("error reading cache item, dropping it")
+		d.drop(d.entries[key])
+		return nil, nil, false
+	}
+	_ = os.Chtimes(d.path(key, dataExt), e.LastUsed, e.LastUsed)
+	return data, meta, true
+}
+
+func (d *Disk) Put(key string, data, meta []byte) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("invalid cache key %q", key)
+	}
+	// Write to temporary files first, so that readers never see a partial item
+	dataTmp, err := writeTemp(d.dir, data)
+	if err != nil {
+		return err
+	}
+	metaTmp, err := writeTemp(d.dir, meta)
+	if err != nil {
+		_ = os.Remove(dataTmp)
+		return err
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.add(&Entry{Key: key, Size: int64(len(data) + len(meta)), Created: now, LastUsed: now}) {
+		_ = os.Remove(dataTmp)
+		_ = os.Remove(metaTmp)
+		return nil
+	}
+	err = os.Rename(metaTmp, d.path(key, metaExt))
+	if err == nil {
+		err = os.Rename(dataTmp, d.path(key, dataExt))
+	}
+	if err != nil {
+		_ = os.Remove(dataTmp)
+		_ = os.Remove(metaTmp)
+		d.drop(d.entries[key])
+		return fmt.Errorf("error storing cache item: %w", err)
+	}
+	return nil
+}
+
+func writeTemp(dir string, b []byte) (string, error) {
+	f, err := os.CreateTemp(dir, tmpPrefix+"*")
+	if err != nil {
+		return "", fmt.Errorf("error creating cache file: %w", err)
+	}
+	_, err = f.Write(b)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("error writing cache file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+func (d *Disk) Delete(key string) bool {
+	return d.delete(key)
+}
+
+func (d *Disk) Purge() error {
+	d.purge()
+	return nil
+}
+
+func (d *Disk) Entries() []Entry {
+	return d.list()
+}
+
+func (d *Disk) Stats() Stats {
+	return d.statistics()
+}
@@ -0,0 +1,57 @@
+package cache
+
+import "time"
+
+type memoryItem struct {
+	data, meta []byte
+}
+
+// Memory is a cache that keeps the items in memory.
+type Memory struct {
+	*index
+	items map[string]memoryItem
+}
+
+// NewMemory creates an in-memory cache holding up to maxSize bytes, 0 for no limit, for ttl, 0 for no expiry.
+func NewMemory(maxSize int64, ttl time.Duration) *Memory {
+	m := &Memory{items: make(map[string]memoryItem)}
+	m.index = newIndex("memory", maxSize, ttl, func(key string) { delete(m.items, key) })
+	return m
+}
+
+func (m *Memory) Get(key string) ([]byte, []byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lookup(key); !ok {
+		return nil, nil, false
+	}
+	item := m.items[key]
+	return item.data, item.meta, true
+}
+
+func (m *Memory) Put(key string, data, meta []byte) error {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.add(&Entry{Key: key, Size: int64(len(data) + len(meta)), Created: now, LastUsed: now}) {
+		m.items[key] = memoryItem{data: data, meta: meta}
+	}
+	return nil
+}
+
+func (m *Memory) Delete(key string) bool {
+	return m.delete(key)
+}
+
+func (m *Memory) Purge() error {
+	m.purge()
+	return nil
+}
+
+func (m *Memory) Entries() []Entry {
+	return m.list()
+}
+
+func (m *Memory) Stats() Stats {
+	return m.statistics()
+}
@@ -0,0 +1,215 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Quota periods, in UTC.
+const (
+	Daily   = "daily"
+	Monthly = "monthly"
+)
+
+// QuotaLimits are the amounts allowed per period, 0 for no limit.
+type QuotaLimits struct {
+	Daily   int64
+	Monthly int64
+}
+
+func (l QuotaLimits) Enabled() bool {
+	return l.Daily > 0 || l.Monthly > 0
+}
+
+// QuotaPeriod is the state of the quota of a period.
+type QuotaPeriod struct {
+	Limit     int64
+	Remaining int64
+	Reset     time.Duration // Reset is the time until the start of the next period
+}
+
+// QuotaResult is the outcome of Quotas.Use.
+type QuotaResult struct {
+	Allowed   bool
+	Exhausted string // Exhausted is the period whose quota would be exceeded, if not allowed
+	Daily     QuotaPeriod
+	Monthly   QuotaPeriod
+	At        time.Time // At is when the usage was counted, to refund it
+}
+
+// usage is the amount used by a key in the current periods.
+type usage struct {
+	Day       string `json:"day"` // Day is the current day, as YYYY-MM-DD
+	DayUsed   int64  `json:"day_used"`
+	Month     string `json:"month"` // Month is the current month, as YYYY-MM
+	MonthUsed int64  `json:"month_used"`
+}
+
+// Quotas tracks the usage of keys over days and months, and saves it to a JSON file. It is safe for concurrent use.
+type Quotas struct {
+	path string
+
+	mu    sync.Mutex
+	usage map[string]*usage
+	dirty bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OpenQuotas loads the usage saved in path, if it exists, and saves it back every flushInterval while it changes.
+// With an empty path, usage is only kept in memory.
+func OpenQuotas(path string, flushInterval time.Duration) (*Quotas, error) {
+	q := &Quotas{path: path, usage: make(map[string]*usage), stop: make(chan struct{})}
+	if path == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading quota file: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &q.usage); err != nil {
+			return nil, fmt.Errorf("error parsing quota file %s: %w", path, err)
+		}
+	}
+	q.wg.Add(1)
+	go q.flushLoop(flushInterval)
+	return q, nil
+}
+
+// Use adds n to the usage of the key, unless that would exceed one of the limits, in which case nothing is used.
+func (q *Quotas) Use(key string, n int64, limits QuotaLimits) QuotaResult {
+	now := time.Now().UTC()
+	day, month := now.Format(time.DateOnly), now.Format("2006-01")
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.usage[key]
+	if !ok {
+		u = &usage{}
+		q.usage[key] = u
+	}
+	if u.Day != day {
+		u.Day, u.DayUsed = day, 0
+	}
+	if u.Month != month {
+		u.Month, u.MonthUsed = month, 0
+	}
+
+	res := QuotaResult{Allowed: true, At: now}
+	switch {
+	case limits.Daily > 0 && u.DayUsed+n > limits.Daily:
+		res.Allowed, res.Exhausted = false, Daily
+	case limits.Monthly > 0 && u.MonthUsed+n > limits.Monthly:
+		res.Allowed, res.Exhausted = false, Monthly
+	default:
+		u.DayUsed += n
+		u.MonthUsed += n
+		q.dirty = true
+	}
+
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	res.Daily = QuotaPeriod{
+		Limit:     limits.Daily,
+		Remaining: max(limits.Daily-u.DayUsed, 0),
+		Reset:     startOfDay.AddDate(0, 0, 1).Sub(now),
+	}
+	res.Monthly = QuotaPeriod{
+		Limit:     limits.Monthly,
+		Remaining: max(limits.Monthly-u.MonthUsed, 0),
+		Reset:     time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Sub(now),
+	}
+	return res
+}
+
+// Refund removes n from the usage of the key counted by Use at the given time, in the periods that have not ended
+// since.
+func (q *Quotas) Refund(key string, n int64, at time.Time) {
+	at = at.UTC()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.usage[key]
+	if !ok {
+		return
+	}
+	if u.Day == at.Format(time.DateOnly) {
+		u.DayUsed = max(u.DayUsed-n, 0)
+		q.dirty = true
+	}
+	if u.Month == at.Format("2006-01") {
+		u.MonthUsed = max(u.MonthUsed-n, 0)
+		q.dirty = true
+	}
+}
+
+func (q *Quotas) flushLoop(interval time.Duration) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			if err := q.flush(); err != nil {
+				log.Warn().Err(err).Msg("error saving quota usage")
+			}
+		}
+	}
+}
+
+// flush saves the usage if it changed since the last save.
+func (q *Quotas) flush() error {
+	q.mu.Lock()
+	if !q.dirty || q.path == "" {
+		q.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(q.usage)
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that a crash never leaves a truncated file
+	f, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating quota file: %w", err)
+	}
+	_, err = f.Write(data)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), q.path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+		return fmt.Errorf("error writing quota file: %w", err)
+	}
+	return nil
+}
+
+// Close stops the periodic saves and saves the usage a last time.
+func (q *Quotas) Close() error {
+	select {
+	case <-q.stop:
+		return nil
+	default:
+	}
+	close(q.stop)
+	q.wg.Wait()
+	return q.flush()
+}
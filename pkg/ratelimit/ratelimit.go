@@ -0,0 +1,137 @@
+// Package ratelimit limits the rate of requests with token buckets, and tracks usage quotas over calendar periods.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the buckets that have refilled completely are dropped.
+const sweepInterval = time.Minute
+
+// Rate is the capacity of a token bucket and the time it takes to refill from empty. A zero Rate is no limit.
+type Rate struct {
+	Limit  float64
+	Period time.Duration
+}
+
+// PerSecond returns a rate of n tokens per second, with a capacity of n, at least 1.
+func PerSecond(n float64) Rate {
+	if n <= 0 {
+		return Rate{}
+	}
+	limit := math.Max(n, 1)
+	return Rate{Limit: limit, Period: time.Duration(float64(time.Second) * limit / n)}
+}
+
+// PerMinute returns a rate of n tokens per minute, with a capacity of n.
+func PerMinute(n float64) Rate {
+	if n <= 0 {
+		return Rate{}
+	}
+	return Rate{Limit: n, Period: time.Minute}
+}
+
+func (r Rate) Enabled() bool {
+	return r.Limit > 0 && r.Period > 0
+}
+
+// perSecond returns the refill speed of the bucket.
+func (r Rate) perSecond() float64 {
+	return r.Limit / r.Period.Seconds()
+}
+
+// Result is the outcome of Limiter.Take.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // Reset is the time until the bucket is full again
+	RetryAfter time.Duration // RetryAfter is the time until the request would be allowed, 0 if it was
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   Rate
+}
+
+// refill adds the tokens accumulated since the last update.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.rate.Limit, b.tokens+now.Sub(b.last).Seconds()*b.rate.perSecond())
+	b.last = now
+}
+
+// Limiter is a set of token buckets, identified by key. It is safe for concurrent use.
+type Limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// Take removes n tokens from the bucket of the key, created full with the given rate if needed. A request of more
+// tokens than the capacity is allowed once the bucket is full, and leaves it in debt, so that large requests are
+// delayed rather than rejected forever.
+func (l *Limiter) Take(key string, rate Rate, n float64) Result {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate {
+		b = &bucket{tokens: rate.Limit, last: now, rate: rate}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+
+	res := Result{Limit: int(rate.Limit)}
+	need := math.Min(n, rate.Limit)
+	if b.tokens >= need {
+		b.tokens -= n
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((need - b.tokens) / rate.perSecond())
+	}
+	res.Remaining = max(int(math.Floor(b.tokens)), 0)
+	res.Reset = seconds((rate.Limit - b.tokens) / rate.perSecond())
+	return res
+}
+
+// Refund gives back n tokens taken from the bucket of the key, when the request they were taken for was rejected
+// for another reason.
+func (l *Limiter) Refund(key string, rate Rate, n float64) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate {
+		// Swept because full, or reset by a rate change
+		return
+	}
+	b.refill(now)
+	b.tokens = math.Min(rate.Limit, b.tokens+n)
+}
+
+// sweep drops the buckets that are full, which are the same as new ones. The lock must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.rate.Limit {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
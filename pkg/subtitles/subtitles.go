@@ -0,0 +1,161 @@
+package subtitles
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"loq7tts-server/loquendo"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type Format string
+
+const (
+	FormatWebVTT Format = "vtt"
+	FormatSRT    Format = "srt"
+)
+
+// MaxLineLength is the maximum number of characters per subtitle line; cues have at most two lines.
+const MaxLineLength = 42
+
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimPrefix(name, ".")) {
+	case "vtt", "webvtt":
+		return FormatWebVTT, nil
+	case "srt":
+		return FormatSRT, nil
+	default:
+		return "", fmt.Errorf("unsupported subtitle format: %s", name)
+	}
+}
+
+// FormatFromPath returns the subtitle format matching the extension of the file name.
+func FormatFromPath(path string) (Format, error) {
+	return ParseFormat(filepath.Ext(path))
+}
+
+func (f Format) MimeType() string {
+	if f == FormatSRT {
+		return "application/x-subrip"
+	}
+	return "text/vtt"
+}
+
+// FromTimings builds one cue per sentence. Sentences that do not fit in two lines are split at word boundaries,
+// using the word timings.
+func FromTimings(timings loquendo.Timings) []Cue {
+	var cues []Cue
+	for _, s := range timings.Sentences {
+		if s.Text == "" {
+			continue
+		}
+		if utf8.RuneCountInString(s.Text) <= 2*MaxLineLength {
+			cues = append(cues, Cue{Start: s.Start, End: s.End, Text: wrap(s.Text)})
+			continue
+		}
+
+		var words []loquendo.WordTiming
+		for _, w := range timings.Words {
+			if w.Sentence == s.Index {
+				words = append(words, w)
+			}
+		}
+		if len(words) == 0 {
+			cues = append(cues, Cue{Start: s.Start, End: s.End, Text: wrap(s.Text)})
+			continue
+		}
+
+		var current []string
+		start := s.Start
+		length := 0
+		for i, w := range words {
+			wordLen := utf8.RuneCountInString(w.Text)
+			if len(current) > 0 && length+1+wordLen > 2*MaxLineLength {
+				cues = append(cues, Cue{Start: start, End: w.Start, Text: wrap(strings.Join(current, " "))})
+				current = nil
+				length = 0
+				start = w.Start
+			}
+			if len(current) > 0 {
+				length++
+			}
+			current = append(current, w.Text)
+			length += wordLen
+			if i == len(words)-1 {
+				cues = append(cues, Cue{Start: start, End: s.End, Text: wrap(strings.Join(current, " "))})
+			}
+		}
+	}
+	return cues
+}
+
+// wrap breaks the text in two lines, at the space closest to the middle, if it's longer than MaxLineLength.
+func wrap(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= MaxLineLength {
+		return text
+	}
+	middle := len(text) / 2
+	best := -1
+	for i, r := range text {
+		if r == ' ' && (best < 0 || abs(i-middle) < abs(best-middle)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return text
+	}
+	return text[:best] + "\n" + text[best+1:]
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func formatTimestamp(d time.Duration, decimalSep string) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, decimalSep, ms%1000)
+}
+
+func WriteVTT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString("WEBVTT\n")
+	for i, c := range cues {
+		_, _ = fmt.Fprintf(bw, "\n%d\n%s --> %s\n%s\n", i+1, formatTimestamp(c.Start, "."), formatTimestamp(c.End, "."), c.Text)
+	}
+	return bw.Flush()
+}
+
+func WriteSRT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	for i, c := range cues {
+		if i > 0 {
+			_, _ = bw.WriteString("\n")
+		}
+		_, _ = fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n", i+1, formatTimestamp(c.Start, ","), formatTimestamp(c.End, ","), c.Text)
+	}
+	return bw.Flush()
+}
+
+func Write(w io.Writer, format Format, cues []Cue) error {
+	switch format {
+	case FormatWebVTT:
+		return WriteVTT(w, cues)
+	case FormatSRT:
+		return WriteSRT(w, cues)
+	default:
+		return fmt.Errorf("unsupported subtitle format: %s", format)
+	}
+}
@@ -0,0 +1,16 @@
+#!/bin/bash
+set -euo pipefail
+
+# Check the readiness of the server, on the address it listens on according to LOQTTS_ADDR.
+
+ADDR="${LOQTTS_ADDR:-:8080}"
+PORT="${ADDR##*:}"
+HOST="${ADDR%:*}"
+
+# A wildcard address accepts connections on loopback
+case "$HOST" in
+  "" | "0.0.0.0") HOST="127.0.0.1" ;;
+  "[::]" | "::") HOST="[::1]" ;;
+esac
+
+exec curl -fsS -o /dev/null "http://$HOST:$PORT/readyz"
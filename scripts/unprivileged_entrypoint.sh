@@ -3,4 +3,5 @@ set -euo pipefail
 
 source auto_xvfb
 
-"$@" 2>&1 | grep -v fixme
+# Replace the shell, so that the server receives the stop signal, and filter the output in a separate process
+exec "$@" > >(grep -v fixme) 2>&1